@@ -36,6 +36,8 @@ func main() {
 			flags.String("pprof-listen-addr", "localhost:6060", "[Operator] If non-empty, the process will listen on this address for pprof analysis (see https://golang.org/pkg/net/http/pprof/)")
 			flags.String("cursors-table", "cursors", "[Operator] Name of the table to use for storing cursors")
 			flags.String("history-table", "substreams_history", "[Operator] Name of the table to use for storing block history, used to handle reorgs")
+			flags.String("completions-table", "substreams_completions", "[Operator] Name of the table to use for recording modules that completed their requested block range")
+			flags.String("reorgs-table", "substreams_reorgs", "[Operator] Name of the table to use for recording the reorgs reverted")
 		}),
 		AfterAllHook(func(cmd *cobra.Command) {
 			cmd.PersistentPreRun = preStart
@@ -47,6 +49,8 @@ func preStart(cmd *cobra.Command, _ []string) {
 
 	db.CURSORS_TABLE = sflags.MustGetString(cmd, "cursors-table")
 	db.HISTORY_TABLE = sflags.MustGetString(cmd, "history-table")
+	db.COMPLETIONS_TABLE = sflags.MustGetString(cmd, "completions-table")
+	db.REORGS_TABLE = sflags.MustGetString(cmd, "reorgs-table")
 
 	delay := sflags.MustGetDuration(cmd, "delay-before-start")
 	if delay > 0 {
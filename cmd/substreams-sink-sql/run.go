@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -9,10 +10,17 @@ import (
 	. "github.com/streamingfast/cli"
 	"github.com/streamingfast/cli/sflags"
 	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams-sink-sql/db"
 	"github.com/streamingfast/substreams-sink-sql/sinker"
 	"github.com/streamingfast/substreams/manifest"
+	"go.uber.org/zap"
 )
 
+// completedExitCode is the exit code of `run` once the requested block range has been
+// fully processed, distinguishing it from a run stopped before reaching its stop block
+// (exit code 0) or failing (exit code 1).
+const completedExitCode = 3
+
 type ignoreUndoBufferSize struct{}
 
 func (i ignoreUndoBufferSize) IsIgnored(in string) bool {
@@ -28,7 +36,12 @@ var sinkRunCmd = Command(sinkRunE,
 		AddCommonSinkerFlags(flags)
 
 		flags.Int("undo-buffer-size", 0, "If non-zero, handling of reorgs in the database is disabled. Instead, a buffer is introduced to only process a blocks once it has been confirmed by that many blocks, introducing a latency but slightly reducing the load on the database when close to head.")
-		flags.Int("flush-interval", 1000, "When in catch up mode, flush every N blocks")
+		flags.Uint64("flush-interval", 1000, "When in catch up mode, flush every N blocks")
+		flags.Uint64("flush-max-rows", 0, "Also flush as soon as that many rows are waiting to be written, in catch up and live modes, 0 disables this limit")
+		flags.Uint64("flush-max-bytes", 256*1024*1024, "Also flush as soon as the data waiting to be written reaches approximately that many bytes, in catch up and live modes, 0 disables this limit")
+		flags.Duration("flush-max-delay", 0, "Also flush as soon as that much time elapsed since the last flush, in catch up and live modes, 0 disables this limit, ignored on ClickHouse")
+		flags.Uint64("live-flush-interval", 1, "When in live mode, flush every N blocks, batching blocks reduces the load on the database on chains with fast blocks")
+		flags.Duration("live-flush-max-latency", time.Second, "When in live mode and batching blocks, flush pending blocks once the oldest one has been waiting that long, even if --live-flush-interval is not reached, 0 disables this limit, ignored on ClickHouse")
 		flags.StringP("endpoint", "e", "", "Specify the substreams endpoint, ex: `mainnet.eth.streamingfast.io:443`")
 	}),
 	OnCommandErrorLogAndExit(zlog),
@@ -39,6 +52,7 @@ func sinkRunE(cmd *cobra.Command, args []string) error {
 
 	sink.RegisterMetrics()
 	sinker.RegisterMetrics()
+	db.RegisterMetrics()
 
 	dsn := args[0]
 	manifestPath := args[1]
@@ -84,17 +98,39 @@ func sinkRunE(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("new base sinker: %w", err)
 	}
 
-	dbLoader, err := newDBLoader(cmd, dsn, sflags.MustGetDuration(cmd, "flush-interval"), handleReorgs)
+	dbLoader, err := newDBLoader(cmd, dsn, handleReorgs)
 	if err != nil {
 		return fmt.Errorf("new db loader: %w", err)
 	}
 
-	postgresSinker, err := sinker.New(sink, dbLoader, zlog, tracer)
+	if err := dbLoader.ValidateTables(); err != nil {
+		zlog.Warn("tables are not declared as required to be written safely", zap.Error(err))
+	}
+
+	flushPolicy := sinker.FlushPolicy{
+		Blocks:         sflags.MustGetUint64(cmd, "flush-interval"),
+		LiveBlocks:     sflags.MustGetUint64(cmd, "live-flush-interval"),
+		LiveMaxLatency: sflags.MustGetDuration(cmd, "live-flush-max-latency"),
+		Rows:           sflags.MustGetUint64(cmd, "flush-max-rows"),
+		Bytes:          sflags.MustGetUint64(cmd, "flush-max-bytes"),
+		Interval:       sflags.MustGetDuration(cmd, "flush-max-delay"),
+	}
+
+	postgresSinker, err := sinker.New(sink, dbLoader, flushPolicy, zlog, tracer)
 	if err != nil {
 		return fmt.Errorf("unable to setup postgres sinker: %w", err)
 	}
 
 	app.SuperviseAndStart(postgresSinker)
 
-	return app.WaitForTermination(zlog, 0*time.Second, 30*time.Second)
+	if err := app.WaitForTermination(zlog, 0*time.Second, 30*time.Second); err != nil {
+		return err
+	}
+
+	if postgresSinker.Completed() {
+		zlog.Info("requested block range completed", zap.Int("exit_code", completedExitCode))
+		os.Exit(completedExitCode)
+	}
+
+	return nil
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/substreams-sink-sql/db"
 	"github.com/streamingfast/substreams/manifest"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
 )
 
 var sinkSetupCmd = Command(sinkSetupE,
@@ -46,7 +47,7 @@ func sinkSetupE(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("extract sink config: %w", err)
 	}
 
-	dbLoader, err := db.NewLoader(dsn, 0, db.OnModuleHashMismatchError, nil, zlog, tracer)
+	dbLoader, err := db.NewLoader(dsn, db.OnModuleHashMismatchError, nil, zlog, tracer)
 	if err != nil {
 		return fmt.Errorf("new psql loader: %w", err)
 	}
@@ -64,10 +65,40 @@ func sinkSetupE(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("setup: %w", err)
 		}
 	}
+	if err := dbLoader.LoadTables(); err != nil {
+		return fmt.Errorf("load tables: %w", err)
+	}
+
+	if err := dbLoader.ValidateTables(); err != nil {
+		return fmt.Errorf("validate tables: %w", err)
+	}
+
+	if err := dbLoader.SetupPartitions(ctx, sinkModuleInitialBlock(pkgBundle.Package)); err != nil {
+		return fmt.Errorf("setup partitions: %w", err)
+	}
+
+	if err := dbLoader.SetupPendingTables(ctx, sflags.MustGetBool(cmd, "postgraphile")); err != nil {
+		return fmt.Errorf("setup pending tables: %w", err)
+	}
+
 	zlog.Info("setup completed successfully")
 	return nil
 }
 
+// sinkModuleInitialBlock returns the initial block of the package's sink module, 0 if unknown.
+func sinkModuleInitialBlock(pkg *pbsubstreams.Package) uint64 {
+	if pkg.Modules == nil {
+		return 0
+	}
+
+	for _, module := range pkg.Modules.Modules {
+		if module.Name == pkg.SinkModule {
+			return module.InitialBlock
+		}
+	}
+	return 0
+}
+
 func isDuplicateTableError(err error) bool {
 	var sqlError *pq.Error
 	if !errors.As(err, &sqlError) {
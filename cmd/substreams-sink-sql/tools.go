@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/cli"
 	. "github.com/streamingfast/cli"
 	sink "github.com/streamingfast/substreams-sink"
@@ -62,6 +63,44 @@ var sinkToolsCmd = Group(
 			}),
 		),
 	),
+
+	Command(toolsHistoryE,
+		"history",
+		"[Operator] Show the changes recorded in the reorg history, grouped by block and table",
+		Description(`
+			This command is going to list the amount of inserts, updates and deletes recorded
+			in the history table for each block and table. The history holds the changes of
+			reversible blocks, those that can be undone by a reorg or by 'tools rollback'.
+		`),
+	),
+
+	Command(toolsRollbackE,
+		"rollback <module_hash>",
+		"[Operator] Revert the changes recorded in the reorg history after a block and rewind the module's cursor to it",
+		Description(`
+			**Warning** This can screw up 'substreams-sink-sql' state, use only if you know what you are doing.
+
+			This command is going to revert the changes recorded in the history table for the
+			blocks after '--to-block', exactly like a reorg undoing them would, and rewrite the
+			cursor of the given module's hash to '--to-block' within the same transaction. The
+			next 'run' resumes streaming right after it.
+
+			The rollback is refused when '--to-block' is not below the current cursor, or when
+			the changes of the blocks after it are not all retained in the history (or in the
+			pending tables with the 'pending_tables' DSN option): the oldest block retained must
+			be at most right after '--to-block', see 'tools history'.
+
+			The cursor written marks '--to-block' as final only when it's not after the last
+			final block of the current cursor, it keeps the final block of the current cursor
+			otherwise so that the stream still undoes '--to-block' if it's forked out.
+			'--to-block-id' must be its ID (hash) as known by the chain.
+		`),
+		ExactArgs(1),
+		Flags(func(flags *pflag.FlagSet) {
+			flags.Uint64("to-block", 0, "The block to roll back to, the changes of the blocks after it are reverted")
+			flags.String("to-block-id", "", "The ID (hash) of the block to roll back to, recorded in the cursor")
+		}),
+	),
 )
 
 func toolsReadCursorE(cmd *cobra.Command, _ []string) error {
@@ -143,9 +182,50 @@ func toolsDeleteCursorE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func toolsHistoryE(cmd *cobra.Command, _ []string) error {
+	loader := toolsCreateLoader()
+
+	entries, err := loader.History(cmd.Context())
+	cli.NoError(err, "Unable to read the history")
+
+	if len(entries) == 0 {
+		fmt.Println("No change recorded in the history")
+		return nil
+	}
+
+	for i, entry := range entries {
+		if i == 0 || entries[i-1].BlockNum != entry.BlockNum {
+			fmt.Printf("Block #%d\n", entry.BlockNum)
+		}
+		fmt.Printf("  %s: %d insert(s), %d update(s), %d delete(s)\n", entry.Table, entry.Inserts, entry.Updates, entry.Deletes)
+	}
+
+	return nil
+}
+
+func toolsRollbackE(cmd *cobra.Command, args []string) error {
+	loader := toolsCreateLoader()
+
+	moduleHash := args[0]
+	toBlock := viper.GetUint64("tools-rollback-to-block")
+	toBlockID := viper.GetString("tools-rollback-to-block-id")
+
+	cli.Ensure(len(moduleHash) == 40, "The <module_hash> must be exactly 40 characters long")
+	cli.Ensure(cmd.Flags().Changed("to-block"), "The --to-block flag is required")
+	cli.Ensure(toBlockID != "", "The --to-block-id flag is required")
+
+	cursor, err := loader.Rollback(cmd.Context(), moduleHash, bstream.NewBlockRef(toBlockID, toBlock))
+	cli.NoError(err, "Unable to roll back")
+
+	fmt.Println("Rolled back successfully")
+	fmt.Printf("- Block %s\n", cursor.Block())
+	fmt.Printf("- Cursor %q\n", cursorToShortString(cursor))
+	return nil
+}
+
 func toolsCreateLoader() *db.Loader {
 	dsn := viper.GetString("tools-global-dsn")
-	loader, err := db.NewLoader(dsn, 0, db.OnModuleHashMismatchIgnore, nil, zlog, tracer)
+	loader, err := db.NewLoader(dsn, db.OnModuleHashMismatchIgnore, nil, zlog, tracer)
 	cli.NoError(err, "Unable to instantiate database manager from DSN %q", dsn)
 
 	if err := loader.LoadTables(); err != nil {
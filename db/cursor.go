@@ -24,7 +24,12 @@ type cursorRow struct {
 // GetAllCursors returns an unordered map given for each module's hash recorded
 // the active cursor for it.
 func (l *Loader) GetAllCursors(ctx context.Context) (out map[string]*sink.Cursor, err error) {
-	rows, err := l.DB.QueryContext(ctx, fmt.Sprintf("SELECT id, cursor, block_num, block_id from %s", l.cursorTable.identifier))
+	query := fmt.Sprintf("SELECT id, %s, block_num, block_id from %s", l.getDialect().EscapeIdentifier("cursor"), l.cursorTable.identifier)
+	if selector, ok := dialectAs[cursorSelector](l.getDialect()); ok {
+		query = selector.selectCursorsQuery(l.cursorTable.identifier)
+	}
+
+	rows, err := l.DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("query all cursors: %w", err)
 	}
@@ -57,12 +62,14 @@ func (l *Loader) GetCursor(ctx context.Context, outputModuleHash string) (cursor
 
 	activeCursor, found := cursors[outputModuleHash]
 	if found {
+		l.committedCursor = activeCursor
 		return activeCursor, false, err
 	}
 
 	// It's not found at this point, look for one with highest block, we will report
 	// (maybe) a warning if the module hash is different, which is the case here.
 	actualOutputModuleHash, activeCursor := cursorAtHighestBlock(cursors)
+	l.committedCursor = activeCursor
 
 	switch l.moduleMismatchMode {
 	case OnModuleHashMismatchIgnore:
@@ -101,8 +108,9 @@ func cursorAtHighestBlock(in map[string]*sink.Cursor) (hash string, highest *sin
 }
 
 func (l *Loader) InsertCursor(ctx context.Context, moduleHash string, c *sink.Cursor) error {
-	query := fmt.Sprintf("INSERT INTO %s (id, cursor, block_num, block_id) values ('%s', '%s', %d, '%s')",
+	query := fmt.Sprintf("INSERT INTO %s (id, %s, block_num, block_id) values ('%s', '%s', %d, '%s')",
 		l.cursorTable.identifier,
+		l.getDialect().EscapeIdentifier("cursor"),
 		moduleHash,
 		c,
 		c.Block().Num(),
@@ -111,6 +119,7 @@ func (l *Loader) InsertCursor(ctx context.Context, moduleHash string, c *sink.Cu
 	if _, err := l.DB.ExecContext(ctx, query); err != nil {
 		return fmt.Errorf("insert cursor: %w", err)
 	}
+	l.committedCursor = c
 
 	return nil
 }
@@ -144,6 +153,39 @@ func (l *Loader) DeleteAllCursors(ctx context.Context) (deletedCount int64, err
 	return deletedCount, nil
 }
 
+// MarkCompleted records that the module `moduleHash` fully processed its requested block range,
+// ending at the block of cursor `c`. The completions table is created if needed, for schemas
+// set up by prior versions.
+func (l *Loader) MarkCompleted(ctx context.Context, moduleHash string, c *sink.Cursor) (err error) {
+	tx, err := l.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to being db transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				l.logger.Warn("failed to rollback transaction", zap.Error(err))
+			}
+		}
+	}()
+
+	if _, err := tx.ExecContext(ctx, l.getDialect().GetCreateCompletionsQuery(l.schema, false)); err != nil {
+		return fmt.Errorf("create completions table: %w", err)
+	}
+
+	table := l.getDialect().EscapeIdentifier(l.schema) + "." + l.getDialect().EscapeIdentifier(COMPLETIONS_TABLE)
+	if _, err := tx.ExecContext(ctx, l.getDialect().GetMarkCompletedQuery(table, moduleHash, c.Block().Num(), c.Block().ID())); err != nil {
+		return fmt.Errorf("mark completed: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit db transaction: %w", err)
+	}
+
+	l.logger.Debug("marked module as completed", zap.String("module_hash", moduleHash), zap.Stringer("block", c.Block()))
+	return nil
+}
+
 type sqlExecutor interface {
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
 }
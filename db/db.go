@@ -4,10 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/jimsmart/schema"
 	"github.com/streamingfast/logging"
+	sink "github.com/streamingfast/substreams-sink"
 	orderedmap "github.com/wk8/go-ordered-map/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -15,6 +20,8 @@ import (
 
 var CURSORS_TABLE = "cursors"
 var HISTORY_TABLE = "substreams_history"
+var COMPLETIONS_TABLE = "substreams_completions"
+var REORGS_TABLE = "substreams_reorgs"
 
 // Make the typing a bit easier
 type OrderedMap[K comparable, V any] struct {
@@ -25,6 +32,10 @@ func NewOrderedMap[K comparable, V any]() *OrderedMap[K, V] {
 	return &OrderedMap[K, V]{OrderedMap: orderedmap.New[K, V]()}
 }
 
+// PendingOperations holds the operations waiting to be flushed, keyed by table name
+// then by row unique id.
+type PendingOperations = OrderedMap[string, *OrderedMap[string, *Operation]]
+
 type SystemTableError struct {
 	error
 }
@@ -32,26 +43,51 @@ type SystemTableError struct {
 type Loader struct {
 	*sql.DB
 
+	// clickhouse is the native ClickHouse connection used to send batches, nil on other databases
+	clickhouse driver.Conn
+	dialect    Dialect
+
 	database     string
 	schema       string
-	entries      *OrderedMap[string, *OrderedMap[string, *Operation]]
+	entries      *PendingOperations
 	entriesCount uint64
+	entriesSize  uint64
 	tables       map[string]*TableInfo
 	cursorTable  *TableInfo
+	statements   *statementCache
+
+	// flushing is the second entries buffer, it holds the operations being flushed
+	// in the background by FlushAsync while new ones accumulate in entries.
+	flushing *PendingOperations
+	inflight *inflightFlush
+
+	// committedCursor is the last cursor read or written, nil until then. The operations of the
+	// next flush start right after its block.
+	committedCursor *sink.Cursor
 
 	handleReorgs       bool
-	flushInterval      time.Duration
 	moduleMismatchMode OnModuleHashMismatch
+	partitions         partitionOptions
+
+	// historyPruneInterval is the amount of final blocks between two prunes of the history,
+	// historyPrunedBlockNum being the block up to which it was last pruned, nil until the first
+	// flush of the run prunes it.
+	historyPruneInterval  uint64
+	historyPrunedBlockNum *uint64
+
+	// pendingTables writes the operations of blocks that are not final yet in shadow tables
+	// instead of the tables themselves, see SetupPendingTables.
+	pendingTables bool
 
 	logger *zap.Logger
 	tracer logging.Tracer
 
-	testTx *TestTx // used for testing: if non-nil, 'loader.BeginTx()' will return this object instead of a real *sql.Tx
+	testTx *TestTx          // used for testing: if non-nil, 'loader.BeginTx()' will return this object instead of a real *sql.Tx
+	now    func() time.Time // time.Now, frozen in testing so that recorded durations are deterministic
 }
 
 func NewLoader(
 	psqlDsn string,
-	flushInterval time.Duration,
 	moduleMismatchMode OnModuleHashMismatch,
 	handleReorgs *bool,
 	logger *zap.Logger,
@@ -62,40 +98,66 @@ func NewLoader(
 		return nil, fmt.Errorf("parse dsn: %w", err)
 	}
 
+	if dsn.driver == "duckdb" && !slices.Contains(sql.Drivers(), "duckdb") {
+		return nil, fmt.Errorf("duckdb support is not compiled in, the binary must be built with the 'duckdb' build tag")
+	}
+
+	dialect, found := LookupDialect(dsn.scheme)
+	if !found {
+		return nil, fmt.Errorf("dialect not found: %w", UnknownDriverError{Driver: dsn.driver})
+	}
+	dialect = configureDialect(dialect, dsn)
+
 	db, err := sql.Open(dsn.driver, dsn.ConnString())
 	if err != nil {
 		return nil, fmt.Errorf("open db connection: %w", err)
 	}
 
+	if dsn.driver == "sqlite3" {
+		// SQLite serializes writers anyway, a single connection avoids `database is locked`
+		// errors and is required by `:memory:` databases which are private to a connection.
+		db.SetMaxOpenConns(1)
+	}
+
+	var nativeConn driver.Conn
+	if dsn.driver == "clickhouse" {
+		options, err := clickhouse.ParseDSN(dsn.ConnString())
+		if err != nil {
+			return nil, fmt.Errorf("parse clickhouse dsn: %w", err)
+		}
+
+		if nativeConn, err = clickhouse.Open(options); err != nil {
+			return nil, fmt.Errorf("open native clickhouse connection: %w", err)
+		}
+	}
+
 	l := &Loader{
 		DB:                 db,
+		clickhouse:         nativeConn,
+		dialect:            dialect,
 		database:           dsn.database,
 		schema:             dsn.schema,
 		entries:            NewOrderedMap[string, *OrderedMap[string, *Operation]](),
+		flushing:           NewOrderedMap[string, *OrderedMap[string, *Operation]](),
 		tables:             map[string]*TableInfo{},
-		flushInterval:      flushInterval,
+		statements:         newStatementCache(db),
 		moduleMismatchMode: moduleMismatchMode,
-		logger:             logger,
-		tracer:             tracer,
-	}
-	_, err = l.tryDialect()
-	if err != nil {
-		return nil, fmt.Errorf("dialect not found: %s", err)
-	}
+		partitions:         dsn.partitions,
 
-	if handleReorgs == nil {
-		// automatic detection
-		l.handleReorgs = !l.getDialect().OnlyInserts()
-	} else {
-		l.handleReorgs = *handleReorgs
-	}
+		historyPruneInterval: dsn.historyPruneInterval,
+		pendingTables:        dsn.pendingTables,
 
-	if l.handleReorgs && l.getDialect().OnlyInserts() {
-		return nil, fmt.Errorf("driver %s does not support reorg handling. You must use set a non-zero undo-buffer-size", dsn.driver)
+		logger: logger,
+		tracer: tracer,
+		now:    time.Now,
+	}
+	// Reorgs are handled by default, every dialect supports them
+	l.handleReorgs = true
+	if handleReorgs != nil {
+		l.handleReorgs = *handleReorgs
 	}
 
 	logger.Info("created new DB loader",
-		zap.Duration("flush_interval", flushInterval),
 		zap.String("driver", dsn.driver),
 		zap.String("database", dsn.database),
 		zap.String("schema", dsn.schema),
@@ -105,12 +167,28 @@ func NewLoader(
 		zap.Int64("port", dsn.port),
 		zap.Stringer("on_module_hash_mismatch", moduleMismatchMode),
 		zap.Bool("handle_reorgs", l.handleReorgs),
-		zap.String("dialect", fmt.Sprintf("%t", l.getDialect())),
+		zap.Bool("pending_tables", l.pendingTables),
+		zap.String("dialect", fmt.Sprintf("%T", l.getDialect())),
 	)
 
 	return l, nil
 }
 
+// Close closes the prepared statements and the connections to the database.
+func (l *Loader) Close() error {
+	if err := l.statements.Close(); err != nil {
+		return fmt.Errorf("close prepared statements: %w", err)
+	}
+
+	if l.clickhouse != nil {
+		if err := l.clickhouse.Close(); err != nil {
+			return fmt.Errorf("close native clickhouse connection: %w", err)
+		}
+	}
+
+	return l.DB.Close()
+}
+
 type Tx interface {
 	Rollback() error
 	Commit() error
@@ -126,15 +204,25 @@ func (l *Loader) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
 	if l.testTx != nil {
 		return l.testTx, nil
 	}
+	if beginner, ok := dialectAs[txBeginner](l.getDialect()); ok {
+		return beginner.beginTx(ctx, l.DB, opts)
+	}
 	return l.DB.BeginTx(ctx, opts)
 }
 
-func (l *Loader) FlushInterval() time.Duration {
-	return l.flushInterval
+// PendingRows returns the amount of rows waiting to be flushed, operations on a row
+// that could be folded together count as a single row.
+func (l *Loader) PendingRows() uint64 {
+	return l.entriesCount
+}
+
+// PendingBytes returns the approximate size in bytes of the data waiting to be flushed.
+func (l *Loader) PendingBytes() uint64 {
+	return l.entriesSize
 }
 
 func (l *Loader) LoadTables() error {
-	schemaTables, err := schema.Tables(l.DB)
+	schemaTables, err := l.schemaTables()
 	if err != nil {
 		return fmt.Errorf("retrieving table and schema: %w", err)
 	}
@@ -149,6 +237,15 @@ func (l *Loader) LoadTables() error {
 			zap.String("table_name", tableName),
 		)
 
+		// SQLite has no schemas, its tables are reported without one and its internal
+		// tables (e.g. `sqlite_sequence`) have no primary key.
+		if schemaName == "" {
+			if strings.HasPrefix(tableName, "sqlite_") {
+				continue
+			}
+			schemaName = l.schema
+		}
+
 		if schemaName != l.schema {
 			continue
 		}
@@ -168,28 +265,43 @@ func (l *Loader) LoadTables() error {
 		for _, f := range columns {
 			columnByName[f.Name()] = &ColumnInfo{
 				name:             f.Name(),
-				escapedName:      EscapeIdentifier(f.Name()),
+				escapedName:      l.getDialect().EscapeIdentifier(f.Name()),
 				databaseTypeName: f.DatabaseTypeName(),
-				scanType:         f.ScanType(),
+				scanType:         columnScanType(f),
 			}
 		}
 
-		key, err := schema.PrimaryKey(l.DB, schemaName, tableName)
+		key, err := l.primaryKey(schemaName, tableName)
 		if err != nil {
 			return fmt.Errorf("get primary key: %w", err)
 		}
 
-		l.tables[tableName], err = NewTableInfo(schemaName, tableName, key, columnByName)
+		table, err := newTableInfo(schemaName, tableName, key, columnByName, l.getDialect().EscapeIdentifier)
 		if err != nil {
 			return fmt.Errorf("invalid table: %w", err)
 		}
+
+		if inspector, ok := dialectAs[tableInspector](l.getDialect()); ok {
+			if err := inspector.inspectTable(l.DB, table); err != nil {
+				return fmt.Errorf("inspecting table %s: %w", table.identifier, err)
+			}
+		}
+
+		l.tables[tableName] = table
 	}
 
 	if !seenCursorTable {
-		return &SystemTableError{fmt.Errorf(`%s.%s table is not found`, EscapeIdentifier(l.schema), CURSORS_TABLE)}
+		return &SystemTableError{fmt.Errorf(`%s.%s table is not found`, l.getDialect().EscapeIdentifier(l.schema), CURSORS_TABLE)}
 	}
 	if l.handleReorgs && !seenHistoryTable {
-		return &SystemTableError{fmt.Errorf("%s.%s table is not found and reorgs handling is enabled", EscapeIdentifier(l.schema), HISTORY_TABLE)}
+		return &SystemTableError{fmt.Errorf("%s.%s table is not found and reorgs handling is enabled", l.getDialect().EscapeIdentifier(l.schema), HISTORY_TABLE)}
+	}
+
+	if l.pendingTables {
+		// Shadow tables are written along the table they shadow, they are not tables of the schema
+		for name := range l.tables {
+			delete(l.tables, name+PENDING_TABLE_SUFFIX)
+		}
 	}
 
 	l.cursorTable = l.tables[CURSORS_TABLE]
@@ -197,6 +309,38 @@ func (l *Loader) LoadTables() error {
 	return nil
 }
 
+// ValidateTables checks the tables loaded by LoadTables are declared as the dialect requires to
+// write them safely, e.g. ClickHouse tables must deduplicate the batches of replayed flushes.
+func (l *Loader) ValidateTables() error {
+	if validator, ok := dialectAs[tablesValidator](l.getDialect()); ok {
+		return validator.validateTables(l)
+	}
+	return nil
+}
+
+// DeduplicatesReplays reports whether the writes of a flush replayed after a failure are
+// deduplicated against the ones of the interrupted flush, which only happens when both cover the
+// same blocks: flushes must then end on blocks that do not depend on when they were received.
+func (l *Loader) DeduplicatesReplays() bool {
+	deduplicator, ok := dialectAs[replayDeduplicator](l.getDialect())
+	return ok && deduplicator.deduplicatesReplays()
+}
+
+// schemaTables returns the columns of every table keyed by schema and table name.
+func (l *Loader) schemaTables() (map[[2]string][]*sql.ColumnType, error) {
+	if introspector, ok := dialectAs[schemaIntrospector](l.getDialect()); ok {
+		return introspector.tables(l.DB)
+	}
+	return schema.Tables(l.DB)
+}
+
+func (l *Loader) primaryKey(schemaName, tableName string) ([]string, error) {
+	if introspector, ok := dialectAs[schemaIntrospector](l.getDialect()); ok {
+		return introspector.primaryKey(l.DB, schemaName, tableName)
+	}
+	return schema.PrimaryKey(l.DB, schemaName, tableName)
+}
+
 func (l *Loader) validateCursorTables(columns []*sql.ColumnType) (err error) {
 	if len(columns) != 4 {
 		return &SystemTableError{fmt.Errorf("table requires 4 columns ('id', 'cursor', 'block_num', 'block_id')")}
@@ -213,7 +357,7 @@ func (l *Loader) validateCursorTables(columns []*sql.ColumnType) (err error) {
 			return &SystemTableError{fmt.Errorf("unexpected column %q in cursors table", columnName)}
 		}
 		expectedType := columnsCheck[columnName]
-		actualType := f.ScanType().Kind().String()
+		actualType := columnScanType(f).Kind().String()
 		if expectedType != actualType {
 			return &SystemTableError{fmt.Errorf("column %q has invalid type, expected %q has %q", columnName, expectedType, actualType)}
 		}
@@ -224,7 +368,7 @@ func (l *Loader) validateCursorTables(columns []*sql.ColumnType) (err error) {
 			return &SystemTableError{fmt.Errorf("missing column %q from cursors", k)}
 		}
 	}
-	key, err := schema.PrimaryKey(l.DB, l.schema, CURSORS_TABLE)
+	key, err := l.primaryKey(l.schema, CURSORS_TABLE)
 	if err != nil {
 		return &SystemTableError{fmt.Errorf("failed getting primary key: %w", err)}
 	}
@@ -271,6 +415,28 @@ func (l *Loader) GetSchema() string {
 	return l.schema
 }
 
+// GetTable returns the table named `name` of the schema, as loaded by LoadTables.
+func (l *Loader) GetTable(name string) (*TableInfo, bool) {
+	table, found := l.tables[name]
+	return table, found
+}
+
+// HandlesReorgs returns true if the history of reversible blocks must be recorded.
+func (l *Loader) HandlesReorgs() bool {
+	return l.handleReorgs
+}
+
+// tableByIdentifier returns the table whose escaped identifier is `identifier`, as recorded
+// in the history table, nil if it's not known.
+func (l *Loader) tableByIdentifier(identifier string) *TableInfo {
+	for _, table := range l.tables {
+		if table.identifier == identifier {
+			return table
+		}
+	}
+	return nil
+}
+
 func (l *Loader) HasTable(tableName string) bool {
 	if _, found := l.tables[tableName]; found {
 		return true
@@ -280,6 +446,7 @@ func (l *Loader) HasTable(tableName string) bool {
 
 func (l *Loader) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	encoder.AddUint64("entries_count", l.entriesCount)
+	encoder.AddUint64("entries_size", l.entriesSize)
 	return nil
 }
 
@@ -300,6 +467,47 @@ func (l *Loader) Setup(ctx context.Context, schemaSql string, withPostgraphile b
 		return fmt.Errorf("setup history table: %w", err)
 	}
 
+	if err := l.setupCompletionsTable(ctx, withPostgraphile); err != nil {
+		return fmt.Errorf("setup completions table: %w", err)
+	}
+
+	if err := l.setupReorgsTable(ctx, withPostgraphile); err != nil {
+		return fmt.Errorf("setup reorgs table: %w", err)
+	}
+
+	return nil
+}
+
+// SetupPartitions creates the first partitions of the tables partitioned by block number, the
+// stream starting at `startBlock`, tables must have been loaded by LoadTables. It does nothing on
+// databases other than Postgres.
+func (l *Loader) SetupPartitions(ctx context.Context, startBlock uint64) (err error) {
+	creator, ok := dialectAs[partitionCreator](l.getDialect())
+	if !ok {
+		return nil
+	}
+
+	tx, err := l.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to being db transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				l.logger.Warn("failed to rollback transaction", zap.Error(err))
+			}
+		}
+	}()
+
+	partitions := stagedPartitions{}
+	if err := creator.createPartitions(withStagedPartitions(ctx, partitions), tx, l, flushRange{start: startBlock, stop: startBlock}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit db transaction: %w", err)
+	}
+	partitions.apply()
 	return nil
 }
 
@@ -310,26 +518,37 @@ func (l *Loader) setupCursorTable(ctx context.Context, withPostgraphile bool) er
 }
 
 func (l *Loader) setupHistoryTable(ctx context.Context, withPostgraphile bool) error {
-	if l.getDialect().OnlyInserts() {
-		return nil
-	}
 	query := l.getDialect().GetCreateHistoryQuery(l.schema, withPostgraphile)
-	_, err := l.ExecContext(ctx, query)
-	return err
+	if _, err := l.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	if migrator, ok := dialectAs[historyMigrator](l.getDialect()); ok {
+		if err := migrator.migrateHistoryTable(ctx, l); err != nil {
+			return fmt.Errorf("migrate history table: %w", err)
+		}
+	}
+	return nil
 }
 
-func (l *Loader) getDialect() dialect {
-	d, _ := l.tryDialect()
-	return d
+func (l *Loader) setupCompletionsTable(ctx context.Context, withPostgraphile bool) error {
+	query := l.getDialect().GetCreateCompletionsQuery(l.schema, withPostgraphile)
+	_, err := l.ExecContext(ctx, query)
+	return err
 }
 
-func (l *Loader) tryDialect() (dialect, error) {
-	dt := fmt.Sprintf("%T", l.DB.Driver())
-	d, ok := driverDialect[dt]
+func (l *Loader) setupReorgsTable(ctx context.Context, withPostgraphile bool) error {
+	recorder, ok := dialectAs[reorgRecorder](l.getDialect())
 	if !ok {
-		return nil, UnknownDriverError{Driver: dt}
+		return nil
 	}
-	return d, nil
+
+	_, err := l.ExecContext(ctx, recorder.createReorgsQuery(l.schema, withPostgraphile))
+	return err
+}
+
+func (l *Loader) getDialect() Dialect {
+	return l.dialect
 }
 
 type obfuscatedString string
@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 
 	sink "github.com/streamingfast/substreams-sink"
@@ -16,20 +17,190 @@ func (e UnknownDriverError) Error() string {
 	return fmt.Sprintf("unknown database driver: %s", e.Driver)
 }
 
-type dialect interface {
+// Dialect implements the database specific parts of the Loader: the system tables DDL, the
+// flush of pending operations and the revert of reorged blocks. The built-in dialects are
+// registered for the `psql`, `postgres`, `clickhouse`, `sqlite`, `mysql` and `duckdb` DSN
+// schemes, other ones are added with RegisterDialect.
+type Dialect interface {
+	// GetCreateCursorQuery returns the DDL creating the cursors table if it does not exist.
 	GetCreateCursorQuery(schema string, withPostgraphile bool) string
+	// GetCreateHistoryQuery returns the DDL creating the history table if it does not exist.
 	GetCreateHistoryQuery(schema string, withPostgraphile bool) string
+	// GetCreateCompletionsQuery returns the DDL creating the completions table if it does not exist.
+	GetCreateCompletionsQuery(schema string, withPostgraphile bool) string
+	// ExecuteSetupScript runs the user's schema SQL script.
 	ExecuteSetupScript(ctx context.Context, l *Loader, schemaSql string) error
+	// DriverSupportRowsAffected returns true if the driver reports the rows affected by a statement.
 	DriverSupportRowsAffected() bool
 	GetUpdateCursorQuery(table, moduleHash string, cursor *sink.Cursor, block_num uint64, block_id string) string
-	ParseDatetimeNormalization(value string) string
-	Flush(tx Tx, ctx context.Context, l *Loader, outputModuleHash string, lastFinalBlock uint64) (int, error)
+	GetMarkCompletedQuery(table, moduleHash string, block_num uint64, block_id string) string
+	// Flush applies the pending operations within `tx`, recording the history of those of reversible
+	// blocks, and returns the amount of operations applied. The cursor is updated by the Loader.
+	Flush(tx Tx, ctx context.Context, l *Loader, entries *PendingOperations, outputModuleHash string, lastFinalBlock uint64) (int, error)
+	// Revert undoes the operations recorded in the history after `lastValidFinalBlock`.
 	Revert(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64) error
+	// OnlyInserts returns true if the database only supports inserts.
 	OnlyInserts() bool
 	CreateUser(tx Tx, ctx context.Context, l *Loader, username string, password string, database string, readOnly bool) error
+	EscapeIdentifier(valueToEscape string) string
 }
 
-var driverDialect = map[string]dialect{
-	"*pq.Driver":            postgresDialect{},   // github.com/lib/pq
-	"*clickhouse.stdDriver": clickhouseDialect{}, // github.com/clickhouse-go/v2
+// WrappedDialect is implemented by dialects wrapping another one, typically a dialect returned by
+// LookupDialect embedded to override some of its methods. The built-in dialects have optional
+// capabilities (how transactions are opened, tables inspected, partitions created...) which are
+// not part of Dialect and thus not promoted by embedding it: the Loader uses the ones of the
+// wrapped dialect, the methods implementing them call the wrapped dialect's own methods, not the
+// overrides of the wrapper.
+type WrappedDialect interface {
+	Dialect
+	// Unwrap returns the wrapped dialect.
+	Unwrap() Dialect
+	// Wrap returns a copy of the wrapper wrapping `dialect` instead, the Loader calls it with the
+	// wrapped dialect configured by the options of the DSN.
+	Wrap(dialect Dialect) Dialect
+}
+
+// dialectAs returns `dialect`, or the first dialect it wraps (see WrappedDialect), implementing
+// the optional capability T.
+func dialectAs[T any](dialect Dialect) (T, bool) {
+	for {
+		if capability, ok := dialect.(T); ok {
+			return capability, true
+		}
+
+		wrapper, ok := dialect.(WrappedDialect)
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		dialect = wrapper.Unwrap()
+	}
+}
+
+// configureDialect returns the dialect configured by the options of `dsn`, see dsnConfigurable,
+// dialects wrapping a configurable dialect wrap the configured one.
+func configureDialect(dialect Dialect, dsn *DSN) Dialect {
+	if configurable, ok := dialect.(dsnConfigurable); ok {
+		return configurable.withDSN(dsn)
+	}
+	if wrapper, ok := dialect.(WrappedDialect); ok {
+		return wrapper.Wrap(configureDialect(wrapper.Unwrap(), dsn))
+	}
+	return dialect
+}
+
+// txBeginner is implemented by dialects controlling how transactions are opened.
+type txBeginner interface {
+	beginTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions) (Tx, error)
+}
+
+// schemaIntrospector is implemented by dialects whose driver is not known by
+// github.com/jimsmart/schema, it lists the tables and their primary key.
+type schemaIntrospector interface {
+	tables(db *sql.DB) (map[[2]string][]*sql.ColumnType, error)
+	primaryKey(db *sql.DB, schema, table string) ([]string, error)
+}
+
+// tableInspector is implemented by dialects needing more details about the tables than their
+// columns and primary key, it's called by LoadTables for every table of the schema.
+type tableInspector interface {
+	inspectTable(db *sql.DB, table *TableInfo) error
+}
+
+// mutationValidator is implemented by dialects supporting updates, upserts and deletes only
+// on some tables, the operation is rejected when an error is returned.
+type mutationValidator interface {
+	validateMutation(table *TableInfo, opType OperationType) error
+}
+
+// partitionCreator is implemented by dialects managing tables partitioned by block number, it
+// creates the partitions needed to hold the blocks of `blockRange`.
+type partitionCreator interface {
+	createPartitions(ctx context.Context, tx Tx, l *Loader, blockRange flushRange) error
+}
+
+// dsnConfigurable is implemented by dialects configured by DSN options, the Loader uses the
+// dialect returned by withDSN.
+type dsnConfigurable interface {
+	withDSN(dsn *DSN) Dialect
+}
+
+// cursorSelector is implemented by dialects needing a specific query to read the cursors
+// (id, cursor, block_num, block_id), e.g. to read only the latest version of each of them.
+type cursorSelector interface {
+	selectCursorsQuery(table string) string
+}
+
+// historyMigrator is implemented by dialects whose history table layout changed, it's called by
+// Setup once the history table exists to convert the tables created by previous versions.
+type historyMigrator interface {
+	migrateHistoryTable(ctx context.Context, l *Loader) error
+}
+
+// reorgRecorder is implemented by dialects recording the reverts in the reorgs table, see
+// Loader.recordReorg for the columns written.
+type reorgRecorder interface {
+	createReorgsQuery(schema string, withPostgraphile bool) string
+}
+
+// pendingTablesWriter is implemented by dialects able to write the operations of blocks that are
+// not final yet in shadow tables, see Loader.SetupPendingTables.
+type pendingTablesWriter interface {
+	createPendingTableQuery(schema string, table *TableInfo, withPostgraphile bool) string
+	pendingTable(schema string, table *TableInfo) string
+}
+
+// tablesValidator is implemented by dialects supporting the tables of the schema only when they
+// are declared in some way, it's called by Loader.ValidateTables.
+type tablesValidator interface {
+	validateTables(l *Loader) error
+}
+
+// replayDeduplicator is implemented by dialects dropping the writes of a flush replayed after a
+// failure that were already made, which requires the replayed flush to cover the same blocks as
+// the interrupted one.
+type replayDeduplicator interface {
+	deduplicatesReplays() bool
+}
+
+// dialects is keyed by DSN scheme, dialects behind a build tag (DuckDB) register themselves
+// from their init function.
+var dialects = map[string]Dialect{
+	"psql":       postgresDialect{},   // github.com/lib/pq
+	"postgres":   postgresDialect{},   // github.com/lib/pq
+	"clickhouse": clickhouseDialect{}, // github.com/clickhouse-go/v2
+	"sqlite":     sqliteDialect{},     // github.com/mattn/go-sqlite3
+	"mysql":      mysqlDialect{},      // github.com/go-sql-driver/mysql
+}
+
+// RegisterDialect makes DSNs of `scheme` open a database/sql connection with the driver
+// registered as `driverName` (see sql.Register) and use `dialect` to load data. It is meant
+// to be called from the init function of the package providing the dialect and panics if
+// `scheme` is already registered or `dialect` is nil.
+//
+// The connection string given to a driver other than `postgres` is the DSN as is, the driver
+// parsing it. Registering a scheme with the `postgres` driver, e.g. to wrap the dialect
+// returned by LookupDialect("psql"), gives it the Postgres connection string.
+func RegisterDialect(scheme, driverName string, dialect Dialect) {
+	if dialect == nil {
+		panic("db: RegisterDialect dialect is nil")
+	}
+	if _, found := driverMap[scheme]; found {
+		panic("db: RegisterDialect called twice for scheme " + scheme)
+	}
+
+	driverMap[scheme] = driverName
+	dialects[scheme] = dialect
+}
+
+// unregisterDialect removes the DSN `scheme` registered by RegisterDialect, it's used by tests.
+func unregisterDialect(scheme string) {
+	delete(driverMap, scheme)
+	delete(dialects, scheme)
+}
+
+// LookupDialect returns the dialect registered for the DSN `scheme`.
+func LookupDialect(scheme string) (Dialect, bool) {
+	dialect, found := dialects[scheme]
+	return dialect, found
 }
@@ -2,110 +2,711 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2"
 
 	"github.com/streamingfast/cli"
 	sink "github.com/streamingfast/substreams-sink"
 	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
 )
 
-type clickhouseDialect struct{}
+type clickhouseDialect struct {
+	// cluster is the ClickHouse cluster set by the `cluster` DSN option, empty for a single node.
+	cluster string
+}
+
+// withDSN returns the dialect for the cluster of the DSN, see clickhouseDialect.cluster.
+func (d clickhouseDialect) withDSN(dsn *DSN) Dialect {
+	d.cluster = dsn.clickhouseCluster
+	return d
+}
 
 // Clickhouse should be used to insert a lot of data in batches. The current official clickhouse
-// driver doesn't support Transactions for multiple tables. The only way to add in batches is
-// creating a transaction for a table, adding all rows and commiting it.
-func (d clickhouseDialect) Flush(tx Tx, ctx context.Context, l *Loader, outputModuleHash string, lastFinalBlock uint64) (int, error) {
-	var entryCount int
-	for entriesPair := l.entries.Oldest(); entriesPair != nil; entriesPair = entriesPair.Next() {
-		tableName := entriesPair.Key
-		entries := entriesPair.Value
-		tx, err := l.DB.BeginTx(ctx, nil)
-		if err != nil {
-			return entryCount, fmt.Errorf("failed to begin db transaction")
+// driver doesn't support Transactions for multiple tables, the rows of each table are thus sent
+// as native blocks, one per table and column set, see insertBatch.
+//
+// Updates, upserts and deletes are applied by inserting a new version of the row, see
+// flushOperations.
+//
+// Without transactions, a flush interrupted after some batches were sent is replayed from the
+// last committed cursor on restart. Each batch thus carries a deduplication token derived from
+// the flushed block range, see clickhouseDedupTokens, for ClickHouse to drop the batches it
+// already received.
+func (d clickhouseDialect) Flush(tx Tx, ctx context.Context, l *Loader, entries *PendingOperations, outputModuleHash string, lastFinalBlock uint64) (int, error) {
+	tokens := newClickhouseDedupTokens(ctx)
+	var ordinal uint64
+	rowCount, err := l.flushByGeneration(entries, func(tableName string, operations []*Operation) error {
+		if err := d.flushOperations(ctx, tx, l, operations, tokens, &ordinal); err != nil {
+			return fmt.Errorf("flushing table %q: %w", tableName, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
 
-		if l.tracer.Enabled() {
-			l.logger.Debug("flushing table entries", zap.String("table_name", tableName), zap.Int("entry_count", entries.Len()))
+	if l.handleReorgs {
+		if err := d.pruneReversibleSegment(tx, ctx, l.schema, lastFinalBlock); err != nil {
+			return 0, err
 		}
-		info := l.tables[tableName]
-		columns := make([]string, 0, len(info.columnsByName))
-		for column := range info.columnsByName {
-			columns = append(columns, column)
+	}
+
+	return rowCount, nil
+}
+
+// flushOperations applies operations of a single table, each for a different row, see
+// planOperations. The history is written first, a failure before the rows are committed leaves
+// history entries for rows that were not changed, reverting them is harmless.
+//
+// `ordinal` numbers the history entries of the flush, it orders the operations of a block on
+// revert since a row can be changed by more than one of them.
+func (d clickhouseDialect) flushOperations(ctx context.Context, tx Tx, l *Loader, operations []*Operation, tokens *clickhouseDedupTokens, ordinal *uint64) error {
+	table := operations[0].table
+
+	// Inserts of versioned tables read the current version too, the inserted row must be above it
+	var read []map[string]string
+	for _, o := range operations {
+		if o.opType != OperationTypeInsert || table.engine.versionColumn != "" {
+			read = append(read, o.primaryKey)
 		}
-		sort.Strings(columns)
-		query := fmt.Sprintf(
-			"INSERT INTO %s.%s (%s)",
-			EscapeIdentifier(l.schema),
-			EscapeIdentifier(tableName),
-			strings.Join(columns, ","))
-		batch, err := tx.Prepare(query)
+	}
+
+	var current map[string]map[string]string
+	if len(read) > 0 {
+		var err error
+		if current, err = d.currentRows(ctx, tx, table, read); err != nil {
+			return err
+		}
+	}
+
+	plan, err := d.planOperations(l, table, operations, current, ordinal)
+	if err != nil {
+		return err
+	}
+
+	if err := d.saveHistory(ctx, l, plan.history, tokens); err != nil {
+		return fmt.Errorf("saving history: %w", err)
+	}
+
+	if err := d.insertRows(ctx, l, table, plan.rows, tokens); err != nil {
+		return err
+	}
+
+	if len(plan.deleted) > 0 {
+		condition, err := d.primaryKeysCondition(table, plan.deleted)
 		if err != nil {
-			return entryCount, fmt.Errorf("failed to prepare insert into %q: %w", tableName, err)
+			return err
+		}
+
+		query := fmt.Sprintf("%s WHERE %s", d.deleteFrom(table), condition)
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("executing query %q: %w", query, err)
 		}
-		for entryPair := entries.Oldest(); entryPair != nil; entryPair = entryPair.Next() {
-			entry := entryPair.Value
+	}
+
+	return nil
+}
 
+// clickhouseFlushPlan is what is written to apply the operations of a table: the rows to insert,
+// the primary keys of the rows to delete with a lightweight `DELETE` and the history rows (op,
+// table_name, pk, prev_value, block_num, ordinal) of the operations of reversible blocks.
+type clickhouseFlushPlan struct {
+	rows    []map[string]string
+	deleted []map[string]string
+	history [][]any
+}
+
+// planOperations returns the plan applying operations of a single table, each for a different
+// row, whose current version, if any, is in `current` (see currentRows). Inserts are written as
+// is while updates, upserts and deletes insert a new version of their row: the merge of the
+// current values with the updated ones for updates and upserts, the current values with
+// `is_deleted` set to 1 for deletes. Deletes on tables without an `is_deleted` column use a
+// lightweight `DELETE`.
+//
+// On versioned tables, inserts and upserts of rows that exist or were deleted are written with
+// the version following the current one, a row inserted again after being deleted would
+// otherwise stay hidden behind its tombstone. Inserting a row that exists replaces it, its
+// history is the one of an update.
+func (d clickhouseDialect) planOperations(l *Loader, table *TableInfo, operations []*Operation, current map[string]map[string]string, ordinal *uint64) (*clickhouseFlushPlan, error) {
+	plan := &clickhouseFlushPlan{}
+	record := func(op string, o *Operation, prev map[string]string) error {
+		if o.reversibleBlockNum == nil {
+			return nil
+		}
+
+		var prevValue *string
+		if prev != nil {
+			encoded, err := json.Marshal(prev)
 			if err != nil {
-				return entryCount, fmt.Errorf("failed to get query: %w", err)
+				return fmt.Errorf("encoding previous value of %s: %w", o, err)
 			}
+			value := string(encoded)
+			prevValue = &value
+		}
+
+		plan.history = append(plan.history, []any{op, table.identifier, primaryKeyToJSON(o.primaryKey), prevValue, *o.reversibleBlockNum, *ordinal})
+		*ordinal++
+		return nil
+	}
 
+	for _, o := range operations {
+		prev, exists := current[createRowUniqueID(o.primaryKey)]
+		if exists && d.isDeleted(table, prev) {
+			exists = false
+		}
+
+		switch {
+		case o.opType == OperationTypeInsert, o.opType == OperationTypeUpsert && !exists:
+			row := o.data
+			if versionColumn := table.engine.versionColumn; versionColumn != "" && prev != nil {
+				base := map[string]string{versionColumn: prev[versionColumn]}
+				if table.engine.isDeletedColumn != "" {
+					base[table.engine.isDeletedColumn] = "0"
+				}
+
+				var err error
+				if row, err = d.versionedRow(table, base, o.data); err != nil {
+					return nil, fmt.Errorf("inserting %s: %w", o, err)
+				}
+			}
+			plan.rows = append(plan.rows, row)
+
+			if exists {
+				if err := record("U", o, prev); err != nil {
+					return nil, err
+				}
+			} else if err := record("I", o, nil); err != nil {
+				return nil, err
+			}
+
+		case !exists:
+			// Like on other databases, updating or deleting a row that does not exist is a no-op
 			if l.tracer.Enabled() {
-				l.logger.Debug("adding query from operation to transaction", zap.Stringer("op", entry), zap.String("query", query))
+				l.logger.Debug("row to mutate does not exist, skipping", zap.Stringer("op", o))
+			}
+
+		case o.opType == OperationTypeDelete && table.engine.isDeletedColumn == "":
+			plan.deleted = append(plan.deleted, o.primaryKey)
+			if err := record("D", o, prev); err != nil {
+				return nil, err
+			}
+
+		case o.opType == OperationTypeDelete:
+			row, err := d.versionedRow(table, prev, map[string]string{table.engine.isDeletedColumn: "1"})
+			if err != nil {
+				return nil, fmt.Errorf("deleting %s: %w", o, err)
+			}
+			plan.rows = append(plan.rows, row)
+			if err := record("D", o, prev); err != nil {
+				return nil, err
 			}
 
-			values, err := convertOpToClickhouseValues(entry)
+		default:
+			row, err := d.versionedRow(table, prev, o.data)
 			if err != nil {
-				return entryCount, fmt.Errorf("failed to get values: %w", err)
+				return nil, fmt.Errorf("updating %s: %w", o, err)
+			}
+			plan.rows = append(plan.rows, row)
+			if err := record("U", o, prev); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// insertRows inserts the rows, each being the values keyed by column name, in batches of
+// rows sharing the same column set. The batches are not deduplicated when `tokens` is nil.
+func (d clickhouseDialect) insertRows(ctx context.Context, l *Loader, table *TableInfo, rows []map[string]string, tokens *clickhouseDedupTokens) error {
+	groups := NewOrderedMap[string, [][]any]()
+	for _, row := range rows {
+		columns := maps.Keys(row)
+		sort.Strings(columns)
+
+		values := make([]any, len(columns))
+		for i, column := range columns {
+			columnInfo, found := table.columnsByName[column]
+			if !found {
+				return fmt.Errorf("cannot find column %q for table %q (valid columns are %q)", column, table.identifier, strings.Join(maps.Keys(table.columnsByName), ", "))
 			}
 
-			if _, err := batch.ExecContext(ctx, values...); err != nil {
-				return entryCount, fmt.Errorf("executing for entry %q: %w", values, err)
+			value, err := convertToType(row[column], columnInfo.scanType)
+			if err != nil {
+				return fmt.Errorf("converting value %q to type %q in column %q: %w", row[column], columnInfo.scanType, column, err)
 			}
+			values[i] = value
+			columns[i] = columnInfo.escapedName
+		}
+
+		key := strings.Join(columns, ",")
+		groupRows, _ := groups.Get(key)
+		groups.Set(key, append(groupRows, values))
+	}
+
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		query := fmt.Sprintf("INSERT INTO %s (%s)", table.identifier, pair.Key)
+		if err := d.insertBatch(ctx, l, query, pair.Value, tokens.next(table.identifier)); err != nil {
+			return fmt.Errorf("inserting into %s: %w", table.identifier, err)
+		}
+	}
+
+	return nil
+}
+
+// insertBatch sends the rows as a single native block through the native ClickHouse
+// connection, the values of each column are appended at once from a typed buffer (see
+// clickhouseColumnBuffers) rather than row by row. A non-empty `token` is sent as the
+// `insert_deduplication_token` of the block, the block is not deduplicated otherwise.
+func (d clickhouseDialect) insertBatch(ctx context.Context, l *Loader, query string, rows [][]any, token string) error {
+	columns, err := clickhouseColumnBuffers(rows)
+	if err != nil {
+		return err
+	}
+
+	if l.tracer.Enabled() {
+		l.logger.Debug("sending native batch", zap.String("query", query), zap.Int("row_count", len(rows)), zap.String("deduplication_token", token))
+	}
+
+	settings := clickhouse.Settings{}
+	if token != "" {
+		settings["insert_deduplication_token"] = token
+	} else {
+		// Without token, the batch would be deduplicated against the previous ones by its content
+		settings["insert_deduplicate"] = 0
+	}
+	if d.cluster != "" {
+		// Rows inserted in Distributed tables are forwarded to the shards before the batch completes
+		settings["insert_distributed_sync"] = 1
+	}
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+
+	batch, err := l.clickhouse.PrepareBatch(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare %q: %w", query, err)
+	}
+	defer func() {
+		if !batch.IsSent() {
+			batch.Abort()
 		}
+	}()
 
-		if err := tx.Commit(); err != nil {
-			return entryCount, fmt.Errorf("failed to commit db transaction: %w", err)
+	for i, column := range columns {
+		if err := batch.Column(i).Append(column); err != nil {
+			return fmt.Errorf("appending column %d of %q: %w", i, query, err)
 		}
-		entryCount += entries.Len()
 	}
 
-	return entryCount, nil
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("sending batch %q: %w", query, err)
+	}
+	return nil
+}
+
+// clickhouseColumnBuffers transposes the rows into a slice of values per column, each typed
+// after the values of the column, e.g. `[]uint64` for a `UInt64` column.
+func clickhouseColumnBuffers(rows [][]any) ([]any, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	buffers := make([]reflect.Value, len(rows[0]))
+	for i, value := range rows[0] {
+		if value == nil {
+			return nil, fmt.Errorf("column %d has an untyped nil value", i)
+		}
+		buffers[i] = reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(value)), 0, len(rows))
+	}
+
+	for _, row := range rows {
+		if len(row) != len(buffers) {
+			return nil, fmt.Errorf("row has %d values, expected %d", len(row), len(buffers))
+		}
+
+		for i, value := range row {
+			v := reflect.ValueOf(value)
+			if !v.IsValid() || v.Type() != buffers[i].Type().Elem() {
+				return nil, fmt.Errorf("column %d mixes values of type %s and %T", i, buffers[i].Type().Elem(), value)
+			}
+			buffers[i] = reflect.Append(buffers[i], v)
+		}
+	}
+
+	out := make([]any, len(buffers))
+	for i, buffer := range buffers {
+		out[i] = buffer.Interface()
+	}
+	return out, nil
+}
+
+// saveHistory records the history rows (op, table_name, pk, prev_value, block_num, ordinal) of
+// the operations of reversible blocks.
+func (d clickhouseDialect) saveHistory(ctx context.Context, l *Loader, history [][]any, tokens *clickhouseDedupTokens) error {
+	if len(history) == 0 {
+		return nil
+	}
+
+	table := d.historyTable(l.schema)
+	return d.insertBatch(ctx, l, fmt.Sprintf("INSERT INTO %s (op, table_name, pk, prev_value, block_num, ordinal)", table), history, tokens.next(table))
+}
+
+// clickhouseDedupTokens derives the `insert_deduplication_token` of the batches of a flush from
+// the flushed block range, the table and the position of the batch among the ones of the table.
+// Replaying the same blocks with the same flush boundaries thus produces the same tokens, batches
+// already written by an interrupted flush are dropped by ClickHouse.
+//
+// Deduplication applies to Replicated*MergeTree tables and to the other MergeTree tables having
+// the `non_replicated_deduplication_window` setting, which the history table is created with and
+// user tables are checked for by validateTables. The cursors table needs none, a replayed cursor
+// write inserts the same version of its row again. Flushes must not be triggered by time for the
+// flush boundaries to be the same, see Loader.DeduplicatesReplays.
+type clickhouseDedupTokens struct {
+	blockRange flushRange
+	batches    map[string]int
+}
+
+// newClickhouseDedupTokens returns nil, generating no tokens, when `ctx` is not the one of a flush.
+func newClickhouseDedupTokens(ctx context.Context) *clickhouseDedupTokens {
+	blockRange, found := flushRangeFromContext(ctx)
+	if !found {
+		return nil
+	}
+
+	return &clickhouseDedupTokens{blockRange: blockRange, batches: map[string]int{}}
+}
+
+// next returns the token of the next batch sent to `table`.
+func (t *clickhouseDedupTokens) next(table string) string {
+	if t == nil {
+		return ""
+	}
+
+	batch := t.batches[table]
+	t.batches[table] = batch + 1
+
+	return fmt.Sprintf("%s:%d-%d:%s:%d", table, t.blockRange.start, t.blockRange.stop, t.blockRange.stopID, batch)
+}
+
+// deduplicatesReplays is true, the batches of a flush are deduplicated by tokens derived from the
+// flushed block range, see clickhouseDedupTokens.
+func (d clickhouseDialect) deduplicatesReplays() bool {
+	return true
 }
 
+// validateTables rejects the tables not deduplicating inserts, the batches of a flush replayed
+// after a failure would be written twice, see clickhouseDedupTokens.
+func (d clickhouseDialect) validateTables(l *Loader) error {
+	var tables []string
+	for _, table := range l.userTables() {
+		if !table.engine.deduplicated {
+			tables = append(tables, table.identifier)
+		}
+	}
+
+	if len(tables) > 0 {
+		return fmt.Errorf("tables %s do not deduplicate inserts, rows of a flush replayed after a failure would be written twice: use a Replicated*MergeTree engine or add `SETTINGS non_replicated_deduplication_window = 1000` to their declaration", strings.Join(tables, ", "))
+	}
+	return nil
+}
+
+// pruneReversibleSegment deletes the history of the blocks that became final. The history is
+// checked first since a lightweight delete is costly even when no row matches.
+func (d clickhouseDialect) pruneReversibleSegment(tx Tx, ctx context.Context, schema string, highestFinalBlock uint64) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT 1 FROM %s WHERE block_num <= %d LIMIT 1`, d.historyTable(schema), highestFinalBlock))
+	if err != nil {
+		return fmt.Errorf("checking history to prune: %w", err)
+	}
+	if rows == nil { // rows will be nil with no error only in testing scenarios
+		return nil
+	}
+
+	found := rows.Next()
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("checking history to prune: %w", err)
+	}
+	if !found {
+		return nil
+	}
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE block_num <= %d`, d.historyTable(schema), highestFinalBlock)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("executing prune query %q: %w", query, err)
+	}
+	return nil
+}
+
+// clickhouseReversion is a history row to revert.
+type clickhouseReversion struct {
+	op         string
+	tableName  string
+	primaryKey map[string]string
+	prevValue  string
+}
+
+// Revert undoes the operations of the blocks after `lastValidFinalBlock`, most recent first, the
+// operations of a block being ordered by their history ordinal, see flushOperations.
+// Inserted rows are removed, see revertInserts, updated and deleted rows are restored by
+// inserting their previous value as a new version of the row.
 func (d clickhouseDialect) Revert(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64) error {
-	return fmt.Errorf("clickhouse driver does not support reorg management.")
+	query := fmt.Sprintf(`SELECT op, table_name, pk, prev_value, block_num FROM %s WHERE block_num > %d ORDER BY block_num DESC, ordinal DESC`,
+		d.historyTable(l.schema),
+		lastValidFinalBlock,
+	)
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	var reversions []clickhouseReversion
+	l.logger.Info("reverting forked block block(s)", zap.Uint64("last_valid_final_block", lastValidFinalBlock))
+	if rows != nil { // rows will be nil with no error only in testing scenarios
+		defer rows.Close()
+		for rows.Next() {
+			var op string
+			var table_name string
+			var pk string
+			var prev_value_nullable *string
+			var block_num uint64
+			if err := rows.Scan(&op, &table_name, &pk, &prev_value_nullable, &block_num); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			l.logger.Debug("reverting", zap.String("operation", op), zap.String("table_name", table_name), zap.String("pk", pk), zap.Uint64("block_num", block_num))
+
+			pkmap := make(map[string]string)
+			if err := json.Unmarshal([]byte(pk), &pkmap); err != nil {
+				return fmt.Errorf("unmarshalling %q: %w", pk, err)
+			}
+
+			reversion := clickhouseReversion{op: op, tableName: table_name, primaryKey: pkmap}
+			if prev_value_nullable != nil {
+				reversion.prevValue = *prev_value_nullable
+			}
+			reversions = append(reversions, reversion)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("iterating on rows from query %q: %w", query, err)
+		}
+	}
+
+	for i := 0; i < len(reversions); {
+		reversion := reversions[i]
+		table := l.tableByIdentifier(reversion.tableName)
+		if table == nil {
+			return fmt.Errorf("unknown table %s in history", reversion.tableName)
+		}
+
+		if reversion.op == "I" {
+			// Consecutive inserts of a table are reverted together
+			var primaryKeys []map[string]string
+			for ; i < len(reversions) && reversions[i].op == "I" && reversions[i].tableName == reversion.tableName; i++ {
+				primaryKeys = append(primaryKeys, reversions[i].primaryKey)
+			}
+
+			revertQuery, err := d.revertInserts(table, primaryKeys)
+			if err != nil {
+				return fmt.Errorf("reverting inserts of table %s: %w", table.identifier, err)
+			}
+
+			if _, err := tx.ExecContext(ctx, revertQuery); err != nil {
+				return fmt.Errorf("executing revert query %q: %w", revertQuery, err)
+			}
+			l.recordRevertedRows(ctx, table.identifier, int64(len(primaryKeys)))
+			continue
+		}
+
+		if err := d.revertMutation(ctx, tx, l, table, reversion); err != nil {
+			return fmt.Errorf("reverting %s of table %s: %w", reversion.op, table.identifier, err)
+		}
+		l.recordRevertedRows(ctx, table.identifier, 1)
+		i++
+	}
+
+	pruneHistory := fmt.Sprintf(`DELETE FROM %s WHERE block_num > %d`,
+		d.historyTable(l.schema),
+		lastValidFinalBlock,
+	)
+
+	if _, err := tx.ExecContext(ctx, pruneHistory); err != nil {
+		return fmt.Errorf("executing pruneHistory: %w", err)
+	}
+	return nil
+}
+
+// revertMutation restores the previous value of an updated ('U') or deleted ('D') row as a new
+// version of the row.
+func (d clickhouseDialect) revertMutation(ctx context.Context, tx Tx, l *Loader, table *TableInfo, reversion clickhouseReversion) error {
+	if reversion.op != "U" && reversion.op != "D" {
+		panic("invalid op in revert command")
+	}
+
+	prev := map[string]string{}
+	if err := json.Unmarshal([]byte(reversion.prevValue), &prev); err != nil {
+		return fmt.Errorf("unmarshalling %q: %w", reversion.prevValue, err)
+	}
+
+	current, err := d.currentRows(ctx, tx, table, []map[string]string{reversion.primaryKey})
+	if err != nil {
+		return err
+	}
+
+	row := prev
+	if latest, found := current[createRowUniqueID(reversion.primaryKey)]; found {
+		changes := map[string]string{}
+		if table.engine.isDeletedColumn != "" {
+			changes[table.engine.isDeletedColumn] = "0"
+		}
+
+		// The restored row must be a version above the current one, deleted or not
+		if row, err = d.versionedRow(table, latest, changes); err != nil {
+			return err
+		}
+		for column, value := range prev {
+			if column != table.engine.versionColumn && column != table.engine.isDeletedColumn {
+				row[column] = value
+			}
+		}
+	}
+
+	return d.insertRows(ctx, l, table, []map[string]string{row}, nil)
 }
 
 func (d clickhouseDialect) GetCreateCursorQuery(schema string, withPostgraphile bool) string {
 	_ = withPostgraphile // TODO: see if this can work
 	return fmt.Sprintf(cli.Dedent(`
-	CREATE TABLE IF NOT EXISTS %s.%s
+	CREATE TABLE IF NOT EXISTS %s.%s%s
 	(
     id         String,
 		cursor     String,
 		block_num  Int64,
 		block_id   String
-	) Engine = ReplacingMergeTree() ORDER BY id;
-	`), EscapeIdentifier(schema), EscapeIdentifier(CURSORS_TABLE))
+	) Engine = %s ORDER BY id;
+	`), EscapeIdentifier(schema), EscapeIdentifier(CURSORS_TABLE), d.onCluster(), d.systemTableEngine("ReplacingMergeTree"))
 }
 
 func (d clickhouseDialect) GetCreateHistoryQuery(schema string, withPostgraphile bool) string {
-	panic("clickhouse does not support reorg management")
+	_ = withPostgraphile // TODO: see if this can work
+
+	// Replicated tables deduplicate inserts by default
+	settings := "\nSETTINGS non_replicated_deduplication_window = 1000"
+	if d.cluster != "" {
+		settings = ""
+	}
+
+	return fmt.Sprintf(cli.Dedent(`
+	CREATE TABLE IF NOT EXISTS %s%s
+	(
+		op           String,
+		table_name   String,
+		pk           String,
+		prev_value   Nullable(String),
+		block_num    UInt64,
+		ordinal      UInt64
+	) Engine = %s ORDER BY (block_num, table_name)%s;
+	`), d.historyTable(schema), d.onCluster(), d.systemTableEngine("MergeTree"), settings)
+}
+
+// migrateHistoryTable adds the `ordinal` column to the history table created by previous
+// versions, their entries have an ordinal of 0.
+func (d clickhouseDialect) migrateHistoryTable(ctx context.Context, l *Loader) error {
+	query := fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN IF NOT EXISTS ordinal UInt64", d.historyTable(l.schema), d.onCluster())
+	if _, err := l.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("executing migration %q: %w", query, err)
+	}
+	return nil
+}
+
+func (d clickhouseDialect) GetCreateCompletionsQuery(schema string, withPostgraphile bool) string {
+	_ = withPostgraphile // TODO: see if this can work
+	return fmt.Sprintf(cli.Dedent(`
+	CREATE TABLE IF NOT EXISTS %s.%s%s
+	(
+		id           String,
+		block_num    Int64,
+		block_id     String,
+		completed_at DateTime DEFAULT now()
+	) Engine = %s ORDER BY id;
+	`), EscapeIdentifier(schema), EscapeIdentifier(COMPLETIONS_TABLE), d.onCluster(), d.systemTableEngine("ReplacingMergeTree", "completed_at"))
+}
+
+func (d clickhouseDialect) createReorgsQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+	CREATE TABLE IF NOT EXISTS %s.%s%s
+	(
+		module_hash      String,
+		last_valid_block Int64,
+		cursor_before    String,
+		cursor_after     String,
+		reverted_rows    String,
+		duration_ms      Int64,
+		reverted_at      DateTime64(3) DEFAULT now64(3)
+	) Engine = %s ORDER BY (module_hash, reverted_at);
+	`), EscapeIdentifier(schema), EscapeIdentifier(REORGS_TABLE), d.onCluster(), d.systemTableEngine("MergeTree"))
+}
+
+var clickhouseIdentifierPattern = "(?:`[^`]+`|\"[^\"]+\"|\\w+)"
+
+// clickhouseDDLRegex matches the beginning of DDL statements up to the name of the object they
+// create, alter or drop.
+var clickhouseDDLRegex = regexp.MustCompile(`(?is)^(\s*(?:CREATE\s+(?:OR\s+REPLACE\s+)?(?:TABLE|(?:MATERIALIZED\s+)?VIEW|DICTIONARY|DATABASE)\s+(?:IF\s+NOT\s+EXISTS\s+)?|ALTER\s+TABLE\s+|DROP\s+(?:TABLE|VIEW|DICTIONARY|DATABASE)\s+(?:IF\s+EXISTS\s+)?)` +
+	clickhouseIdentifierPattern + `(?:\.` + clickhouseIdentifierPattern + `)?)`)
+
+var clickhouseOnClusterRegex = regexp.MustCompile(`(?i)\bON\s+CLUSTER\b`)
+
+// withOnCluster adds the `ON CLUSTER` clause to the DDL statement `query`, other statements and
+// statements already declaring a cluster are returned as is.
+func (d clickhouseDialect) withOnCluster(query string) string {
+	if clickhouseOnClusterRegex.MatchString(query) {
+		return query
+	}
+
+	location := clickhouseDDLRegex.FindStringIndex(query)
+	if location == nil {
+		return query
+	}
+
+	return query[:location[1]] + d.onCluster() + query[location[1]:]
 }
 
+// onCluster returns the `ON CLUSTER` clause of DDL queries, empty for a single node.
+func (d clickhouseDialect) onCluster() string {
+	if d.cluster == "" {
+		return ""
+	}
+	return " ON CLUSTER " + EscapeIdentifier(d.cluster)
+}
+
+// systemTableEngine returns the engine of a system table. On a cluster, system tables are
+// replicated on every node of the cluster, their replication path is not specific to a shard,
+// so cursors and history read on any node are the same.
+func (d clickhouseDialect) systemTableEngine(engine string, params ...string) string {
+	if d.cluster != "" {
+		engine = "Replicated" + engine
+		params = append([]string{"'/clickhouse/tables/{database}/{table}'", "'{replica}'"}, params...)
+	}
+	return engine + "(" + strings.Join(params, ", ") + ")"
+}
+
+// ExecuteSetupScript runs the statements of the schema one by one. On a cluster, DDL statements
+// not declaring an `ON CLUSTER` clause are run on the cluster, see withOnCluster.
 func (d clickhouseDialect) ExecuteSetupScript(ctx context.Context, l *Loader, schemaSql string) error {
 	for _, query := range strings.Split(schemaSql, ";") {
 		if len(strings.TrimSpace(query)) == 0 {
 			continue
 		}
+		if d.cluster != "" {
+			query = d.withOnCluster(query)
+		}
 		if _, err := l.ExecContext(ctx, query); err != nil {
 			return fmt.Errorf("exec schema: %w", err)
 		}
@@ -113,22 +714,46 @@ func (d clickhouseDialect) ExecuteSetupScript(ctx context.Context, l *Loader, sc
 	return nil
 }
 
+// GetUpdateCursorQuery inserts the new version of the cursor. On a cluster, the insert completes
+// once a majority of the replicas received it, see selectCursorsQuery.
 func (d clickhouseDialect) GetUpdateCursorQuery(table, moduleHash string, cursor *sink.Cursor, block_num uint64, block_id string) string {
+	settings := ""
+	if d.cluster != "" {
+		settings = " SETTINGS insert_quorum = 'auto', insert_quorum_parallel = 0"
+	}
+
 	return query(`
-			INSERT INTO %s (id, cursor, block_num, block_id) values ('%s', '%s', %d, '%s')
-	`, table, moduleHash, cursor, block_num, block_id)
+			INSERT INTO %s%s (id, cursor, block_num, block_id) values ('%s', '%s', %d, '%s')
+	`, table, settings, moduleHash, cursor, block_num, block_id)
 }
 
-func (d clickhouseDialect) ParseDatetimeNormalization(value string) string {
-	return fmt.Sprintf("parseDateTimeBestEffort(%s)", escapeStringValue(value))
+// selectCursorsQuery reads the cursors with FINAL, the table keeping every written cursor until
+// its parts are merged. On a cluster, the read only succeeds on a replica holding the last cursor
+// written with a quorum, see GetUpdateCursorQuery.
+func (d clickhouseDialect) selectCursorsQuery(table string) string {
+	query := fmt.Sprintf("SELECT id, cursor, block_num, block_id FROM %s FINAL", table)
+	if d.cluster != "" {
+		query += " SETTINGS select_sequential_consistency = 1"
+	}
+	return query
+}
+
+func (d clickhouseDialect) GetMarkCompletedQuery(table, moduleHash string, block_num uint64, block_id string) string {
+	return query(`
+			INSERT INTO %s (id, block_num, block_id) values ('%s', %d, '%s')
+	`, table, moduleHash, block_num, block_id)
 }
 
 func (d clickhouseDialect) DriverSupportRowsAffected() bool {
 	return false
 }
 
+func (d clickhouseDialect) EscapeIdentifier(valueToEscape string) string {
+	return EscapeIdentifier(valueToEscape)
+}
+
 func (d clickhouseDialect) OnlyInserts() bool {
-	return true
+	return false
 }
 
 func (d clickhouseDialect) CreateUser(tx Tx, ctx context.Context, l *Loader, username string, password string, _database string, readOnly bool) error {
@@ -159,23 +784,8 @@ func (d clickhouseDialect) CreateUser(tx Tx, ctx context.Context, l *Loader, use
 	return nil
 }
 
-func convertOpToClickhouseValues(o *Operation) ([]any, error) {
-	columns := make([]string, len(o.data))
-	i := 0
-	for column := range o.data {
-		columns[i] = column
-		i++
-	}
-	sort.Strings(columns)
-	values := make([]any, len(o.data))
-	for i, v := range columns {
-		convertedType, err := convertToType(o.data[v], o.table.columnsByName[v].scanType)
-		if err != nil {
-			return nil, fmt.Errorf("converting value %q to type %q in column %q: %w", o.data[v], o.table.columnsByName[v].scanType, v, err)
-		}
-		values[i] = convertedType
-	}
-	return values, nil
+func (d clickhouseDialect) historyTable(schema string) string {
+	return fmt.Sprintf("%s.%s", EscapeIdentifier(schema), EscapeIdentifier(HISTORY_TABLE))
 }
 
 func convertToType(value string, valueType reflect.Type) (any, error) {
@@ -214,8 +824,11 @@ func convertToType(value string, valueType reflect.Type) (any, error) {
 		return uint32(v), err
 	case reflect.Uint64:
 		return strconv.ParseUint(value, 10, 0)
-	case reflect.Float32, reflect.Float64:
-		return strconv.ParseFloat(value, 10)
+	case reflect.Float32:
+		v, err := strconv.ParseFloat(value, 32)
+		return float32(v), err
+	case reflect.Float64:
+		return strconv.ParseFloat(value, 64)
 	case reflect.Struct:
 		if valueType == reflectTypeTime {
 			if integerRegex.MatchString(value) {
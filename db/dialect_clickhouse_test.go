@@ -0,0 +1,383 @@
+package db
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClickhouseEngine(t *testing.T) {
+	tests := []struct {
+		engineFull string
+		expect     clickhouseEngine
+	}{
+		{"MergeTree ORDER BY id SETTINGS index_granularity = 8192", clickhouseEngine{name: "MergeTree"}},
+		{"MergeTree() ORDER BY (a, b)", clickhouseEngine{name: "MergeTree"}},
+		{"ReplacingMergeTree ORDER BY (a, b)", clickhouseEngine{name: "ReplacingMergeTree"}},
+		{"ReplacingMergeTree(version) ORDER BY id", clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version"}},
+		{"ReplacingMergeTree(version, is_deleted) ORDER BY id", clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted"}},
+		{
+			"ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/db/xfer', '{replica}', `ver`, deleted) ORDER BY id",
+			clickhouseEngine{name: "ReplacingMergeTree", replicated: true, deduplicated: true, versionColumn: "ver", isDeletedColumn: "deleted"},
+		},
+		{"MergeTree ORDER BY id SETTINGS non_replicated_deduplication_window = 1000, index_granularity = 8192", clickhouseEngine{name: "MergeTree", deduplicated: true}},
+		{"MergeTree ORDER BY id SETTINGS non_replicated_deduplication_window = 0", clickhouseEngine{name: "MergeTree"}},
+		{"Log", clickhouseEngine{name: "Log"}},
+		{
+			"Distributed('prod', 'default', 'xfer_local', cityHash64(id, idx))",
+			clickhouseEngine{name: "Distributed", distributed: &clickhouseDistributed{cluster: "prod", database: "default", table: "xfer_local"}},
+		},
+		{"Distributed(prod, '', `xfer_local`)", clickhouseEngine{name: "Distributed", distributed: &clickhouseDistributed{cluster: "prod", table: "xfer_local"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.engineFull, func(t *testing.T) {
+			assert.Equal(t, test.expect, parseClickhouseEngine(test.engineFull))
+		})
+	}
+}
+
+func newClickhouseTestTable(t *testing.T, pkList []string, engine clickhouseEngine) *TableInfo {
+	t.Helper()
+
+	table, err := NewTableInfo("default", "xfer", pkList, map[string]*ColumnInfo{
+		"id":         NewColumnInfo("id", "String", ""),
+		"idx":        NewColumnInfo("idx", "UInt32", uint32(0)),
+		"from":       NewColumnInfo("from", "String", ""),
+		"version":    NewColumnInfo("version", "UInt64", uint64(0)),
+		"updated_at": NewColumnInfo("updated_at", "DateTime", time.Time{}),
+		"is_deleted": NewColumnInfo("is_deleted", "UInt8", uint8(0)),
+	})
+	require.NoError(t, err)
+
+	table.engine = engine
+	return table
+}
+
+func TestClickhouseRevertInserts(t *testing.T) {
+	mergeTree := clickhouseEngine{name: "MergeTree"}
+	versioned := clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version"}
+	tombstones := clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted"}
+
+	tests := []struct {
+		name        string
+		table       *TableInfo
+		primaryKeys []map[string]string
+		expect      string
+	}{
+		{
+			name:        "lightweight delete",
+			table:       newClickhouseTestTable(t, []string{"id"}, mergeTree),
+			primaryKeys: []map[string]string{{"id": "a"}, {"id": "b'c"}},
+			expect:      `DELETE FROM "default"."xfer" WHERE ("id") IN (('a'),('b''c'))`,
+		},
+		{
+			name:        "lightweight delete composite key",
+			table:       newClickhouseTestTable(t, []string{"id", "idx"}, versioned),
+			primaryKeys: []map[string]string{{"id": "a", "idx": "1"}},
+			expect:      `DELETE FROM "default"."xfer" WHERE ("id","idx") IN (('a','1'))`,
+		},
+		{
+			name:        "lightweight delete on distributed table",
+			table:       newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "MergeTree", replicated: true, distributed: &clickhouseDistributed{cluster: "prod", database: "default", table: "xfer_local"}}),
+			primaryKeys: []map[string]string{{"id": "a"}},
+			expect:      `DELETE FROM "default"."xfer_local" ON CLUSTER "prod" WHERE ("id") IN (('a'))`,
+		},
+		{
+			name:        "tombstones on distributed table",
+			table:       newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted", distributed: &clickhouseDistributed{cluster: "prod", database: "default", table: "xfer_local"}}),
+			primaryKeys: []map[string]string{{"id": "a"}},
+			expect:      `INSERT INTO "default"."xfer" SELECT * REPLACE (1 AS "is_deleted", "version" + 1 AS "version") FROM "default"."xfer" FINAL WHERE ("id") IN (('a')) SETTINGS insert_distributed_sync = 1`,
+		},
+		{
+			name:        "tombstones",
+			table:       newClickhouseTestTable(t, []string{"id"}, tombstones),
+			primaryKeys: []map[string]string{{"id": "a"}},
+			expect:      `INSERT INTO "default"."xfer" SELECT * REPLACE (1 AS "is_deleted", "version" + 1 AS "version") FROM "default"."xfer" FINAL WHERE ("id") IN (('a'))`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := clickhouseDialect{}.revertInserts(test.table, test.primaryKeys)
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, query)
+		})
+	}
+
+	_, err := clickhouseDialect{}.revertInserts(newClickhouseTestTable(t, []string{"id", "idx"}, mergeTree), []map[string]string{{"id": "a"}})
+	assert.Error(t, err)
+}
+
+func TestClickhouseValidateMutation(t *testing.T) {
+	tests := []struct {
+		engine       clickhouseEngine
+		expectUpdate bool
+		expectDelete bool
+	}{
+		{clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted"}, true, true},
+		{clickhouseEngine{name: "ReplacingMergeTree", replicated: true}, true, true},
+		{clickhouseEngine{name: "MergeTree"}, false, true},
+		{clickhouseEngine{name: "SummingMergeTree"}, false, true},
+		{clickhouseEngine{name: "Log"}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.engine.name, func(t *testing.T) {
+			table := newClickhouseTestTable(t, []string{"id"}, test.engine)
+			d := clickhouseDialect{}
+
+			assert.Equal(t, test.expectUpdate, d.validateMutation(table, OperationTypeUpdate) == nil)
+			assert.Equal(t, test.expectUpdate, d.validateMutation(table, OperationTypeUpsert) == nil)
+			assert.Equal(t, test.expectDelete, d.validateMutation(table, OperationTypeDelete) == nil)
+		})
+	}
+}
+
+func TestClickhouseVersionedRow(t *testing.T) {
+	current := map[string]string{"id": "a", "from": "alice", "version": "7", "is_deleted": "0"}
+
+	versioned := newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted"})
+	row, err := clickhouseDialect{}.versionedRow(versioned, current, map[string]string{"from": "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"id": "a", "from": "bob", "version": "8", "is_deleted": "0"}, row)
+
+	row, err = clickhouseDialect{}.versionedRow(versioned, current, map[string]string{"is_deleted": "1"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"id": "a", "from": "alice", "version": "8", "is_deleted": "1"}, row)
+
+	row, err = clickhouseDialect{}.versionedRow(versioned, current, map[string]string{"version": "42"})
+	require.NoError(t, err)
+	assert.Equal(t, "42", row["version"], "an explicit version is kept")
+
+	unversioned := newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "ReplacingMergeTree"})
+	row, err = clickhouseDialect{}.versionedRow(unversioned, current, map[string]string{"from": "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, "7", row["version"])
+
+	assert.Equal(t, "a", current["id"], "current row is left untouched")
+	assert.Equal(t, "alice", current["from"], "current row is left untouched")
+}
+
+func TestClickhousePlanOperationsOrdinal(t *testing.T) {
+	l, _ := NewTestLoader(zlog, tracer, "default", TestTables("default"))
+	table := newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted"})
+	blockNum := uint64(10)
+
+	// A row deleted then inserted again in the same block, flushed as two generations
+	var ordinal uint64
+	current := map[string]map[string]string{
+		createRowUniqueID(map[string]string{"id": "a"}): {"id": "a", "from": "alice", "version": "7", "is_deleted": "0"},
+	}
+	deleted, err := clickhouseDialect{}.planOperations(l, table, []*Operation{
+		l.newDeleteOperation(table, map[string]string{"id": "a"}, &blockNum),
+		l.newInsertOperation(table, map[string]string{"id": "b"}, map[string]string{"id": "b", "from": "bob"}, &blockNum),
+	}, current, &ordinal)
+	require.NoError(t, err)
+
+	inserted, err := clickhouseDialect{}.planOperations(l, table, []*Operation{
+		l.newInsertOperation(table, map[string]string{"id": "a"}, map[string]string{"id": "a", "from": "carol"}, &blockNum),
+	}, nil, &ordinal)
+	require.NoError(t, err)
+
+	prevValue := `{"from":"alice","id":"a","is_deleted":"0","version":"7"}`
+	assert.Equal(t, [][]any{
+		{"D", `"default"."xfer"`, `{"id":"a"}`, &prevValue, uint64(10), uint64(0)},
+		{"I", `"default"."xfer"`, `{"id":"b"}`, (*string)(nil), uint64(10), uint64(1)},
+	}, deleted.history)
+	assert.Equal(t, [][]any{
+		{"I", `"default"."xfer"`, `{"id":"a"}`, (*string)(nil), uint64(10), uint64(2)},
+	}, inserted.history)
+	assert.Equal(t, uint64(3), ordinal)
+
+	assert.Contains(t, clickhouseDialect{}.GetCreateHistoryQuery("default", false), "ordinal      UInt64")
+}
+
+func TestClickhouseReinsertAfterDelete(t *testing.T) {
+	l, _ := NewTestLoader(zlog, tracer, "default", TestTables("default"))
+	table := newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "ReplacingMergeTree", versionColumn: "version", isDeletedColumn: "is_deleted"})
+	primaryKey := map[string]string{"id": "a"}
+	blockNum := uint64(10)
+
+	var ordinal uint64
+	deleted, err := clickhouseDialect{}.planOperations(l, table, []*Operation{
+		l.newDeleteOperation(table, primaryKey, &blockNum),
+	}, map[string]map[string]string{
+		createRowUniqueID(primaryKey): {"id": "a", "from": "alice", "version": "7", "is_deleted": "0"},
+	}, &ordinal)
+	require.NoError(t, err)
+	require.Len(t, deleted.rows, 1)
+	tombstone := deleted.rows[0]
+	assert.Equal(t, map[string]string{"id": "a", "from": "alice", "version": "8", "is_deleted": "1"}, tombstone)
+
+	for _, opType := range []OperationType{OperationTypeInsert, OperationTypeUpsert} {
+		t.Run(string(opType), func(t *testing.T) {
+			o := l.newInsertOperation(table, primaryKey, map[string]string{"id": "a", "from": "carol"}, &blockNum)
+			o.opType = opType
+
+			inserted, err := clickhouseDialect{}.planOperations(l, table, []*Operation{o}, map[string]map[string]string{
+				createRowUniqueID(primaryKey): tombstone,
+			}, &ordinal)
+			require.NoError(t, err)
+
+			assert.Equal(t, []map[string]string{{"id": "a", "from": "carol", "version": "9", "is_deleted": "0"}}, inserted.rows, "the row is above its tombstone")
+			require.Len(t, inserted.history, 1)
+			assert.Equal(t, "I", inserted.history[0][0])
+		})
+	}
+
+	replaced, err := clickhouseDialect{}.planOperations(l, table, []*Operation{
+		l.newInsertOperation(table, primaryKey, map[string]string{"id": "a", "from": "carol"}, &blockNum),
+	}, map[string]map[string]string{
+		createRowUniqueID(primaryKey): {"id": "a", "from": "alice", "version": "7", "is_deleted": "0"},
+	}, &ordinal)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"id": "a", "from": "carol", "version": "8", "is_deleted": "0"}}, replaced.rows)
+	require.Len(t, replaced.history, 1)
+	assert.Equal(t, "U", replaced.history[0][0], "inserting an existing row replaces it")
+}
+
+func TestClickhouseValidateTables(t *testing.T) {
+	l, _ := NewTestLoader(zlog, tracer, "default", TestTables("default"))
+	replicated := newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "MergeTree", replicated: true, deduplicated: true})
+	l.tables = map[string]*TableInfo{"xfer": replicated}
+	assert.NoError(t, clickhouseDialect{}.validateTables(l))
+
+	l.tables["xfer"] = newClickhouseTestTable(t, []string{"id"}, clickhouseEngine{name: "MergeTree"})
+	assert.ErrorContains(t, clickhouseDialect{}.validateTables(l), `tables "default"."xfer" do not deduplicate inserts`)
+}
+
+func TestNextVersion(t *testing.T) {
+	version, err := nextVersion("41", reflect.TypeOf(uint64(0)))
+	require.NoError(t, err)
+	assert.Equal(t, "42", version)
+
+	version, err = nextVersion("", reflect.TypeOf(int32(0)))
+	require.NoError(t, err)
+	assert.Equal(t, "1", version)
+
+	future := time.Now().Add(time.Hour).Unix()
+	version, err = nextVersion(strconv.FormatInt(future, 10), reflectTypeTime)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(future+1, 10), version)
+
+	version, err = nextVersion("1700000000", reflectTypeTime)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, version, strconv.FormatInt(time.Now().Unix()-1, 10))
+
+	_, err = nextVersion("abc", reflect.TypeOf(""))
+	assert.Error(t, err)
+}
+
+func TestClickhouseValueString(t *testing.T) {
+	name := "alice"
+	var missing *string
+
+	tests := []struct {
+		name        string
+		value       any
+		expect      string
+		expectFound bool
+	}{
+		{"string", "abc", "abc", true},
+		{"integer", uint32(12), "12", true},
+		{"boolean", true, "true", true},
+		{"time", time.Unix(1700000000, 0).UTC(), "1700000000", true},
+		{"big int", big.NewInt(123), "123", true},
+		{"nullable", &name, "alice", true},
+		{"null", missing, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, found := clickhouseValueString(test.value)
+			assert.Equal(t, test.expectFound, found)
+			assert.Equal(t, test.expect, value)
+		})
+	}
+}
+
+func TestClickhouseColumnBuffers(t *testing.T) {
+	prev := `{"id":"a"}`
+
+	columns, err := clickhouseColumnBuffers([][]any{
+		{"I", uint64(10), (*string)(nil)},
+		{"U", uint64(11), &prev},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []any{
+		[]string{"I", "U"},
+		[]uint64{10, 11},
+		[]*string{nil, &prev},
+	}, columns)
+
+	columns, err = clickhouseColumnBuffers(nil)
+	require.NoError(t, err)
+	assert.Empty(t, columns)
+
+	_, err = clickhouseColumnBuffers([][]any{{"a", uint64(1)}, {"b", int64(2)}})
+	assert.Error(t, err)
+
+	_, err = clickhouseColumnBuffers([][]any{{"a", nil}})
+	assert.Error(t, err)
+}
+
+func TestClickhouseDedupTokens(t *testing.T) {
+	ctx := withFlushRange(context.Background(), flushRange{start: 101, stop: 200, stopID: "abc"})
+
+	tokens := newClickhouseDedupTokens(ctx)
+	assert.Equal(t, `"default"."xfer":101-200:abc:0`, tokens.next(`"default"."xfer"`))
+	assert.Equal(t, `"default"."history":101-200:abc:0`, tokens.next(`"default"."history"`))
+	assert.Equal(t, `"default"."xfer":101-200:abc:1`, tokens.next(`"default"."xfer"`))
+
+	replayed := newClickhouseDedupTokens(ctx)
+	assert.Equal(t, `"default"."xfer":101-200:abc:0`, replayed.next(`"default"."xfer"`), "replaying the range yields the same tokens")
+
+	none := newClickhouseDedupTokens(context.Background())
+	assert.Nil(t, none)
+	assert.Equal(t, "", none.next(`"default"."xfer"`))
+}
+
+func TestClickhouseSelectCursorsQuery(t *testing.T) {
+	assert.Equal(t, `SELECT id, cursor, block_num, block_id FROM "default"."cursors" FINAL`, clickhouseDialect{}.selectCursorsQuery(`"default"."cursors"`))
+}
+
+func TestClickhouseCluster(t *testing.T) {
+	single := clickhouseDialect{}
+	cluster := clickhouseDialect{cluster: "prod"}
+
+	assert.Equal(t, "ReplacingMergeTree()", single.systemTableEngine("ReplacingMergeTree"))
+	assert.Equal(t, "ReplicatedReplacingMergeTree('/clickhouse/tables/{database}/{table}', '{replica}', completed_at)", cluster.systemTableEngine("ReplacingMergeTree", "completed_at"))
+	assert.Contains(t, cluster.GetCreateCursorQuery("default", false), `CREATE TABLE IF NOT EXISTS "default"."cursors" ON CLUSTER "prod"`)
+	assert.Contains(t, cluster.GetCreateHistoryQuery("default", false), `Engine = ReplicatedMergeTree('/clickhouse/tables/{database}/{table}', '{replica}') ORDER BY (block_num, table_name);`)
+	assert.Contains(t, single.GetCreateHistoryQuery("default", false), "Engine = MergeTree() ORDER BY (block_num, table_name)\nSETTINGS non_replicated_deduplication_window = 1000;")
+
+	assert.Equal(t, `SELECT id, cursor, block_num, block_id FROM "default"."cursors" FINAL SETTINGS select_sequential_consistency = 1`, cluster.selectCursorsQuery(`"default"."cursors"`))
+	assert.Contains(t, cluster.GetUpdateCursorQuery(`"default"."cursors"`, "abc", sink.NewBlankCursor(), 0, ""), `INSERT INTO "default"."cursors" SETTINGS insert_quorum = 'auto', insert_quorum_parallel = 0 (id, cursor, block_num, block_id)`)
+
+	tests := []struct {
+		query  string
+		expect string
+	}{
+		{"CREATE TABLE xfer (id String) ENGINE = MergeTree ORDER BY id", `CREATE TABLE xfer ON CLUSTER "prod" (id String) ENGINE = MergeTree ORDER BY id`},
+		{"\ncreate table if not exists `default`.`xfer`(id String)", "\ncreate table if not exists `default`.`xfer` ON CLUSTER \"prod\"(id String)"},
+		{"CREATE MATERIALIZED VIEW IF NOT EXISTS totals TO t AS SELECT 1", `CREATE MATERIALIZED VIEW IF NOT EXISTS totals ON CLUSTER "prod" TO t AS SELECT 1`},
+		{"ALTER TABLE \"default\".xfer ADD COLUMN x UInt8", `ALTER TABLE "default".xfer ON CLUSTER "prod" ADD COLUMN x UInt8`},
+		{"DROP TABLE IF EXISTS xfer", `DROP TABLE IF EXISTS xfer ON CLUSTER "prod"`},
+		{"CREATE TABLE xfer ON CLUSTER other (id String)", "CREATE TABLE xfer ON CLUSTER other (id String)"},
+		{"INSERT INTO xfer VALUES ('a')", "INSERT INTO xfer VALUES ('a')"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			assert.Equal(t, test.expect, cluster.withOnCluster(test.query))
+		})
+	}
+}
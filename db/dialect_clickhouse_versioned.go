@@ -0,0 +1,433 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clickhouseEngine describes the engine of a table, see parseClickhouseEngine.
+type clickhouseEngine struct {
+	// name is the engine name without its `Replicated` prefix, e.g. `ReplacingMergeTree`
+	name       string
+	replicated bool
+
+	// deduplicated is set on engines dropping the inserts whose `insert_deduplication_token` was
+	// already received: replicated engines and the ones with `non_replicated_deduplication_window`.
+	deduplicated bool
+
+	// versionColumn and isDeletedColumn are the parameters of a `ReplacingMergeTree`, empty
+	// when not declared.
+	versionColumn   string
+	isDeletedColumn string
+
+	// distributed is set on `Distributed` tables, the other fields then describe the engine of
+	// the local tables holding the rows.
+	distributed *clickhouseDistributed
+}
+
+// clickhouseDistributed are the parameters of a `Distributed` table: the cluster and the local
+// tables holding the rows on each shard.
+type clickhouseDistributed struct {
+	cluster  string
+	database string
+	table    string
+}
+
+// localTable returns the escaped identifier of the local tables.
+func (d *clickhouseDistributed) localTable() string {
+	return EscapeIdentifier(d.database) + "." + EscapeIdentifier(d.table)
+}
+
+// mergeTree reports whether the engine belongs to the MergeTree family, the only one
+// supporting lightweight deletes.
+func (e clickhouseEngine) mergeTree() bool {
+	return strings.HasSuffix(e.name, "MergeTree")
+}
+
+var clickhouseDeduplicationWindowRegex = regexp.MustCompile(`(?i)\bnon_replicated_deduplication_window\s*=\s*'?(\d+)`)
+
+// parseClickhouseEngine parses the `engine_full` column of `system.tables`, e.g.
+// `ReplacingMergeTree(version, is_deleted) ORDER BY id SETTINGS index_granularity = 8192`.
+// The ZooKeeper path and replica name parameters of replicated engines are skipped.
+func parseClickhouseEngine(engineFull string) clickhouseEngine {
+	engineFull = strings.TrimSpace(engineFull)
+	name, rest := engineFull, ""
+	if i := strings.IndexAny(engineFull, "( "); i >= 0 {
+		name, rest = engineFull[:i], engineFull[i:]
+	}
+
+	engine := clickhouseEngine{name: strings.TrimPrefix(name, "Replicated")}
+	engine.replicated = engine.name != name
+	engine.deduplicated = engine.replicated
+	if match := clickhouseDeduplicationWindowRegex.FindStringSubmatch(rest); match != nil && strings.Trim(match[1], "0") != "" {
+		engine.deduplicated = engine.mergeTree()
+	}
+
+	if engine.name == "Distributed" && strings.HasPrefix(rest, "(") {
+		args := splitClickhouseArgs(rest[1:])
+		for i, arg := range args {
+			args[i] = strings.Trim(arg, "'`\"")
+		}
+		if len(args) >= 3 {
+			engine.distributed = &clickhouseDistributed{cluster: args[0], database: args[1], table: args[2]}
+		}
+		return engine
+	}
+
+	if engine.name != "ReplacingMergeTree" || !strings.HasPrefix(rest, "(") {
+		return engine
+	}
+
+	params, _, _ := strings.Cut(rest[1:], ")")
+
+	var columns []string
+	for _, param := range strings.Split(params, ",") {
+		param = strings.TrimSpace(param)
+		if param == "" || strings.HasPrefix(param, "'") {
+			continue
+		}
+		columns = append(columns, strings.Trim(param, "`\""))
+	}
+
+	if len(columns) > 0 {
+		engine.versionColumn = columns[0]
+	}
+	if len(columns) > 1 {
+		engine.isDeletedColumn = columns[1]
+	}
+
+	return engine
+}
+
+// splitClickhouseArgs splits the arguments of an engine, `in` starting right after its opening
+// parenthesis, on the commas not nested in parentheses or quotes. The arguments are trimmed.
+func splitClickhouseArgs(in string) (args []string) {
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range in {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '`' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')' && depth == 0:
+			return append(args, strings.TrimSpace(in[start:i]))
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(in[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(args, strings.TrimSpace(in[start:]))
+}
+
+// inspectTable detects the engine of the table, the engine of the local tables for `Distributed`
+// tables.
+func (d clickhouseDialect) inspectTable(db *sql.DB, table *TableInfo) error {
+	engine, err := d.queryEngine(db, table.schema, table.name)
+	if err != nil {
+		return err
+	}
+
+	if distributed := engine.distributed; distributed != nil {
+		if distributed.database == "" {
+			distributed.database = table.schema
+		}
+
+		local, err := d.queryEngine(db, distributed.database, distributed.table)
+		if err != nil {
+			return fmt.Errorf("local table of distributed table: %w", err)
+		}
+
+		local.distributed = distributed
+		engine = local
+	}
+
+	table.engine = engine
+	return nil
+}
+
+func (d clickhouseDialect) queryEngine(db *sql.DB, database, table string) (clickhouseEngine, error) {
+	var engineFull string
+	err := db.QueryRow(`SELECT engine_full FROM system.tables WHERE database = ? AND name = ?`, database, table).Scan(&engineFull)
+	if err != nil {
+		return clickhouseEngine{}, fmt.Errorf("querying engine of %s.%s: %w", database, table, err)
+	}
+
+	return parseClickhouseEngine(engineFull), nil
+}
+
+// deleteFrom returns the beginning of a lightweight `DELETE` query on the table, up to its
+// `WHERE` clause. Lightweight deletes are not supported by `Distributed` tables, they are run
+// on the local tables of every shard.
+func (d clickhouseDialect) deleteFrom(table *TableInfo) string {
+	if distributed := table.engine.distributed; distributed != nil {
+		return fmt.Sprintf("DELETE FROM %s ON CLUSTER %s", distributed.localTable(), EscapeIdentifier(distributed.cluster))
+	}
+	return "DELETE FROM " + table.identifier
+}
+
+// validateMutation accepts updates and upserts on `ReplacingMergeTree` tables, which are
+// written as new versions of the row, and deletes on all the MergeTree family.
+func (d clickhouseDialect) validateMutation(table *TableInfo, opType OperationType) error {
+	switch opType {
+	case OperationTypeUpdate, OperationTypeUpsert:
+		if table.engine.name != "ReplacingMergeTree" {
+			return fmt.Errorf("table %s uses engine %q, updates are only supported on ReplacingMergeTree tables", table.identifier, table.engine.name)
+		}
+
+	case OperationTypeDelete:
+		if !table.engine.mergeTree() {
+			return fmt.Errorf("table %s uses engine %q, deletes are only supported on MergeTree tables", table.identifier, table.engine.name)
+		}
+	}
+
+	return nil
+}
+
+// currentRows returns the latest version of the rows with the given primary keys, keyed by
+// row unique id (see createRowUniqueID). When the table declares a version column, the rows
+// deleted through `is_deleted` are returned as well, see isDeleted.
+func (d clickhouseDialect) currentRows(ctx context.Context, tx Tx, table *TableInfo, primaryKeys []map[string]string) (map[string]map[string]string, error) {
+	condition, err := d.primaryKeysCondition(table, primaryKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryColumns := make([]string, len(table.primaryColumns))
+	for i, column := range table.primaryColumns {
+		primaryColumns[i] = column.escapedName
+	}
+
+	var query string
+	switch {
+	case table.engine.versionColumn != "":
+		query = fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s DESC LIMIT 1 BY %s",
+			table.identifier,
+			condition,
+			EscapeIdentifier(table.engine.versionColumn),
+			strings.Join(primaryColumns, ","),
+		)
+	case table.engine.name == "ReplacingMergeTree":
+		query = fmt.Sprintf("SELECT * FROM %s FINAL WHERE %s", table.identifier, condition)
+	default:
+		query = fmt.Sprintf("SELECT * FROM %s WHERE %s LIMIT 1 BY %s", table.identifier, condition, strings.Join(primaryColumns, ","))
+	}
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("executing query %q: %w", query, err)
+	}
+
+	out := map[string]map[string]string{}
+	if rows == nil { // rows will be nil with no error only in testing scenarios
+		return out, nil
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, fmt.Errorf("columns of %s: %w", table.identifier, err)
+	}
+
+	for rows.Next() {
+		pointers := make([]any, len(columnTypes))
+		for i, columnType := range columnTypes {
+			pointers[i] = reflect.New(columnType.ScanType()).Interface()
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("scanning row of %s: %w", table.identifier, err)
+		}
+
+		row := make(map[string]string, len(columnTypes))
+		for i, columnType := range columnTypes {
+			if value, ok := clickhouseValueString(reflect.ValueOf(pointers[i]).Elem().Interface()); ok {
+				row[columnType.Name()] = value
+			}
+		}
+
+		primaryKey := make(map[string]string, len(table.primaryColumns))
+		for _, column := range table.primaryColumns {
+			primaryKey[column.name] = row[column.name]
+		}
+		out[createRowUniqueID(primaryKey)] = row
+	}
+
+	return out, rows.Err()
+}
+
+// isDeleted reports whether the row read by currentRows is a deleted version.
+func (d clickhouseDialect) isDeleted(table *TableInfo, row map[string]string) bool {
+	if table.engine.isDeletedColumn == "" {
+		return false
+	}
+
+	return row[table.engine.isDeletedColumn] != "" && row[table.engine.isDeletedColumn] != "0"
+}
+
+// versionedRow returns the new version of the row `current` with `changes` applied, its
+// version column, if any and not part of the changes, is set to the next version.
+func (d clickhouseDialect) versionedRow(table *TableInfo, current map[string]string, changes map[string]string) (map[string]string, error) {
+	row := make(map[string]string, len(current)+len(changes))
+	for column, value := range current {
+		row[column] = value
+	}
+	for column, value := range changes {
+		row[column] = value
+	}
+
+	versionColumn := table.engine.versionColumn
+	if _, changed := changes[versionColumn]; versionColumn == "" || changed {
+		return row, nil
+	}
+
+	columnInfo, found := table.columnsByName[versionColumn]
+	if !found {
+		return nil, fmt.Errorf("version column %q not found in table %s", versionColumn, table.identifier)
+	}
+
+	version, err := nextVersion(current[versionColumn], columnInfo.scanType)
+	if err != nil {
+		return nil, fmt.Errorf("version column %q: %w", versionColumn, err)
+	}
+	row[versionColumn] = version
+
+	return row, nil
+}
+
+// nextVersion returns the version following `current` in the same format, integers are
+// incremented while times move to the current time, or the next second when `current` is
+// in the future.
+func nextVersion(current string, valueType reflect.Type) (string, error) {
+	if current == "" {
+		current = "0"
+	}
+
+	switch valueType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid version %q: %w", current, err)
+		}
+		return strconv.FormatInt(v+1, 10), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(current, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid version %q: %w", current, err)
+		}
+		return strconv.FormatUint(v+1, 10), nil
+
+	case reflect.Struct:
+		if valueType == reflectTypeTime {
+			v, err := strconv.ParseInt(current, 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid version %q: %w", current, err)
+			}
+			return strconv.FormatInt(max(time.Now().Unix(), v+1), 10), nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported version type %s", valueType)
+}
+
+// clickhouseValueString formats a value scanned from ClickHouse the way Substreams values are
+// received, so it can be converted back by convertToType. Times are formatted as unix seconds,
+// false is returned for NULL values.
+func clickhouseValueString(value any) (string, bool) {
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return "", false
+		}
+		if v, ok := rv.Interface().(*big.Int); ok {
+			return v.String(), true
+		}
+		rv = rv.Elem()
+	}
+
+	switch v := rv.Interface().(type) {
+	case time.Time:
+		return strconv.FormatInt(v.Unix(), 10), true
+	case []byte:
+		return string(v), true
+	case big.Int:
+		return v.String(), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// primaryKeysCondition returns the condition matching the rows with the given primary keys.
+func (d clickhouseDialect) primaryKeysCondition(table *TableInfo, primaryKeys []map[string]string) (string, error) {
+	if len(table.primaryColumns) == 0 {
+		return "", fmt.Errorf("table %s has no primary key, its rows cannot be identified", table.identifier)
+	}
+
+	columns := make([]string, len(table.primaryColumns))
+	for i, column := range table.primaryColumns {
+		columns[i] = column.escapedName
+	}
+
+	tuples := make([]string, len(primaryKeys))
+	for i, primaryKey := range primaryKeys {
+		values := make([]string, len(table.primaryColumns))
+		for j, column := range table.primaryColumns {
+			value, found := primaryKey[column.name]
+			if !found {
+				return "", fmt.Errorf("primary key %q is missing column %q", primaryKey, column.name)
+			}
+			values[j] = escapeStringValue(value)
+		}
+		tuples[i] = "(" + strings.Join(values, ",") + ")"
+	}
+
+	return fmt.Sprintf("(%s) IN (%s)", strings.Join(columns, ","), strings.Join(tuples, ",")), nil
+}
+
+// revertInserts returns the query removing the rows with the given primary keys from the
+// table. Rows of tables declaring an `is_deleted` column are removed by inserting a tombstone,
+// a copy of the row with `is_deleted` set to 1 (and its version incremented), rows of other
+// tables are removed with a lightweight `DELETE`.
+func (d clickhouseDialect) revertInserts(table *TableInfo, primaryKeys []map[string]string) (string, error) {
+	condition, err := d.primaryKeysCondition(table, primaryKeys)
+	if err != nil {
+		return "", err
+	}
+
+	if table.engine.isDeletedColumn != "" {
+		isDeleted := EscapeIdentifier(table.engine.isDeletedColumn)
+		replaced := "1 AS " + isDeleted
+		if table.engine.versionColumn != "" {
+			version := EscapeIdentifier(table.engine.versionColumn)
+			replaced += ", " + version + " + 1 AS " + version
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s SELECT * REPLACE (%s) FROM %s FINAL WHERE %s",
+			table.identifier,
+			replaced,
+			table.identifier,
+			condition,
+		)
+		if table.engine.distributed != nil {
+			// Tombstones must reach the shards before the revert completes
+			query += " SETTINGS insert_distributed_sync = 1"
+		}
+		return query, nil
+	}
+
+	return fmt.Sprintf("%s WHERE %s", d.deleteFrom(table), condition), nil
+}
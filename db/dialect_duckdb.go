@@ -0,0 +1,732 @@
+//go:build duckdb
+
+// The DuckDB driver links the DuckDB library through cgo, it is thus only compiled in when
+// building with the `duckdb` build tag (`go build -tags duckdb ./...`).
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+	"github.com/streamingfast/cli"
+	sink "github.com/streamingfast/substreams-sink"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+)
+
+func init() {
+	// The `duckdb` scheme is known even without the build tag to report that support is not compiled in
+	dialects["duckdb"] = duckdbDialect{} // github.com/marcboeker/go-duckdb
+}
+
+// duckdbMaxBindParameters bounds the amount of bind parameters sent in a single statement,
+// DuckDB has no hard limit but very large statements are slow to bind.
+const duckdbMaxBindParameters = 32768
+
+// duckdbDialect handles DuckDB databases. DuckDB is an analytical database, it's optimized
+// for bulk inserts which are written through its appender, updates, upserts and deletes are
+// supported but run as regular statements. Reorgs are supported the same way as on SQLite,
+// by recording the previous value of rows as JSON in the history table.
+//
+// The appender writes through the driver connection, transactions are thus opened on a
+// dedicated connection (see duckdbTx) so appended rows are part of the flush transaction.
+type duckdbDialect struct{}
+
+// duckdbTx is a transaction holding the connection on which it was opened.
+type duckdbTx struct {
+	*sql.Tx
+	conn *sql.Conn
+}
+
+func (t *duckdbTx) Commit() error {
+	defer t.conn.Close()
+	return t.Tx.Commit()
+}
+
+func (t *duckdbTx) Rollback() error {
+	defer t.conn.Close()
+	return t.Tx.Rollback()
+}
+
+func (d duckdbDialect) beginTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions) (Tx, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get connection: %w", err)
+	}
+
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &duckdbTx{Tx: tx, conn: conn}, nil
+}
+
+// tables lists the tables of the database with their columns, github.com/jimsmart/schema
+// does not know about the DuckDB driver.
+func (d duckdbDialect) tables(db *sql.DB) (map[[2]string][]*sql.ColumnType, error) {
+	rows, err := db.Query(`SELECT schema_name, table_name FROM duckdb_tables() WHERE NOT internal AND NOT temporary`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names [][2]string
+	for rows.Next() {
+		var name [2]string
+		if err := rows.Scan(&name[0], &name[1]); err != nil {
+			return nil, fmt.Errorf("scanning table name: %w", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	out := make(map[[2]string][]*sql.ColumnType, len(names))
+	for _, name := range names {
+		columns, err := d.columnTypes(db, name[0], name[1])
+		if err != nil {
+			return nil, fmt.Errorf("table %s.%s: %w", name[0], name[1], err)
+		}
+		out[name] = columns
+	}
+
+	return out, nil
+}
+
+func (d duckdbDialect) columnTypes(db *sql.DB, schema, table string) ([]*sql.ColumnType, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s.%s LIMIT 0", EscapeIdentifier(schema), EscapeIdentifier(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return rows.ColumnTypes()
+}
+
+func (d duckdbDialect) primaryKey(db *sql.DB, schema, table string) ([]string, error) {
+	rows, err := db.Query(`SELECT unnest(constraint_column_names) FROM duckdb_constraints() WHERE schema_name = ? AND table_name = ? AND constraint_type = 'PRIMARY KEY'`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("scanning primary key column: %w", err)
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// Revert undoes the operations recorded in the history one by one, see revertFromHistory.
+func (d duckdbDialect) Revert(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64) error {
+	return revertFromHistory(tx, ctx, l, lastValidFinalBlock,
+		fmt.Sprintf(`SELECT op,table_name,pk,prev_value,block_num FROM %s WHERE "block_num" > %d ORDER BY "block_num" DESC, "id" DESC`, d.historyTable(l.schema), lastValidFinalBlock),
+		fmt.Sprintf(`DELETE FROM %s WHERE "block_num" > %d;`, d.historyTable(l.schema), lastValidFinalBlock),
+		d.revertOp,
+	)
+}
+
+// revertOp restores the row as it was before the operation, `prev_value` holds the row's
+// columns as a JSON object, each column is extracted from it with `json_extract_string` and
+// cast back to the column's type by DuckDB.
+func (d duckdbDialect) revertOp(tx Tx, ctx context.Context, op, escaped_table_name, pk, prev_value string) error {
+	pkmap := make(map[string]string)
+	if err := json.Unmarshal([]byte(pk), &pkmap); err != nil {
+		return fmt.Errorf("revertOp: unmarshalling %q: %w", pk, err)
+	}
+
+	var stmt *statement
+	switch op {
+	case "I":
+		stmt = newStatement(fmt.Sprintf(`DELETE FROM %s WHERE %s;`,
+			escaped_table_name,
+			getPrimaryKeyWhereClause(pkmap),
+		))
+
+	case "D":
+		columns, err := jsonObjectKeys(prev_value)
+		if err != nil {
+			return err
+		}
+
+		escapedColumns := make([]string, len(columns))
+		values := make([]string, len(columns))
+		args := make([]any, len(columns))
+		for i, column := range columns {
+			escapedColumns[i] = EscapeIdentifier(column)
+			values[i] = d.jsonExtract(column)
+			args[i] = prev_value
+		}
+
+		stmt = newStatement(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s);`,
+			escaped_table_name,
+			strings.Join(escapedColumns, ","),
+			strings.Join(values, ","),
+		), args...)
+
+	case "U":
+		columns, err := jsonObjectKeys(prev_value)
+		if err != nil {
+			return err
+		}
+
+		updates := make([]string, 0, len(columns))
+		args := make([]any, 0, len(columns))
+		for _, column := range columns {
+			// DuckDB refuses to update the columns of the primary key, they are unchanged anyway
+			if _, isPrimary := pkmap[column]; isPrimary {
+				continue
+			}
+
+			updates = append(updates, EscapeIdentifier(column)+"="+d.jsonExtract(column))
+			args = append(args, prev_value)
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		stmt = newStatement(fmt.Sprintf(`UPDATE %s SET %s WHERE %s;`,
+			escaped_table_name,
+			strings.Join(updates, ", "),
+			getPrimaryKeyWhereClause(pkmap),
+		), args...)
+
+	default:
+		panic("invalid op in revert command")
+	}
+
+	if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+		return fmt.Errorf("executing revert query %q: %w", stmt.query, err)
+	}
+	return nil
+}
+
+// jsonExtract returns the expression extracting `column` from the JSON object bound as its
+// own parameter.
+func (d duckdbDialect) jsonExtract(column string) string {
+	return "json_extract_string(?," + escapeStringValue(`$."`+column+`"`) + ")"
+}
+
+func (d duckdbDialect) Flush(tx Tx, ctx context.Context, l *Loader, entries *PendingOperations, outputModuleHash string, lastFinalBlock uint64) (int, error) {
+	rowCount, err := l.flushByGeneration(entries, func(tableName string, operations []*Operation) error {
+		if err := d.flushOperations(ctx, tx, l, operations); err != nil {
+			return fmt.Errorf("flushing table %q: %w", tableName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.pruneReversibleSegment(tx, ctx, l.schema, lastFinalBlock); err != nil {
+		return 0, err
+	}
+
+	return rowCount, nil
+}
+
+// flushOperations applies operations of a single table, each for a different row. Inserts
+// are written through the appender when possible, see appendInserts.
+func (d duckdbDialect) flushOperations(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	var statements []*statement
+	var inserts, upserts []*Operation
+	for _, operation := range operations {
+		switch operation.opType {
+		case OperationTypeInsert:
+			inserts = append(inserts, operation)
+
+		case OperationTypeUpsert:
+			upserts = append(upserts, operation)
+
+		default:
+			operationStatements, err := d.prepareStatement(l.schema, operation)
+			if err != nil {
+				return fmt.Errorf("failed to prepare statement: %w", err)
+			}
+			statements = append(statements, operationStatements...)
+		}
+	}
+
+	if len(upserts) > 0 {
+		upsertStatements, err := d.insertStatements(l.schema, upserts)
+		if err != nil {
+			return fmt.Errorf("preparing upserts: %w", err)
+		}
+		statements = append(statements, upsertStatements...)
+	}
+
+	if len(inserts) > 0 {
+		insertStatements, err := d.flushInserts(ctx, tx, l, inserts)
+		if err != nil {
+			return fmt.Errorf("flushing inserts: %w", err)
+		}
+		statements = append(statements, insertStatements...)
+	}
+
+	for _, stmt := range statements {
+		if l.tracer.Enabled() {
+			l.logger.Debug("adding query to transaction", zap.String("query", stmt.query), zap.Int("arg_count", len(stmt.args)))
+		}
+
+		if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("executing query %q: %w", stmt.query, err)
+		}
+	}
+
+	return nil
+}
+
+// flushInserts records the history of the reversible inserts then appends the rows, it returns
+// the statements to execute for the rows that could not be appended.
+func (d duckdbDialect) flushInserts(ctx context.Context, tx Tx, l *Loader, operations []*Operation) ([]*statement, error) {
+	var history [][]any
+	for _, o := range operations {
+		if o.reversibleBlockNum != nil {
+			history = append(history, []any{"I", o.table.identifier, primaryKeyToJSON(o.primaryKey), *o.reversibleBlockNum})
+		}
+	}
+
+	if len(history) > 0 {
+		for _, stmt := range positionalMultiRowInsert(fmt.Sprintf("INSERT INTO %s (op,table_name,pk,block_num) VALUES ", d.historyTable(l.schema)), "", 4, history, duckdbMaxBindParameters, 0) {
+			if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+				return nil, fmt.Errorf("executing query %q: %w", stmt.query, err)
+			}
+		}
+	}
+
+	if dtx, ok := tx.(*duckdbTx); ok {
+		appended, err := d.appendInserts(ctx, dtx, operations)
+		if err != nil {
+			return nil, err
+		}
+		if appended {
+			return nil, nil
+		}
+
+		l.logger.Debug("inserts cannot be appended, using insert statements", zap.String("table_name", operations[0].table.name))
+	}
+
+	return d.insertStatements(l.schema, operations)
+}
+
+// appendInserts writes the rows through the DuckDB appender. The appender receives every
+// column of the table in order and typed values, it's thus only used when all values can be
+// converted (see appenderValue) and no omitted column has a default value, it returns false
+// otherwise.
+func (d duckdbDialect) appendInserts(ctx context.Context, tx *duckdbTx, operations []*Operation) (bool, error) {
+	table := operations[0].table
+	columns, err := d.tableColumns(ctx, tx, table)
+	if err != nil {
+		return false, err
+	}
+
+	positions := make(map[string]int, len(columns))
+	for i, column := range columns {
+		positions[column.name] = i
+	}
+
+	rows := make([][]driver.Value, len(operations))
+	for i, o := range operations {
+		row := make([]driver.Value, len(columns))
+		for columnName, value := range o.data {
+			position, found := positions[columnName]
+			if !found {
+				return false, nil
+			}
+
+			columnInfo, found := table.columnsByName[columnName]
+			if !found {
+				return false, nil
+			}
+
+			converted, ok := d.appenderValue(value, columnInfo.scanType)
+			if !ok {
+				return false, nil
+			}
+			row[position] = converted
+		}
+
+		for _, column := range columns {
+			if _, found := o.data[column.name]; !found && column.hasDefault {
+				return false, nil
+			}
+		}
+
+		rows[i] = row
+	}
+
+	err = tx.conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), table.schema, table.name)
+		if err != nil {
+			return fmt.Errorf("new appender: %w", err)
+		}
+
+		for _, row := range rows {
+			if err := appender.AppendRow(row...); err != nil {
+				appender.Close()
+				return fmt.Errorf("append row: %w", err)
+			}
+		}
+
+		return appender.Close()
+	})
+	if err != nil {
+		return false, fmt.Errorf("appending to %s: %w", table.identifier, err)
+	}
+
+	return true, nil
+}
+
+type duckdbColumn struct {
+	name       string
+	hasDefault bool
+}
+
+// tableColumns returns the columns of the table ordered by position.
+func (d duckdbDialect) tableColumns(ctx context.Context, tx Tx, table *TableInfo) ([]duckdbColumn, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT column_name, column_default IS NOT NULL FROM duckdb_columns() WHERE schema_name = ? AND table_name = ? ORDER BY column_index`, table.schema, table.name)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns of %s: %w", table.identifier, err)
+	}
+	defer rows.Close()
+
+	var columns []duckdbColumn
+	for rows.Next() {
+		var column duckdbColumn
+		if err := rows.Scan(&column.name, &column.hasDefault); err != nil {
+			return nil, fmt.Errorf("scanning column: %w", err)
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// appenderValue converts the value to the Go type of the column as expected by the appender,
+// it returns false when the value cannot be converted.
+func (d duckdbDialect) appenderValue(value string, valueType reflect.Type) (driver.Value, bool) {
+	switch valueType.Kind() {
+	case reflect.String:
+		return value, true
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		return b, err == nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, valueType.Bits())
+		if err != nil {
+			return nil, false
+		}
+		return reflect.ValueOf(i).Convert(valueType).Interface(), true
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, valueType.Bits())
+		if err != nil {
+			return nil, false
+		}
+		return reflect.ValueOf(u).Convert(valueType).Interface(), true
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, valueType.Bits())
+		if err != nil {
+			return nil, false
+		}
+		return reflect.ValueOf(f).Convert(valueType).Interface(), true
+
+	case reflect.Struct:
+		if valueType != reflectTypeTime {
+			return nil, false
+		}
+
+		if integerRegex.MatchString(value) {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			return time.Unix(i, 0).UTC(), true
+		}
+
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.UTC(), true
+			}
+		}
+		return nil, false
+
+	default:
+		return nil, false
+	}
+}
+
+// insertStatements returns the statements to apply the insert (or upsert) operations grouped
+// per operation type and column set, history rows of reversible upserts come first followed
+// by the data rows. The history of reversible inserts is recorded by flushInserts.
+func (d duckdbDialect) insertStatements(schema string, operations []*Operation) ([]*statement, error) {
+	groups, err := groupInserts(operations, d.normalizeValueType)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []*statement
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		group := pair.Value
+		prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", group.table.identifier, strings.Join(group.columns, ","))
+
+		switch group.opType {
+		case OperationTypeInsert:
+			statements = append(statements, positionalMultiRowInsert(prefix, "", len(group.columns), group.rows, duckdbMaxBindParameters, 0)...)
+
+		case OperationTypeUpsert:
+			for _, o := range group.reversible {
+				statements = append(statements, d.saveUpsert(schema, o.table, o.primaryKey, *o.reversibleBlockNum))
+			}
+
+			statements = append(statements, positionalMultiRowInsert(prefix, " "+onConflictClause(group.table, group.columns), len(group.columns), group.rows, duckdbMaxBindParameters, 0)...)
+
+		default:
+			panic(fmt.Errorf("unexpected operation type %q in insert group", group.opType))
+		}
+	}
+
+	return statements, nil
+}
+
+// prepareStatement returns the statement(s) required to apply an update or delete operation,
+// when the operation is reversible, the history statement is returned first and must be executed
+// before the actual operation statement.
+func (d duckdbDialect) prepareStatement(schema string, o *Operation) ([]*statement, error) {
+	// A table without a primary key set yield a `primaryKey` map with a single entry where the key is an empty string
+	if _, found := o.primaryKey[""]; found {
+		return nil, fmt.Errorf("trying to perform %s operation but table %q don't have a primary key set, this is not accepted", o.opType, o.table.name)
+	}
+
+	switch o.opType {
+	case OperationTypeUpdate:
+		columns, values, err := prepareColValues(o.table, o.data, d.normalizeValueType)
+		if err != nil {
+			return nil, fmt.Errorf("preparing column & values: %w", err)
+		}
+
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = column + "=?"
+		}
+
+		primaryKeySelector, primaryKeyArgs := positionalPrimaryKeyWhereClause(o.primaryKey, EscapeIdentifier)
+		updateQuery := newStatement(fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+			o.table.identifier,
+			strings.Join(updates, ", "),
+			primaryKeySelector,
+		), append(values, primaryKeyArgs...)...)
+
+		if o.reversibleBlockNum != nil {
+			return []*statement{d.saveRow("U", schema, o.table, o.primaryKey, *o.reversibleBlockNum), updateQuery}, nil
+		}
+		return []*statement{updateQuery}, nil
+
+	case OperationTypeDelete:
+		primaryKeySelector, primaryKeyArgs := positionalPrimaryKeyWhereClause(o.primaryKey, EscapeIdentifier)
+		deleteQuery := newStatement(fmt.Sprintf("DELETE FROM %s WHERE %s",
+			o.table.identifier,
+			primaryKeySelector,
+		), primaryKeyArgs...)
+
+		if o.reversibleBlockNum != nil {
+			return []*statement{d.saveRow("D", schema, o.table, o.primaryKey, *o.reversibleBlockNum), deleteQuery}, nil
+		}
+		return []*statement{deleteQuery}, nil
+
+	default:
+		panic(fmt.Errorf("unexpected operation type %q", o.opType))
+	}
+}
+
+func (d duckdbDialect) saveRow(op, schema string, table *TableInfo, primaryKey map[string]string, blockNum uint64) *statement {
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(primaryKey, EscapeIdentifier)
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT ?,?,?,%s,? FROM %s WHERE %s;`,
+		d.historyTable(schema),
+		d.rowToJSON(table),
+		table.identifier,
+		whereClause,
+	), append([]any{op, table.identifier, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
+}
+
+// saveUpsert records the history of an upsert, since it's only known by the database if the
+// row exists, the recorded operation is an insert ('I') when the row does not exist yet and
+// an update ('U') holding the previous value otherwise.
+func (d duckdbDialect) saveUpsert(schema string, table *TableInfo, primaryKey map[string]string, blockNum uint64) *statement {
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(primaryKey, EscapeIdentifier)
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT CASE WHEN prev IS NULL THEN 'I' ELSE 'U' END,?,?,prev,? FROM (SELECT (SELECT %s FROM %s WHERE %s) AS prev);`,
+		d.historyTable(schema),
+		d.rowToJSON(table),
+		table.identifier,
+		whereClause,
+	), append([]any{table.identifier, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
+}
+
+// rowToJSON returns the `json_object(...)` expression holding all the columns of the table,
+// the DuckDB equivalent of Postgres `row_to_json`.
+func (d duckdbDialect) rowToJSON(table *TableInfo) string {
+	columns := maps.Keys(table.columnsByName)
+	sort.Strings(columns)
+
+	pairs := make([]string, len(columns))
+	for i, column := range columns {
+		pairs[i] = escapeStringValue(column) + "," + table.columnsByName[column].escapedName
+	}
+
+	return "json_object(" + strings.Join(pairs, ",") + ")"
+}
+
+func (d duckdbDialect) pruneReversibleSegment(tx Tx, ctx context.Context, schema string, highestFinalBlock uint64) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE block_num <= %d;`, d.historyTable(schema), highestFinalBlock)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("executing prune query %q: %w", query, err)
+	}
+	return nil
+}
+
+// Format based on type, value returned is meant to be used as a bind parameter. DuckDB casts
+// textual values to the column's type, except for timestamps given as unix seconds.
+func (d duckdbDialect) normalizeValueType(value string, valueType reflect.Type) (any, error) {
+	switch valueType.Kind() {
+	case reflect.Struct:
+		if valueType == reflectTypeTime {
+			if integerRegex.MatchString(value) {
+				i, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return "", fmt.Errorf("could not convert %s to int: %w", value, err)
+				}
+
+				return time.Unix(i, 0).UTC(), nil
+			}
+		}
+
+		return value, nil
+
+	default:
+		return value, nil
+	}
+}
+
+func (d duckdbDialect) GetCreateCursorQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id         text not null primary key,
+			cursor     text,
+			block_num  bigint,
+			block_id   text
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(CURSORS_TABLE))
+}
+
+func (d duckdbDialect) GetCreateHistoryQuery(schema string, withPostgraphile bool) string {
+	sequence := fmt.Sprintf("%s.%s", EscapeIdentifier(schema), EscapeIdentifier(HISTORY_TABLE+"_id_seq"))
+
+	return fmt.Sprintf(cli.Dedent(`
+		create sequence if not exists %s;
+		create table if not exists %s
+		(
+			id           bigint primary key default nextval(%s),
+			op           char,
+			table_name   text,
+			pk           text,
+			prev_value   text,
+			block_num    bigint
+		);
+		`), sequence, d.historyTable(schema), escapeStringValue(sequence))
+}
+
+func (d duckdbDialect) GetCreateCompletionsQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id           text not null primary key,
+			block_num    bigint,
+			block_id     text,
+			completed_at timestamp default current_timestamp
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(COMPLETIONS_TABLE))
+}
+
+func (d duckdbDialect) createReorgsQuery(schema string, withPostgraphile bool) string {
+	sequence := fmt.Sprintf("%s.%s", EscapeIdentifier(schema), EscapeIdentifier(REORGS_TABLE+"_id_seq"))
+
+	return fmt.Sprintf(cli.Dedent(`
+		create sequence if not exists %s;
+		create table if not exists %s.%s
+		(
+			id               bigint primary key default nextval(%s),
+			module_hash      text,
+			last_valid_block bigint,
+			cursor_before    text,
+			cursor_after     text,
+			reverted_rows    text,
+			duration_ms      bigint,
+			reverted_at      timestamp default current_timestamp
+		);
+		`), sequence, EscapeIdentifier(schema), EscapeIdentifier(REORGS_TABLE), escapeStringValue(sequence))
+}
+
+func (d duckdbDialect) ExecuteSetupScript(ctx context.Context, l *Loader, schemaSql string) error {
+	if _, err := l.ExecContext(ctx, schemaSql); err != nil {
+		return fmt.Errorf("exec schema: %w", err)
+	}
+	return nil
+}
+
+func (d duckdbDialect) GetUpdateCursorQuery(table, moduleHash string, cursor *sink.Cursor, block_num uint64, block_id string) string {
+	return query(`
+		UPDATE %s set cursor = '%s', block_num = %d, block_id = '%s' WHERE id = '%s';
+	`, table, cursor, block_num, block_id, moduleHash)
+}
+
+func (d duckdbDialect) GetMarkCompletedQuery(table, moduleHash string, block_num uint64, block_id string) string {
+	return query(`
+		INSERT INTO %s (id, block_num, block_id, completed_at) VALUES ('%s', %d, '%s', current_timestamp)
+		ON CONFLICT (id) DO UPDATE SET block_num = EXCLUDED.block_num, block_id = EXCLUDED.block_id, completed_at = EXCLUDED.completed_at;
+	`, table, moduleHash, block_num, block_id)
+}
+
+func (d duckdbDialect) DriverSupportRowsAffected() bool {
+	return true
+}
+
+func (d duckdbDialect) EscapeIdentifier(valueToEscape string) string {
+	return EscapeIdentifier(valueToEscape)
+}
+
+func (d duckdbDialect) OnlyInserts() bool {
+	return false
+}
+
+func (d duckdbDialect) CreateUser(tx Tx, ctx context.Context, l *Loader, username string, password string, database string, readOnly bool) error {
+	return fmt.Errorf("duckdb does not support users, access is controlled by the database file permissions")
+}
+
+func (d duckdbDialect) historyTable(schema string) string {
+	return fmt.Sprintf("%s.%s", EscapeIdentifier(schema), EscapeIdentifier(HISTORY_TABLE))
+}
@@ -0,0 +1,90 @@
+//go:build duckdb
+
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const duckdbTestSchema = `
+	create table xfer (id text primary key, "from" text, amount integer);
+	create table balance (owner text, token text, amount integer, frozen boolean, primary key (owner, token));
+`
+
+func newDuckDBTestLoader(t *testing.T) *Loader {
+	t.Helper()
+
+	ctx := context.Background()
+	l, err := NewLoader("duckdb://"+filepath.Join(t.TempDir(), "test.duckdb"), OnModuleHashMismatchIgnore, nil, zlog, tracer)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	require.NoError(t, l.Setup(ctx, duckdbTestSchema, false))
+	require.NoError(t, l.LoadTables())
+	require.NoError(t, l.InsertCursor(ctx, "abc", sink.NewBlankCursor()))
+
+	return l
+}
+
+func TestDuckDBFlushAndRevert(t *testing.T) {
+	ctx := context.Background()
+	l := newDuckDBTestLoader(t)
+	blockNum := func(num uint64) *uint64 { return &num }
+
+	flush := func(lastFinalBlock uint64) {
+		t.Helper()
+		_, err := l.Flush(ctx, "abc", sink.NewBlankCursor(), lastFinalBlock)
+		require.NoError(t, err)
+	}
+
+	// Irreversible block, not recorded in history
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "0"}, map[string]string{"from": "genesis", "amount": "1"}, nil))
+	flush(5)
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a", "amount": "10"}, blockNum(10)))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"from": "b", "amount": "20"}, blockNum(10)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "alice", "token": "eth"}, map[string]string{"amount": "100", "frozen": "false"}, blockNum(10)))
+	flush(5)
+
+	require.NoError(t, l.Update("xfer", map[string]string{"id": "1"}, map[string]string{"from": "c"}, blockNum(11)))
+	require.NoError(t, l.Delete("xfer", map[string]string{"id": "2"}, blockNum(11)))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "3"}, map[string]string{"from": "d", "amount": "30"}, blockNum(11)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "alice", "token": "eth"}, map[string]string{"amount": "150", "frozen": "true"}, blockNum(11)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "bob", "token": "eth"}, map[string]string{"amount": "5", "frozen": "false"}, blockNum(11)))
+	flush(5)
+
+	assert.Equal(t, []string{
+		"0|genesis|1",
+		"1|c|10",
+		"3|d|30",
+	}, sqliteRows(t, l, `SELECT id, "from", amount FROM xfer ORDER BY id`))
+	assert.Equal(t, []string{
+		"alice|eth|150|true",
+		"bob|eth|5|false",
+	}, sqliteRows(t, l, `SELECT owner, token, amount, frozen FROM balance ORDER BY owner`))
+
+	require.NoError(t, l.Revert(ctx, "abc", sink.NewBlankCursor(), 10))
+
+	assert.Equal(t, []string{
+		"0|genesis|1",
+		"1|a|10",
+		"2|b|20",
+	}, sqliteRows(t, l, `SELECT id, "from", amount FROM xfer ORDER BY id`))
+	assert.Equal(t, []string{
+		"alice|eth|100|false",
+	}, sqliteRows(t, l, `SELECT owner, token, amount, frozen FROM balance ORDER BY owner`))
+
+	require.NoError(t, l.Revert(ctx, "abc", sink.NewBlankCursor(), 5))
+
+	assert.Equal(t, []string{
+		"0|genesis|1",
+	}, sqliteRows(t, l, `SELECT id, "from", amount FROM xfer ORDER BY id`))
+	assert.Empty(t, sqliteRows(t, l, `SELECT owner FROM balance`))
+	assert.Empty(t, sqliteRows(t, l, `SELECT op FROM substreams_history`))
+}
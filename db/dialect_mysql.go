@@ -0,0 +1,510 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/streamingfast/cli"
+	sink "github.com/streamingfast/substreams-sink"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+)
+
+// mysqlMaxBindParameters is the maximum amount of bind parameters accepted by MySQL
+// in a single prepared statement.
+const mysqlMaxBindParameters = 65535
+
+// mysqlMaxInsertBytes is the approximate maximum size of the bind parameters sent in a single
+// multi-row INSERT, kept under the default `max_allowed_packet` of MySQL 5.7 (4 MiB) since a
+// statement is sent in a single packet.
+const mysqlMaxInsertBytes = 3 * 1024 * 1024
+
+// mysqlDialect handles MySQL and MariaDB databases, identifiers are escaped with backticks and
+// the schema is the database. Reorgs are supported by recording the previous value of rows with
+// `JSON_OBJECT` in the history table, BLOB columns cannot be represented in JSON and are thus
+// not supported in reversible segments.
+type mysqlDialect struct{}
+
+// Revert undoes the operations recorded in the history one by one, see revertFromHistory.
+func (d mysqlDialect) Revert(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64) error {
+	return revertFromHistory(tx, ctx, l, lastValidFinalBlock,
+		fmt.Sprintf("SELECT op,table_name,pk,prev_value,block_num FROM %s WHERE block_num > %d ORDER BY block_num DESC, id DESC", d.historyTable(l.schema), lastValidFinalBlock),
+		fmt.Sprintf("DELETE FROM %s WHERE block_num > %d;", d.historyTable(l.schema), lastValidFinalBlock),
+		d.revertOp,
+	)
+}
+
+// revertOp restores the row as it was before the operation, `prev_value` holds the row's
+// columns as a JSON object, each column is extracted from it, see jsonValue.
+func (d mysqlDialect) revertOp(tx Tx, ctx context.Context, op, escaped_table_name, pk, prev_value string) error {
+	pkmap := make(map[string]string)
+	if err := json.Unmarshal([]byte(pk), &pkmap); err != nil {
+		return fmt.Errorf("revertOp: unmarshalling %q: %w", pk, err)
+	}
+
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(pkmap, d.EscapeIdentifier)
+
+	var stmt *statement
+	switch op {
+	case "I":
+		stmt = newStatement(fmt.Sprintf("DELETE FROM %s WHERE %s;",
+			escaped_table_name,
+			whereClause,
+		), whereArgs...)
+
+	case "D":
+		columns, err := jsonObjectKeys(prev_value)
+		if err != nil {
+			return err
+		}
+
+		escapedColumns := make([]string, len(columns))
+		values := make([]string, len(columns))
+		var args []any
+		for i, column := range columns {
+			escapedColumns[i] = d.EscapeIdentifier(column)
+			values[i] = d.jsonValue(column)
+			args = append(args, prev_value, prev_value)
+		}
+
+		stmt = newStatement(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);",
+			escaped_table_name,
+			strings.Join(escapedColumns, ","),
+			strings.Join(values, ","),
+		), args...)
+
+	case "U":
+		columns, err := jsonObjectKeys(prev_value)
+		if err != nil {
+			return err
+		}
+
+		updates := make([]string, len(columns))
+		var args []any
+		for i, column := range columns {
+			updates[i] = d.EscapeIdentifier(column) + "=" + d.jsonValue(column)
+			args = append(args, prev_value, prev_value)
+		}
+
+		stmt = newStatement(fmt.Sprintf("UPDATE %s SET %s WHERE %s;",
+			escaped_table_name,
+			strings.Join(updates, ", "),
+			whereClause,
+		), append(args, whereArgs...)...)
+
+	default:
+		panic("invalid op in revert command")
+	}
+
+	if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+		return fmt.Errorf("executing revert query %q: %w", stmt.query, err)
+	}
+	return nil
+}
+
+// jsonValue returns the expression extracting `column` from a JSON object, the object being bound
+// twice. `JSON_UNQUOTE` alone would turn a JSON null into the 'null' string, it's thus checked first.
+func (d mysqlDialect) jsonValue(column string) string {
+	path := d.escapeStringValue(`$."` + jsonPathKeyEscaper.Replace(column) + `"`)
+
+	return fmt.Sprintf("CASE JSON_TYPE(JSON_EXTRACT(?,%s)) WHEN 'NULL' THEN NULL ELSE JSON_UNQUOTE(JSON_EXTRACT(?,%s)) END", path, path)
+}
+
+func (d mysqlDialect) Flush(tx Tx, ctx context.Context, l *Loader, entries *PendingOperations, outputModuleHash string, lastFinalBlock uint64) (int, error) {
+	rowCount, err := l.flushByGeneration(entries, func(tableName string, operations []*Operation) error {
+		if err := d.flushOperations(ctx, tx, l, operations); err != nil {
+			return fmt.Errorf("flushing table %q: %w", tableName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.pruneReversibleSegment(tx, ctx, l.schema, lastFinalBlock); err != nil {
+		return 0, err
+	}
+
+	return rowCount, nil
+}
+
+// flushOperations applies operations of a single table, each for a different row.
+func (d mysqlDialect) flushOperations(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	var statements []*statement
+	var inserts []*Operation
+	for _, operation := range operations {
+		if operation.opType == OperationTypeInsert || operation.opType == OperationTypeUpsert {
+			inserts = append(inserts, operation)
+			continue
+		}
+
+		operationStatements, err := d.prepareStatement(l.schema, operation)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		statements = append(statements, operationStatements...)
+	}
+
+	if len(inserts) > 0 {
+		insertStatements, err := d.insertStatements(l.schema, inserts)
+		if err != nil {
+			return fmt.Errorf("preparing inserts: %w", err)
+		}
+		statements = append(statements, insertStatements...)
+	}
+
+	for _, stmt := range statements {
+		if l.tracer.Enabled() {
+			l.logger.Debug("adding query to transaction", zap.String("query", stmt.query), zap.Int("arg_count", len(stmt.args)))
+		}
+
+		if _, err := l.statements.exec(ctx, tx, stmt); err != nil {
+			return fmt.Errorf("executing query %q: %w", stmt.query, err)
+		}
+	}
+
+	return nil
+}
+
+// insertStatements returns the statements to apply the insert (or upsert) operations grouped
+// per operation type and column set, history rows come first followed by the data rows.
+func (d mysqlDialect) insertStatements(schema string, operations []*Operation) ([]*statement, error) {
+	groups, err := groupInserts(operations, d.normalizeValueType)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []*statement
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		group := pair.Value
+		prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", group.table.identifier, strings.Join(group.columns, ","))
+
+		switch group.opType {
+		case OperationTypeInsert:
+			if len(group.reversible) > 0 {
+				history := make([][]any, len(group.reversible))
+				for i, o := range group.reversible {
+					history[i] = []any{"I", o.table.identifier, primaryKeyToJSON(o.primaryKey), *o.reversibleBlockNum}
+				}
+
+				statements = append(statements, positionalMultiRowInsert(
+					fmt.Sprintf("INSERT INTO %s (op,table_name,pk,block_num) VALUES ", d.historyTable(schema)),
+					"",
+					4,
+					history,
+					mysqlMaxBindParameters,
+					mysqlMaxInsertBytes,
+				)...)
+			}
+
+			statements = append(statements, positionalMultiRowInsert(prefix, "", len(group.columns), group.rows, mysqlMaxBindParameters, mysqlMaxInsertBytes)...)
+
+		case OperationTypeUpsert:
+			for _, o := range group.reversible {
+				statements = append(statements, d.saveUpsert(schema, o.table, o.primaryKey, *o.reversibleBlockNum))
+			}
+
+			statements = append(statements, positionalMultiRowInsert(prefix, " "+d.onDuplicateKeyClause(group.table, group.columns), len(group.columns), group.rows, mysqlMaxBindParameters, mysqlMaxInsertBytes)...)
+
+		default:
+			panic(fmt.Errorf("unexpected operation type %q in insert group", group.opType))
+		}
+	}
+
+	return statements, nil
+}
+
+// onDuplicateKeyClause returns the `ON DUPLICATE KEY UPDATE` clause turning an INSERT into an
+// upsert, the non primary key columns are updated with the incoming values. `VALUES(<column>)`
+// is used over the newer row alias syntax which is not supported by MariaDB.
+func (d mysqlDialect) onDuplicateKeyClause(table *TableInfo, escapedColumns []string) string {
+	isPrimary := make(map[string]bool, len(table.primaryColumns))
+	for _, column := range table.primaryColumns {
+		isPrimary[column.escapedName] = true
+	}
+
+	var updates []string
+	for _, column := range escapedColumns {
+		if !isPrimary[column] {
+			updates = append(updates, column+"=VALUES("+column+")")
+		}
+	}
+
+	if len(updates) == 0 {
+		// Updating a primary key column to itself is a no-op, the equivalent of `DO NOTHING`
+		column := table.primaryColumns[0].escapedName
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s=%s", column, column)
+	}
+
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+// prepareStatement returns the statement(s) required to apply an update or delete operation,
+// when the operation is reversible, the history statement is returned first and must be executed
+// before the actual operation statement.
+func (d mysqlDialect) prepareStatement(schema string, o *Operation) ([]*statement, error) {
+	// A table without a primary key set yield a `primaryKey` map with a single entry where the key is an empty string
+	if _, found := o.primaryKey[""]; found {
+		return nil, fmt.Errorf("trying to perform %s operation but table %q don't have a primary key set, this is not accepted", o.opType, o.table.name)
+	}
+
+	primaryKeySelector, primaryKeyArgs := positionalPrimaryKeyWhereClause(o.primaryKey, d.EscapeIdentifier)
+
+	switch o.opType {
+	case OperationTypeUpdate:
+		columns, values, err := prepareColValues(o.table, o.data, d.normalizeValueType)
+		if err != nil {
+			return nil, fmt.Errorf("preparing column & values: %w", err)
+		}
+
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = column + "=?"
+		}
+
+		updateQuery := newStatement(fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+			o.table.identifier,
+			strings.Join(updates, ", "),
+			primaryKeySelector,
+		), append(values, primaryKeyArgs...)...)
+
+		if o.reversibleBlockNum != nil {
+			return []*statement{d.saveRow("U", schema, o.table, o.primaryKey, *o.reversibleBlockNum), updateQuery}, nil
+		}
+		return []*statement{updateQuery}, nil
+
+	case OperationTypeDelete:
+		deleteQuery := newStatement(fmt.Sprintf("DELETE FROM %s WHERE %s",
+			o.table.identifier,
+			primaryKeySelector,
+		), primaryKeyArgs...)
+
+		if o.reversibleBlockNum != nil {
+			return []*statement{d.saveRow("D", schema, o.table, o.primaryKey, *o.reversibleBlockNum), deleteQuery}, nil
+		}
+		return []*statement{deleteQuery}, nil
+
+	default:
+		panic(fmt.Errorf("unexpected operation type %q", o.opType))
+	}
+}
+
+func (d mysqlDialect) saveRow(op, schema string, table *TableInfo, primaryKey map[string]string, blockNum uint64) *statement {
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(primaryKey, d.EscapeIdentifier)
+
+	return newStatement(fmt.Sprintf("INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT ?,?,?,%s,? FROM %s WHERE %s;",
+		d.historyTable(schema),
+		d.rowToJSON(table),
+		table.identifier,
+		whereClause,
+	), append([]any{op, table.identifier, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
+}
+
+// saveUpsert records the history of an upsert, since it's only known by the database if the
+// row exists, the recorded operation is an insert ('I') when the row does not exist yet and
+// an update ('U') holding the previous value otherwise.
+func (d mysqlDialect) saveUpsert(schema string, table *TableInfo, primaryKey map[string]string, blockNum uint64) *statement {
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(primaryKey, d.EscapeIdentifier)
+
+	return newStatement(fmt.Sprintf("INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT CASE WHEN prev IS NULL THEN 'I' ELSE 'U' END,?,?,prev,? FROM (SELECT (SELECT %s FROM %s WHERE %s) AS prev) AS existing;",
+		d.historyTable(schema),
+		d.rowToJSON(table),
+		table.identifier,
+		whereClause,
+	), append([]any{table.identifier, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
+}
+
+// rowToJSON returns the `JSON_OBJECT(...)` expression holding all the columns of the table,
+// the MySQL equivalent of Postgres `row_to_json`.
+func (d mysqlDialect) rowToJSON(table *TableInfo) string {
+	columns := maps.Keys(table.columnsByName)
+	sort.Strings(columns)
+
+	pairs := make([]string, len(columns))
+	for i, column := range columns {
+		pairs[i] = d.escapeStringValue(column) + "," + table.columnsByName[column].escapedName
+	}
+
+	return "JSON_OBJECT(" + strings.Join(pairs, ",") + ")"
+}
+
+func (d mysqlDialect) pruneReversibleSegment(tx Tx, ctx context.Context, schema string, highestFinalBlock uint64) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE block_num <= %d;", d.historyTable(schema), highestFinalBlock)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("executing prune query %q: %w", query, err)
+	}
+	return nil
+}
+
+// Format based on type, value returned is meant to be used as a bind parameter. MySQL converts
+// textual values to the column's type, except booleans (stored as integers) and timestamps which
+// must not have a time zone suffix.
+func (d mysqlDialect) normalizeValueType(value string, valueType reflect.Type) (any, error) {
+	switch valueType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch value {
+		case "true":
+			return 1, nil
+		case "false":
+			return 0, nil
+		}
+
+		return value, nil
+
+	case reflect.Struct:
+		if valueType == reflectTypeTime {
+			if integerRegex.MatchString(value) {
+				i, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return "", fmt.Errorf("could not convert %s to int: %w", value, err)
+				}
+
+				return time.Unix(i, 0).UTC(), nil
+			}
+
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				return t.UTC(), nil
+			}
+
+			return value, nil
+		}
+
+		return "", fmt.Errorf("unsupported struct type %s", valueType)
+
+	default:
+		return value, nil
+	}
+}
+
+func (d mysqlDialect) GetCreateCursorQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id         varchar(255) not null primary key,
+			%s   text,
+			block_num  bigint,
+			block_id   varchar(255)
+		);
+		`), d.EscapeIdentifier(schema), d.EscapeIdentifier(CURSORS_TABLE), d.EscapeIdentifier("cursor"))
+}
+
+func (d mysqlDialect) GetCreateHistoryQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s
+		(
+			id           bigint auto_increment primary key,
+			op           char(1),
+			table_name   text,
+			pk           text,
+			prev_value   json,
+			block_num    bigint
+		);
+		`), d.historyTable(schema))
+}
+
+func (d mysqlDialect) GetCreateCompletionsQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id           varchar(255) not null primary key,
+			block_num    bigint,
+			block_id     varchar(255),
+			completed_at timestamp default current_timestamp
+		);
+		`), d.EscapeIdentifier(schema), d.EscapeIdentifier(COMPLETIONS_TABLE))
+}
+
+func (d mysqlDialect) createReorgsQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id               bigint auto_increment primary key,
+			module_hash      varchar(255),
+			last_valid_block bigint,
+			cursor_before    text,
+			cursor_after     text,
+			reverted_rows    json,
+			duration_ms      bigint,
+			reverted_at      timestamp default current_timestamp
+		);
+		`), d.EscapeIdentifier(schema), d.EscapeIdentifier(REORGS_TABLE))
+}
+
+func (d mysqlDialect) ExecuteSetupScript(ctx context.Context, l *Loader, schemaSql string) error {
+	if _, err := l.ExecContext(ctx, schemaSql); err != nil {
+		return fmt.Errorf("exec schema: %w", err)
+	}
+	return nil
+}
+
+func (d mysqlDialect) GetUpdateCursorQuery(table, moduleHash string, cursor *sink.Cursor, block_num uint64, block_id string) string {
+	return query(`
+		UPDATE %s set %s = '%s', block_num = %d, block_id = '%s' WHERE id = '%s';
+	`, table, d.EscapeIdentifier("cursor"), cursor, block_num, block_id, moduleHash)
+}
+
+func (d mysqlDialect) GetMarkCompletedQuery(table, moduleHash string, block_num uint64, block_id string) string {
+	return query(`
+		INSERT INTO %s (id, block_num, block_id, completed_at) VALUES ('%s', %d, '%s', current_timestamp)
+		ON DUPLICATE KEY UPDATE block_num = VALUES(block_num), block_id = VALUES(block_id), completed_at = VALUES(completed_at);
+	`, table, moduleHash, block_num, block_id)
+}
+
+func (d mysqlDialect) DriverSupportRowsAffected() bool {
+	return true
+}
+
+func (d mysqlDialect) EscapeIdentifier(valueToEscape string) string {
+	if strings.Contains(valueToEscape, "`") {
+		valueToEscape = strings.ReplaceAll(valueToEscape, "`", "``")
+	}
+
+	return "`" + valueToEscape + "`"
+}
+
+// escapeStringValue quotes `value` as a string literal. MySQL treats backslashes in literals as
+// escape characters (unless the `NO_BACKSLASH_ESCAPES` SQL mode is set), they are escaped too.
+func (d mysqlDialect) escapeStringValue(value string) string {
+	return escapeStringValue(strings.ReplaceAll(value, `\`, `\\`))
+}
+
+// jsonPathKeyEscaper escapes a key quoted in a JSON path, e.g. `$."<key>"`.
+var jsonPathKeyEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func (d mysqlDialect) OnlyInserts() bool {
+	return false
+}
+
+func (d mysqlDialect) CreateUser(tx Tx, ctx context.Context, l *Loader, username string, password string, database string, readOnly bool) error {
+	user, db := d.escapeStringValue(username)+"@'%'", d.EscapeIdentifier(database)
+
+	privileges := "ALL PRIVILEGES"
+	if readOnly {
+		privileges = "SELECT"
+	}
+
+	// Executed one by one, the `multiStatements` option may have been disabled in the DSN
+	for _, q := range []string{
+		fmt.Sprintf("CREATE USER %s IDENTIFIED BY %s;", user, d.escapeStringValue(password)),
+		fmt.Sprintf("GRANT %s ON %s.* TO %s;", privileges, db, user),
+	} {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("executing query %q: %w", q, err)
+		}
+	}
+
+	return nil
+}
+
+func (d mysqlDialect) historyTable(schema string) string {
+	return fmt.Sprintf("%s.%s", d.EscapeIdentifier(schema), d.EscapeIdentifier(HISTORY_TABLE))
+}
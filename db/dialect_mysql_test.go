@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMySQLTestTable(t *testing.T, name string, pkList []string, columnsTypes map[string]any) *TableInfo {
+	t.Helper()
+
+	d := mysqlDialect{}
+	columns := make(map[string]*ColumnInfo, len(columnsTypes))
+	for column, scanType := range columnsTypes {
+		columns[column] = &ColumnInfo{name: column, escapedName: d.EscapeIdentifier(column), scanType: reflect.TypeOf(scanType)}
+	}
+
+	table, err := newTableInfo("testdb", name, pkList, columns, d.EscapeIdentifier)
+	require.NoError(t, err)
+
+	return table
+}
+
+func TestMySQLPrepareStatement(t *testing.T) {
+	blockNum := uint64(10)
+	table := newMySQLTestTable(t, "xfer", []string{"id", "idx"}, map[string]any{"id": "", "idx": int64(0), "from": "", "to": ""})
+	primaryKey := map[string]string{"id": "1234", "idx": "3"}
+
+	tests := []struct {
+		name   string
+		op     *Operation
+		expect []string
+	}{
+		{
+			name: "update",
+			op:   &Operation{table: table, opType: OperationTypeUpdate, primaryKey: primaryKey, data: map[string]string{"from": "a"}},
+			expect: []string{
+				"UPDATE `testdb`.`xfer` SET `from`=? WHERE `id` = ? AND `idx` = ? -- [a, 1234, 3]",
+			},
+		},
+		{
+			name: "reversible update",
+			op:   &Operation{table: table, opType: OperationTypeUpdate, primaryKey: primaryKey, data: map[string]string{"from": "a", "to": "b"}, reversibleBlockNum: &blockNum},
+			expect: []string{
+				"INSERT INTO `testdb`.`substreams_history` (op,table_name,pk,prev_value,block_num) SELECT ?,?,?,JSON_OBJECT('from',`from`,'id',`id`,'idx',`idx`,'to',`to`),? FROM `testdb`.`xfer` WHERE `id` = ? AND `idx` = ?; -- [U, `testdb`.`xfer`, {\"id\":\"1234\",\"idx\":\"3\"}, 10, 1234, 3]",
+				"UPDATE `testdb`.`xfer` SET `from`=?, `to`=? WHERE `id` = ? AND `idx` = ? -- [a, b, 1234, 3]",
+			},
+		},
+		{
+			name: "reversible delete",
+			op:   &Operation{table: table, opType: OperationTypeDelete, primaryKey: primaryKey, reversibleBlockNum: &blockNum},
+			expect: []string{
+				"INSERT INTO `testdb`.`substreams_history` (op,table_name,pk,prev_value,block_num) SELECT ?,?,?,JSON_OBJECT('from',`from`,'id',`id`,'idx',`idx`,'to',`to`),? FROM `testdb`.`xfer` WHERE `id` = ? AND `idx` = ?; -- [D, `testdb`.`xfer`, {\"id\":\"1234\",\"idx\":\"3\"}, 10, 1234, 3]",
+				"DELETE FROM `testdb`.`xfer` WHERE `id` = ? AND `idx` = ? -- [1234, 3]",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &TestTx{}
+
+			statements, err := mysqlDialect{}.prepareStatement("testdb", test.op)
+			require.NoError(t, err)
+
+			for _, stmt := range statements {
+				_, err := (*statementCache)(nil).exec(context.Background(), tx, stmt)
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, test.expect, tx.Results())
+		})
+	}
+}
+
+func TestMySQLInsertStatements(t *testing.T) {
+	blockNum := uint64(10)
+	table := newMySQLTestTable(t, "xfer", []string{"id"}, map[string]any{"id": "", "from": "", "to": ""})
+	onlyKeys := newMySQLTestTable(t, "owners", []string{"owner"}, map[string]any{"owner": ""})
+
+	insert := func(id, from string, reversible bool) *Operation {
+		o := &Operation{table: table, opType: OperationTypeInsert, primaryKey: map[string]string{"id": id}, data: map[string]string{"id": id, "from": from}}
+		if reversible {
+			o.reversibleBlockNum = &blockNum
+		}
+		return o
+	}
+
+	tests := []struct {
+		name       string
+		operations []*Operation
+		expect     []string
+	}{
+		{
+			name:       "inserts",
+			operations: []*Operation{insert("1", "a", false), insert("2", "b", false)},
+			expect: []string{
+				"INSERT INTO `testdb`.`xfer` (`from`,`id`) VALUES (?,?),(?,?); -- [a, 1, b, 2]",
+			},
+		},
+		{
+			name:       "reversible inserts",
+			operations: []*Operation{insert("1", "a", true), insert("2", "b", true)},
+			expect: []string{
+				"INSERT INTO `testdb`.`substreams_history` (op,table_name,pk,block_num) VALUES (?,?,?,?),(?,?,?,?); -- [I, `testdb`.`xfer`, {\"id\":\"1\"}, 10, I, `testdb`.`xfer`, {\"id\":\"2\"}, 10]",
+				"INSERT INTO `testdb`.`xfer` (`from`,`id`) VALUES (?,?),(?,?); -- [a, 1, b, 2]",
+			},
+		},
+		{
+			name: "reversible upsert",
+			operations: []*Operation{
+				{table: table, opType: OperationTypeUpsert, primaryKey: map[string]string{"id": "1"}, data: map[string]string{"id": "1", "to": "b"}, reversibleBlockNum: &blockNum},
+			},
+			expect: []string{
+				"INSERT INTO `testdb`.`substreams_history` (op,table_name,pk,prev_value,block_num) SELECT CASE WHEN prev IS NULL THEN 'I' ELSE 'U' END,?,?,prev,? FROM (SELECT (SELECT JSON_OBJECT('from',`from`,'id',`id`,'to',`to`) FROM `testdb`.`xfer` WHERE `id` = ?) AS prev) AS existing; -- [`testdb`.`xfer`, {\"id\":\"1\"}, 10, 1]",
+				"INSERT INTO `testdb`.`xfer` (`id`,`to`) VALUES (?,?) ON DUPLICATE KEY UPDATE `to`=VALUES(`to`); -- [1, b]",
+			},
+		},
+		{
+			name: "upsert of primary key only",
+			operations: []*Operation{
+				{table: onlyKeys, opType: OperationTypeUpsert, primaryKey: map[string]string{"owner": "a"}, data: map[string]string{"owner": "a"}},
+			},
+			expect: []string{
+				"INSERT INTO `testdb`.`owners` (`owner`) VALUES (?) ON DUPLICATE KEY UPDATE `owner`=`owner`; -- [a]",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &TestTx{}
+
+			statements, err := mysqlDialect{}.insertStatements("testdb", test.operations)
+			require.NoError(t, err)
+
+			for _, stmt := range statements {
+				_, err := (*statementCache)(nil).exec(context.Background(), tx, stmt)
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, test.expect, tx.Results())
+		})
+	}
+}
+
+func TestMySQLInsertChunking(t *testing.T) {
+	rows := make([][]any, 5)
+	for i := range rows {
+		rows[i] = []any{strings.Repeat("a", mysqlMaxInsertBytes/2)}
+	}
+
+	var chunks []int
+	for _, stmt := range positionalMultiRowInsert("INSERT INTO t VALUES ", "", 1, rows, mysqlMaxBindParameters, mysqlMaxInsertBytes) {
+		chunks = append(chunks, len(stmt.args))
+	}
+	assert.Equal(t, []int{2, 2, 1}, chunks, "statements stay under the packet size")
+}
+
+func TestMySQLRevertOp(t *testing.T) {
+	prevValue := `{"from":"a","id":"1"}`
+	value := "CASE JSON_TYPE(JSON_EXTRACT(?,'$.\"%[1]s\"')) WHEN 'NULL' THEN NULL ELSE JSON_UNQUOTE(JSON_EXTRACT(?,'$.\"%[1]s\"')) END"
+
+	tests := []struct {
+		name      string
+		op        string
+		prevValue string
+		expect    string
+	}{
+		{
+			name:   "insert",
+			op:     "I",
+			expect: "DELETE FROM `testdb`.`xfer` WHERE `id` = ?; -- [1]",
+		},
+		{
+			name:      "delete",
+			op:        "D",
+			prevValue: prevValue,
+			expect:    "INSERT INTO `testdb`.`xfer` (`from`,`id`) VALUES (" + fmt.Sprintf(value, "from") + "," + fmt.Sprintf(value, "id") + "); -- [" + prevValue + ", " + prevValue + ", " + prevValue + ", " + prevValue + "]",
+		},
+		{
+			name:      "update",
+			op:        "U",
+			prevValue: prevValue,
+			expect:    "UPDATE `testdb`.`xfer` SET `from`=" + fmt.Sprintf(value, "from") + ", `id`=" + fmt.Sprintf(value, "id") + " WHERE `id` = ?; -- [" + prevValue + ", " + prevValue + ", " + prevValue + ", " + prevValue + ", 1]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &TestTx{}
+
+			err := mysqlDialect{}.revertOp(tx, context.Background(), test.op, "`testdb`.`xfer`", `{"id":"1"}`, test.prevValue)
+			require.NoError(t, err)
+			assert.Equal(t, []string{test.expect}, tx.Results())
+		})
+	}
+}
+
+func TestMySQLNormalizeValueType(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		valueType any
+		expect    any
+	}{
+		{"string", "abc", "", "abc"},
+		{"integer", "12", int64(0), "12"},
+		{"boolean true", "true", int8(0), 1},
+		{"boolean false", "false", int8(0), 0},
+		{"time from unix seconds", "1700000000", time.Time{}, time.Unix(1700000000, 0).UTC()},
+		{"time from RFC3339", "2023-11-14T23:13:20+01:00", time.Time{}, time.Unix(1700000000, 0).UTC()},
+		{"time as is", "2023-11-14 22:13:20", time.Time{}, "2023-11-14 22:13:20"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := mysqlDialect{}.normalizeValueType(test.value, reflect.TypeOf(test.valueType))
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, value)
+		})
+	}
+}
+
+func TestMySQLEscapeIdentifier(t *testing.T) {
+	assert.Equal(t, "`from`", mysqlDialect{}.EscapeIdentifier("from"))
+	assert.Equal(t, "`we``ird`", mysqlDialect{}.EscapeIdentifier("we`ird"))
+}
+
+func TestMySQLEscapeStringValue(t *testing.T) {
+	d := mysqlDialect{}
+	assert.Equal(t, `'it''s'`, d.escapeStringValue(`it's`))
+	assert.Equal(t, `'secret\\'`, d.escapeStringValue(`secret\`), "a trailing backslash does not escape the closing quote")
+	assert.Equal(t, `'\\'' OR 1=1 -- '`, d.escapeStringValue(`\' OR 1=1 -- `))
+
+	assert.Equal(t,
+		`CASE JSON_TYPE(JSON_EXTRACT(?,'$."we\\"ird\\\\"')) WHEN 'NULL' THEN NULL ELSE JSON_UNQUOTE(JSON_EXTRACT(?,'$."we\\"ird\\\\"')) END`,
+		d.jsonValue(`we"ird\`),
+	)
+}
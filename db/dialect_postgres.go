@@ -3,7 +3,6 @@ package db
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"reflect"
 	"sort"
@@ -19,168 +18,361 @@ import (
 
 type postgresDialect struct{}
 
+// Revert undoes the operations of the blocks after `lastValidFinalBlock` with a few set-based
+// statements per table. Applying the history in reverse order leaves each row in the state preceding
+// its earliest reverted operation, which is what the statements restore directly, see revertQueries.
 func (d postgresDialect) Revert(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64) error {
-	query := fmt.Sprintf(`SELECT op,table_name,pk,prev_value,block_num FROM %s WHERE "block_num" > %d ORDER BY "block_num" DESC`,
+	l.logger.Info("reverting forked block block(s)", zap.Uint64("last_valid_final_block", lastValidFinalBlock))
+
+	if l.pendingTables {
+		if err := d.revertPending(ctx, tx, l, lastValidFinalBlock); err != nil {
+			return err
+		}
+	}
+
+	tables, err := d.revertedTables(ctx, tx, l, lastValidFinalBlock)
+	if err != nil {
+		return err
+	}
+
+	if err := d.revertTables(ctx, tx, l, tables, lastValidFinalBlock); err != nil {
+		return err
+	}
+
+	pruneHistory := fmt.Sprintf(`DELETE FROM %s WHERE "block_num" > %d;`,
 		d.historyTable(l.schema),
 		lastValidFinalBlock,
 	)
 
-	rows, err := tx.QueryContext(ctx, query)
+	_, err = tx.ExecContext(ctx, pruneHistory)
 	if err != nil {
-		return err
+		return fmt.Errorf("executing pruneHistory: %w", err)
 	}
+	return nil
+}
 
-	var reversions []func() error
-	l.logger.Info("reverting forked block block(s)", zap.Uint64("last_valid_final_block", lastValidFinalBlock))
-	if rows != nil { // rows will be nil with no error only in testing scenarios
-		defer rows.Close()
-		for rows.Next() {
-			var op string
-			var table_name string
-			var pk string
-			var prev_value_nullable sql.NullString
-			var block_num uint64
-			if err := rows.Scan(&op, &table_name, &pk, &prev_value_nullable, &block_num); err != nil {
-				return fmt.Errorf("scanning row: %w", err)
-			}
-			l.logger.Debug("reverting", zap.String("operation", op), zap.String("table_name", table_name), zap.String("pk", pk), zap.Uint64("block_num", block_num))
-			prev_value := prev_value_nullable.String
-
-			// we can't call revertOp inside this loop, because it calls tx.ExecContext,
-			// which can't run while this query is "active" or it will silently discard the remaining rows!
-			reversions = append(reversions, func() error {
-				if err := d.revertOp(tx, ctx, op, table_name, pk, prev_value, block_num); err != nil {
-					return fmt.Errorf("revertOp: %w", err)
-				}
-				return nil
-			})
+// revertTables reverts the rows of `tables` changed after `lastValidFinalBlock`, see revertQueries.
+// Inserted rows are deleted from the referencing tables first and changed rows are then restored
+// in the referenced tables first, so foreign keys hold after each statement.
+func (d postgresDialect) revertTables(ctx context.Context, tx Tx, l *Loader, tables []*TableInfo, lastValidFinalBlock uint64) error {
+	tables = sortByReferences(tables)
+	revertedRows := make([]int64, len(tables))
+	exec := func(i int, query string) error {
+		result, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("executing revert query %q: %w", query, err)
 		}
-		if err := rows.Err(); err != nil {
-			return fmt.Errorf("iterating on rows from query %q: %w", query, err)
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("rows affected: %w", err)
 		}
-		for _, reversion := range reversions {
-			if err := reversion(); err != nil {
-				return fmt.Errorf("execution revert operation: %w", err)
-			}
+		revertedRows[i] += rowsAffected
+		return nil
+	}
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		deleteInserted, _ := d.revertQueries(l.schema, tables[i], lastValidFinalBlock)
+		if err := exec(i, deleteInserted); err != nil {
+			return err
 		}
 	}
-	pruneHistory := fmt.Sprintf(`DELETE FROM %s WHERE "block_num" > %d;`,
+
+	for i, table := range tables {
+		_, restoreChanged := d.revertQueries(l.schema, table, lastValidFinalBlock)
+		if err := exec(i, restoreChanged); err != nil {
+			return err
+		}
+
+		l.recordRevertedRows(ctx, table.identifier, revertedRows[i])
+		l.logger.Debug("reverted table rows", zap.String("table", table.identifier), zap.Int64("row_count", revertedRows[i]))
+	}
+
+	return nil
+}
+
+// revertedTables returns the tables having history after `lastValidFinalBlock`, sorted by identifier.
+func (d postgresDialect) revertedTables(ctx context.Context, tx Tx, l *Loader, lastValidFinalBlock uint64) ([]*TableInfo, error) {
+	query := fmt.Sprintf(`SELECT DISTINCT table_name FROM %s WHERE "block_num" > %d ORDER BY table_name`,
 		d.historyTable(l.schema),
 		lastValidFinalBlock,
 	)
 
-	_, err = tx.ExecContext(ctx, pruneHistory)
+	rows, err := tx.QueryContext(ctx, query)
 	if err != nil {
-		return fmt.Errorf("executing pruneHistory: %w", err)
+		return nil, fmt.Errorf("executing query %q: %w", query, err)
 	}
-	return nil
+	if rows == nil { // rows will be nil with no error only in testing scenarios
+		return nil, nil
+	}
+	defer rows.Close()
+
+	var tables []*TableInfo
+	for rows.Next() {
+		var identifier string
+		if err := rows.Scan(&identifier); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		table := l.tableByIdentifier(identifier)
+		if table == nil {
+			return nil, fmt.Errorf("history references unknown table %s", identifier)
+		}
+		tables = append(tables, table)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating on rows from query %q: %w", query, err)
+	}
+	return tables, nil
+}
+
+// sortByReferences orders `tables` so that the tables referenced by the foreign keys of a table
+// precede it, the order of `tables` being otherwise kept. Tables referencing each other, directly
+// or not, cannot all precede the tables they reference: the cycle is broken at its first table.
+func sortByReferences(tables []*TableInfo) []*TableInfo {
+	byIdentifier := make(map[string]*TableInfo, len(tables))
+	for _, table := range tables {
+		byIdentifier[table.identifier] = table
+	}
+
+	out := make([]*TableInfo, 0, len(tables))
+	visited := make(map[*TableInfo]bool, len(tables))
+
+	var visit func(table *TableInfo)
+	visit = func(table *TableInfo) {
+		if visited[table] {
+			return
+		}
+		visited[table] = true
+
+		for _, reference := range table.references {
+			if referenced, found := byIdentifier[reference]; found {
+				visit(referenced)
+			}
+		}
+		out = append(out, table)
+	}
+
+	for _, table := range tables {
+		visit(table)
+	}
+	return out
 }
 
-func (d postgresDialect) Flush(tx Tx, ctx context.Context, l *Loader, outputModuleHash string, lastFinalBlock uint64) (int, error) {
-	var rowCount int
-	for entriesPair := l.entries.Oldest(); entriesPair != nil; entriesPair = entriesPair.Next() {
-		tableName := entriesPair.Key
-		entries := entriesPair.Value
+// inspectTable reads the partitioning of the table and the tables referenced by its foreign keys.
+func (d postgresDialect) inspectTable(db *sql.DB, table *TableInfo) error {
+	if err := d.inspectPartitioning(db, table); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT n.nspname, c.relname
+		FROM pg_constraint f
+		JOIN pg_class c ON c.oid = f.confrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE f.contype = 'f' AND f.conrelid = $1::regclass AND f.confrelid <> f.conrelid
+	`, table.identifier)
+	if err != nil {
+		return fmt.Errorf("listing foreign keys: %w", err)
+	}
+	defer rows.Close()
 
-		if l.tracer.Enabled() {
-			l.logger.Debug("flushing table rows", zap.String("table_name", tableName), zap.Int("row_count", entries.Len()))
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return fmt.Errorf("scanning foreign key: %w", err)
 		}
-		for entryPair := entries.Oldest(); entryPair != nil; entryPair = entryPair.Next() {
-			entry := entryPair.Value
+		table.references = append(table.references, EscapeIdentifier(schema)+"."+EscapeIdentifier(name))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("listing foreign keys: %w", err)
+	}
+
+	sort.Strings(table.references)
+	return nil
+}
 
-			query, err := d.prepareStatement(l.schema, entry)
-			if err != nil {
-				return 0, fmt.Errorf("failed to prepare statement: %w", err)
+// revertQueries returns the statements reverting the rows of `table` changed after `lastValidFinalBlock`.
+// Only the earliest reverted history entry of each row matters: rows first inserted are deleted, rows
+// first updated or deleted are restored to their previous value, updating the row if it exists (so
+// foreign keys referencing it are not cascaded) and inserting it otherwise. Rows are matched on all
+// the columns of the primary key, decoded from the history with `jsonb_populate_record`.
+func (d postgresDialect) revertQueries(schema string, table *TableInfo, lastValidFinalBlock uint64) (deleteInserted, restoreChanged string) {
+	reverted := fmt.Sprintf(`WITH reverted AS (SELECT DISTINCT ON (pk) op, pk, prev_value FROM %s WHERE table_name = %s AND "block_num" > %d ORDER BY pk, "block_num", id)`,
+		d.historyTable(schema),
+		escapeStringValue(table.identifier),
+		lastValidFinalBlock,
+	)
+
+	primaryColumns := make([]string, len(table.primaryColumns))
+	keyColumns := make([]string, len(table.primaryColumns))
+	for i, column := range table.primaryColumns {
+		primaryColumns[i] = column.escapedName
+		keyColumns[i] = "k." + column.escapedName
+	}
+
+	columns := make([]string, 0, len(table.columnsByName))
+	for _, column := range table.columnsByName {
+		columns = append(columns, column.escapedName)
+	}
+	sort.Strings(columns)
+
+	restoredColumns := make([]string, len(columns))
+	for i, column := range columns {
+		restoredColumns[i] = "r." + column
+	}
+
+	deleteInserted = fmt.Sprintf(`%s DELETE FROM %s WHERE (%s) IN (SELECT %s FROM reverted, jsonb_populate_record(null::%s, reverted.pk) k WHERE reverted.op = 'I');`,
+		reverted,
+		table.identifier,
+		strings.Join(primaryColumns, ","),
+		strings.Join(keyColumns, ","),
+		table.identifier,
+	)
+
+	restoreChanged = fmt.Sprintf(`%s INSERT INTO %s (%s) SELECT %s FROM reverted, jsonb_populate_record(null::%s, reverted.prev_value) r WHERE reverted.op IN ('U','D') %s;`,
+		reverted,
+		table.identifier,
+		strings.Join(columns, ","),
+		strings.Join(restoredColumns, ","),
+		table.identifier,
+		onConflictClause(table, columns),
+	)
+
+	return deleteInserted, restoreChanged
+}
+
+func (d postgresDialect) Flush(tx Tx, ctx context.Context, l *Loader, entries *PendingOperations, outputModuleHash string, lastFinalBlock uint64) (int, error) {
+	if blockRange, found := flushRangeFromContext(ctx); found {
+		// Without a committed cursor, the first flushed block is only known from the flushed rows
+		if !l.hasCommittedCursor() {
+			blockRange.start = blockRange.stop
+			if first, found := d.firstFlushedBlock(l, entries); found {
+				blockRange.start = min(first, blockRange.stop)
 			}
+		}
 
-			if l.tracer.Enabled() {
-				l.logger.Debug("adding query from operation to transaction", zap.Stringer("op", entry), zap.String("query", query))
+		if err := d.createPartitions(ctx, tx, l, blockRange); err != nil {
+			return 0, err
+		}
+	}
+
+	// Pending operations of the blocks now final precede the ones being flushed
+	var promotedCount int
+	if l.pendingTables {
+		var err error
+		if promotedCount, err = d.promotePending(ctx, tx, l, lastFinalBlock); err != nil {
+			return 0, err
+		}
+	}
+
+	rowCount, err := l.flushByGeneration(entries, func(tableName string, operations []*Operation) error {
+		operations, pending := d.splitPending(l, operations, lastFinalBlock)
+		if len(operations) > 0 {
+			if err := d.flushOperations(ctx, tx, l, operations); err != nil {
+				return fmt.Errorf("flushing table %q: %w", tableName, err)
 			}
+		}
 
-			if _, err := tx.ExecContext(ctx, query); err != nil {
-				return 0, fmt.Errorf("executing query %q: %w", query, err)
+		if len(pending) > 0 {
+			if err := d.flushPending(ctx, tx, l, pending); err != nil {
+				return fmt.Errorf("flushing pending table of %q: %w", tableName, err)
 			}
 		}
-		rowCount += entries.Len()
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	rowCount += promotedCount
 
-	if err := d.pruneReversibleSegment(tx, ctx, l.schema, lastFinalBlock); err != nil {
+	if l.shouldPruneHistory(lastFinalBlock) {
+		if err := d.pruneReversibleSegment(tx, ctx, l.schema, lastFinalBlock); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := d.detachPartitions(ctx, tx, l, lastFinalBlock); err != nil {
 		return 0, err
 	}
 
 	return rowCount, nil
 }
 
-func (d postgresDialect) revertOp(tx Tx, ctx context.Context, op, escaped_table_name, pk, prev_value string, block_num uint64) error {
+// flushOperations applies operations of a single table, each for a different row.
+func (d postgresDialect) flushOperations(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	if canCopy(tx, operations) {
+		if err := d.flushCopy(ctx, tx, l, operations); err != nil {
+			return fmt.Errorf("using copy: %w", err)
+		}
 
-	pkmap := make(map[string]string)
-	if err := json.Unmarshal([]byte(pk), &pkmap); err != nil {
-		return fmt.Errorf("revertOp: unmarshalling %q: %w", pk, err)
+		return nil
 	}
-	switch op {
-	case "I":
-		query := fmt.Sprintf(`DELETE FROM %s WHERE %s;`,
-			escaped_table_name,
-			getPrimaryKeyWhereClause(pkmap),
-		)
-		if _, err := tx.ExecContext(ctx, query); err != nil {
-			return fmt.Errorf("executing revert query %q: %w", query, err)
-		}
-	case "D":
-		query := fmt.Sprintf(`INSERT INTO %s SELECT * FROM json_populate_record(null::%s,%s);`,
-			escaped_table_name,
-			escaped_table_name,
-			escapeStringValue(prev_value),
-		)
-		if _, err := tx.ExecContext(ctx, query); err != nil {
-			return fmt.Errorf("executing revert query %q: %w", query, err)
+
+	var inserts []*Operation
+	for _, operation := range operations {
+		// Inserts and upserts are batched together in multi-row statements, each operation being
+		// for a different row, the ordering against updates and deletes of other rows does not matter.
+		if operation.opType == OperationTypeInsert || operation.opType == OperationTypeUpsert {
+			inserts = append(inserts, operation)
+			continue
 		}
 
-	case "U":
-		columns, err := sqlColumnNamesFromJSON(prev_value)
+		statements, err := d.prepareStatement(l.schema, operation)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to prepare statement: %w", err)
 		}
 
-		query := fmt.Sprintf(`UPDATE %s SET(%s)=((SELECT %s FROM json_populate_record(null::%s,%s))) WHERE %s;`,
-			escaped_table_name,
-			columns,
-			columns,
-			escaped_table_name,
-			escapeStringValue(prev_value),
-			getPrimaryKeyWhereClause(pkmap),
-		)
-		if _, err := tx.ExecContext(ctx, query); err != nil {
-			return fmt.Errorf("executing revert query %q: %w", query, err)
+		for _, stmt := range statements {
+			if l.tracer.Enabled() {
+				l.logger.Debug("adding query from operation to transaction", zap.Stringer("op", operation), zap.String("query", stmt.query))
+			}
+
+			if _, err := l.statements.exec(ctx, tx, stmt); err != nil {
+				return fmt.Errorf("executing query %q: %w", stmt.query, err)
+			}
 		}
-	default:
-		panic("invalid op in revert command")
 	}
-	return nil
-}
 
-func sqlColumnNamesFromJSON(in string) (string, error) {
-	valueMap := make(map[string]interface{})
-	if err := json.Unmarshal([]byte(in), &valueMap); err != nil {
-		return "", fmt.Errorf("unmarshalling %q into valueMap: %w", in, err)
-	}
-	escapedNames := make([]string, len(valueMap))
-	i := 0
-	for k := range valueMap {
-		escapedNames[i] = EscapeIdentifier(k)
-		i++
+	if len(inserts) > 0 {
+		if err := d.flushInserts(ctx, tx, l, inserts); err != nil {
+			return fmt.Errorf("flushing inserts: %w", err)
+		}
 	}
-	sort.Strings(escapedNames)
 
-	return strings.Join(escapedNames, ","), nil
+	return nil
 }
 
+// postgresHistoryPruneBatchSize is the maximum amount of history rows deleted by each statement
+// pruning the history.
+const postgresHistoryPruneBatchSize = 10_000
+
+// pruneReversibleSegment deletes the history of the blocks up to `highestFinalBlock` in batches of
+// postgresHistoryPruneBatchSize rows, found through the `block_num` index, so that a large backlog
+// of history is not deleted by a single statement.
 func (d postgresDialect) pruneReversibleSegment(tx Tx, ctx context.Context, schema string, highestFinalBlock uint64) error {
-	query := fmt.Sprintf(`DELETE FROM %s WHERE block_num <= %d;`, d.historyTable(schema), highestFinalBlock)
-	if _, err := tx.ExecContext(ctx, query); err != nil {
-		return fmt.Errorf("executing prune query %q: %w", query, err)
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id IN (SELECT id FROM %s WHERE block_num <= %d LIMIT %d);`,
+		d.historyTable(schema),
+		d.historyTable(schema),
+		highestFinalBlock,
+		postgresHistoryPruneBatchSize,
+	)
+
+	for {
+		result, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("executing prune query %q: %w", query, err)
+		}
+
+		prunedRows, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("rows affected: %w", err)
+		}
+		if prunedRows < postgresHistoryPruneBatchSize {
+			return nil
+		}
 	}
-	return nil
 }
 
 func (d postgresDialect) GetCreateCursorQuery(schema string, withPostgraphile bool) string {
@@ -204,15 +396,18 @@ func (d postgresDialect) GetCreateHistoryQuery(schema string, withPostgraphile b
 	out := fmt.Sprintf(cli.Dedent(`
 		create table if not exists %s
 		(
-            id           SERIAL PRIMARY KEY,
-            op           char,
-            table_name   text,
-			pk           text,
-            prev_value   text,
+			id           BIGSERIAL PRIMARY KEY,
+			op           char,
+			table_name   text,
+			pk           jsonb,
+			prev_value   jsonb,
 			block_num    bigint
 		);
+		create index if not exists %s on %s (block_num);
 		`),
 		d.historyTable(schema),
+		EscapeIdentifier(HISTORY_TABLE+"_block_num_idx"),
+		d.historyTable(schema),
 	)
 	if withPostgraphile {
 		out += fmt.Sprintf("COMMENT ON TABLE %s.%s IS E'@omit';",
@@ -221,6 +416,91 @@ func (d postgresDialect) GetCreateHistoryQuery(schema string, withPostgraphile b
 	return out
 }
 
+// migrateHistoryTable converts the history table created by previous versions, which stored the
+// primary key and previous value of rows as JSON text and identified entries with a 32 bits serial.
+// The block number index is created by GetCreateHistoryQuery.
+func (d postgresDialect) migrateHistoryTable(ctx context.Context, l *Loader) error {
+	rows, err := l.QueryContext(ctx, `SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`, l.schema, HISTORY_TABLE)
+	if err != nil {
+		return fmt.Errorf("reading history columns: %w", err)
+	}
+	defer rows.Close()
+
+	dataTypes := map[string]string{}
+	for rows.Next() {
+		var column, dataType string
+		if err := rows.Scan(&column, &dataType); err != nil {
+			return fmt.Errorf("scanning history column: %w", err)
+		}
+		dataTypes[column] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading history columns: %w", err)
+	}
+
+	var statements []string
+	if dataTypes["id"] == "integer" {
+		statements = append(statements,
+			fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN id TYPE bigint`, d.historyTable(l.schema)),
+			fmt.Sprintf(`ALTER SEQUENCE %s.%s AS bigint`, EscapeIdentifier(l.schema), EscapeIdentifier(HISTORY_TABLE+"_id_seq")),
+		)
+	}
+	if dataTypes["pk"] == "text" {
+		statements = append(statements, fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN pk TYPE jsonb USING pk::jsonb`, d.historyTable(l.schema)))
+	}
+	if dataTypes["prev_value"] == "text" {
+		statements = append(statements, fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN prev_value TYPE jsonb USING NULLIF(prev_value, '')::jsonb`, d.historyTable(l.schema)))
+	}
+
+	if len(statements) == 0 {
+		return nil
+	}
+
+	l.logger.Info("migrating history table", zap.String("table", d.historyTable(l.schema)), zap.Strings("statements", statements))
+	if _, err := l.ExecContext(ctx, strings.Join(statements, ";\n")); err != nil {
+		return fmt.Errorf("executing migration: %w", err)
+	}
+	return nil
+}
+
+func (d postgresDialect) GetCreateCompletionsQuery(schema string, withPostgraphile bool) string {
+	out := fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id           text not null constraint %s primary key,
+			block_num    bigint,
+			block_id     text,
+			completed_at timestamp with time zone default now()
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(COMPLETIONS_TABLE), EscapeIdentifier(COMPLETIONS_TABLE+"_pk"))
+	if withPostgraphile {
+		out += fmt.Sprintf("COMMENT ON TABLE %s.%s IS E'@omit';",
+			EscapeIdentifier(schema), EscapeIdentifier(COMPLETIONS_TABLE))
+	}
+	return out
+}
+
+func (d postgresDialect) createReorgsQuery(schema string, withPostgraphile bool) string {
+	out := fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id               BIGSERIAL PRIMARY KEY,
+			module_hash      text,
+			last_valid_block bigint,
+			cursor_before    text,
+			cursor_after     text,
+			reverted_rows    jsonb,
+			duration_ms      bigint,
+			reverted_at      timestamp with time zone default now()
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(REORGS_TABLE))
+	if withPostgraphile {
+		out += fmt.Sprintf("COMMENT ON TABLE %s.%s IS E'@omit';",
+			EscapeIdentifier(schema), EscapeIdentifier(REORGS_TABLE))
+	}
+	return out
+}
+
 func (d postgresDialect) ExecuteSetupScript(ctx context.Context, l *Loader, schemaSql string) error {
 	if _, err := l.ExecContext(ctx, schemaSql); err != nil {
 		return fmt.Errorf("exec schema: %w", err)
@@ -234,14 +514,21 @@ func (d postgresDialect) GetUpdateCursorQuery(table, moduleHash string, cursor *
 	`, table, cursor, block_num, block_id, moduleHash)
 }
 
-func (d postgresDialect) ParseDatetimeNormalization(value string) string {
-	return escapeStringValue(value)
+func (d postgresDialect) GetMarkCompletedQuery(table, moduleHash string, block_num uint64, block_id string) string {
+	return query(`
+		INSERT INTO %s (id, block_num, block_id, completed_at) VALUES ('%s', %d, '%s', now())
+		ON CONFLICT (id) DO UPDATE SET block_num = EXCLUDED.block_num, block_id = EXCLUDED.block_id, completed_at = EXCLUDED.completed_at;
+	`, table, moduleHash, block_num, block_id)
 }
 
 func (d postgresDialect) DriverSupportRowsAffected() bool {
 	return true
 }
 
+func (d postgresDialect) EscapeIdentifier(valueToEscape string) string {
+	return EscapeIdentifier(valueToEscape)
+}
+
 func (d postgresDialect) OnlyInserts() bool {
 	return false
 }
@@ -273,106 +560,120 @@ func (d postgresDialect) historyTable(schema string) string {
 	return fmt.Sprintf("%s.%s", EscapeIdentifier(schema), EscapeIdentifier(HISTORY_TABLE))
 }
 
-func (d postgresDialect) saveInsert(schema string, table string, primaryKey map[string]string, blockNum uint64) string {
-	return fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,block_num) values (%s,%s,%s,%d);`,
-		d.historyTable(schema),
-		escapeStringValue("I"),
-		escapeStringValue(table),
-		escapeStringValue(primaryKeyToJSON(primaryKey)),
-		blockNum,
-	)
+func (d postgresDialect) saveUpdate(schema string, escapedTableName string, primaryKey map[string]string, blockNum uint64) *statement {
+	return d.saveRow("U", schema, escapedTableName, primaryKey, blockNum)
 }
 
-func (d postgresDialect) saveUpdate(schema string, escapedTableName string, primaryKey map[string]string, blockNum uint64) string {
-	return d.saveRow("U", schema, escapedTableName, primaryKey, blockNum)
+// saveUpsert records the history of an upsert, since it's only known by the database if the
+// row exists, the recorded operation is an insert ('I') when the row does not exist yet and
+// an update ('U') holding the previous value otherwise.
+func (d postgresDialect) saveUpsert(schema string, escapedTableName string, primaryKey map[string]string, blockNum uint64) *statement {
+	schemaAndTable := fmt.Sprintf("%s.%s", EscapeIdentifier(schema), escapedTableName)
+	whereClause, whereArgs := getPrimaryKeyWhereClauseArgs(primaryKey, 4)
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT CASE WHEN prev IS NULL THEN 'I' ELSE 'U' END,$1::text,$2::jsonb,prev,$3::bigint FROM (SELECT (SELECT to_jsonb(%s) FROM %s.%s WHERE %s) AS prev) AS existing;`,
+		d.historyTable(schema),
+		escapedTableName,
+		EscapeIdentifier(schema), escapedTableName,
+		whereClause,
+	), append([]any{schemaAndTable, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
 }
 
-func (d postgresDialect) saveDelete(schema string, escapedTableName string, primaryKey map[string]string, blockNum uint64) string {
+func (d postgresDialect) saveDelete(schema string, escapedTableName string, primaryKey map[string]string, blockNum uint64) *statement {
 	return d.saveRow("D", schema, escapedTableName, primaryKey, blockNum)
 }
 
-func (d postgresDialect) saveRow(op, schema, escapedTableName string, primaryKey map[string]string, blockNum uint64) string {
+func (d postgresDialect) saveRow(op, schema, escapedTableName string, primaryKey map[string]string, blockNum uint64) *statement {
 	schemaAndTable := fmt.Sprintf("%s.%s", EscapeIdentifier(schema), escapedTableName)
-	return fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT %s,%s,%s,row_to_json(%s),%d FROM %s.%s WHERE %s;`,
+	whereClause, whereArgs := getPrimaryKeyWhereClauseArgs(primaryKey, 5)
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb(%s),$4::bigint FROM %s.%s WHERE %s;`,
 		d.historyTable(schema),
-		escapeStringValue(op), escapeStringValue(schemaAndTable), escapeStringValue(primaryKeyToJSON(primaryKey)), escapedTableName, blockNum,
+		escapedTableName,
 		EscapeIdentifier(schema), escapedTableName,
-		getPrimaryKeyWhereClause(primaryKey),
-	)
-
+		whereClause,
+	), append([]any{op, schemaAndTable, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
 }
 
-func (d *postgresDialect) prepareStatement(schema string, o *Operation) (string, error) {
-	var columns, values []string
-	if o.opType == OperationTypeInsert || o.opType == OperationTypeUpdate {
+// prepareStatement returns the statement(s) required to apply the operation, when the operation
+// is reversible, the history statement is returned first and must be executed before the actual
+// operation statement.
+func (d *postgresDialect) prepareStatement(schema string, o *Operation) ([]*statement, error) {
+	var columns []string
+	var values []any
+	if o.opType == OperationTypeUpdate {
 		var err error
 		columns, values, err = d.prepareColValues(o.table, o.data)
 		if err != nil {
-			return "", fmt.Errorf("preparing column & values: %w", err)
+			return nil, fmt.Errorf("preparing column & values: %w", err)
 		}
 	}
 
 	if o.opType == OperationTypeUpdate || o.opType == OperationTypeDelete {
 		// A table without a primary key set yield a `primaryKey` map with a single entry where the key is an empty string
 		if _, found := o.primaryKey[""]; found {
-			return "", fmt.Errorf("trying to perform %s operation but table %q don't have a primary key set, this is not accepted", o.opType, o.table.name)
+			return nil, fmt.Errorf("trying to perform %s operation but table %q don't have a primary key set, this is not accepted", o.opType, o.table.name)
 		}
 	}
 
 	switch o.opType {
-	case OperationTypeInsert:
-		insertQuery := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);",
-			o.table.identifier,
-			strings.Join(columns, ","),
-			strings.Join(values, ","),
-		)
-		if o.reversibleBlockNum != nil {
-			return d.saveInsert(schema, o.table.identifier, o.primaryKey, *o.reversibleBlockNum) + insertQuery, nil
-		}
-		return insertQuery, nil
+	case OperationTypeInsert, OperationTypeUpsert:
+		return d.insertStatements(schema, []*Operation{o})
 
 	case OperationTypeUpdate:
 		updates := make([]string, len(columns))
 		for i := 0; i < len(columns); i++ {
-			updates[i] = fmt.Sprintf("%s=%s", columns[i], values[i])
+			updates[i] = fmt.Sprintf("%s=$%d", columns[i], i+1)
 		}
 
-		primaryKeySelector := getPrimaryKeyWhereClause(o.primaryKey)
+		primaryKeySelector, primaryKeyArgs := getPrimaryKeyWhereClauseArgs(o.primaryKey, len(values)+1)
 
-		updateQuery := fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+		updateQuery := newStatement(fmt.Sprintf("UPDATE %s SET %s WHERE %s",
 			o.table.identifier,
 			strings.Join(updates, ", "),
 			primaryKeySelector,
-		)
+		), append(values, primaryKeyArgs...)...)
 
 		if o.reversibleBlockNum != nil {
-			return d.saveUpdate(schema, o.table.nameEscaped, o.primaryKey, *o.reversibleBlockNum) + updateQuery, nil
+			return []*statement{d.saveUpdate(schema, o.table.nameEscaped, o.primaryKey, *o.reversibleBlockNum), updateQuery}, nil
 		}
-		return updateQuery, nil
+		return []*statement{updateQuery}, nil
 
 	case OperationTypeDelete:
-		primaryKeyWhereClause := getPrimaryKeyWhereClause(o.primaryKey)
-		deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE %s",
+		primaryKeyWhereClause, primaryKeyArgs := getPrimaryKeyWhereClauseArgs(o.primaryKey, 1)
+		deleteQuery := newStatement(fmt.Sprintf("DELETE FROM %s WHERE %s",
 			o.table.identifier,
 			primaryKeyWhereClause,
-		)
+		), primaryKeyArgs...)
 		if o.reversibleBlockNum != nil {
-			return d.saveDelete(schema, o.table.nameEscaped, o.primaryKey, *o.reversibleBlockNum) + deleteQuery, nil
+			return []*statement{d.saveDelete(schema, o.table.nameEscaped, o.primaryKey, *o.reversibleBlockNum), deleteQuery}, nil
 		}
-		return deleteQuery, nil
+		return []*statement{deleteQuery}, nil
 
 	default:
 		panic(fmt.Errorf("unknown operation type %q", o.opType))
 	}
 }
 
-func (d *postgresDialect) prepareColValues(table *TableInfo, colValues map[string]string) (columns []string, values []string, err error) {
+// prepareColValues returns the escaped columns names sorted alphabetically along with the
+// normalized values to bind for each of them.
+func (d *postgresDialect) prepareColValues(table *TableInfo, colValues map[string]string) (columns []string, values []any, err error) {
+	return prepareColValues(table, colValues, d.normalizeValueType)
+}
+
+// normalizeValueFunc converts the textual value received from Substreams for a column whose
+// values are of Go type `valueType` into the value to bind for the dialect.
+type normalizeValueFunc func(value string, valueType reflect.Type) (any, error)
+
+// prepareColValues returns the escaped columns names sorted alphabetically along with the
+// values to bind for each of them, as normalized by `normalize`.
+func prepareColValues(table *TableInfo, colValues map[string]string, normalize normalizeValueFunc) (columns []string, values []any, err error) {
 	if len(colValues) == 0 {
 		return
 	}
 
 	columns = make([]string, len(colValues))
-	values = make([]string, len(colValues))
+	values = make([]any, len(colValues))
 
 	i := 0
 	for colName := range colValues {
@@ -388,7 +689,7 @@ func (d *postgresDialect) prepareColValues(table *TableInfo, colValues map[strin
 			return nil, nil, fmt.Errorf("cannot find column %q for table %q (valid columns are %q)", columnName, table.identifier, strings.Join(maps.Keys(table.columnsByName), ", "))
 		}
 
-		normalizedValue, err := d.normalizeValueType(value, columnInfo.scanType)
+		normalizedValue, err := normalize(value, columnInfo.scanType)
 		if err != nil {
 			return nil, nil, fmt.Errorf("getting sql value from table %s for column %q raw value %q: %w", table.identifier, columnName, value, err)
 		}
@@ -416,29 +717,36 @@ func getPrimaryKeyWhereClause(primaryKey map[string]string) string {
 	return strings.Join(reg[:], " AND ")
 }
 
-// Format based on type, value returned unescaped
-func (d *postgresDialect) normalizeValueType(value string, valueType reflect.Type) (string, error) {
-	switch valueType.Kind() {
-	case reflect.String:
-		// replace unicode null character with empty string
-		value = strings.ReplaceAll(value, "\u0000", "")
-		return escapeStringValue(value), nil
-
-	// BYTES in Postgres must be escaped, we receive a Vec<u8> from substreams
-	case reflect.Slice:
-		return escapeStringValue(value), nil
+// getPrimaryKeyWhereClauseArgs is like getPrimaryKeyWhereClause but uses bind placeholders
+// starting at `$from`, the returned arguments are ordered like the placeholders.
+func getPrimaryKeyWhereClauseArgs(primaryKey map[string]string, from int) (string, []any) {
+	// Avoid any sorting if there is a single primary key
+	if len(primaryKey) == 1 {
+		for key, value := range primaryKey {
+			return EscapeIdentifier(key) + " = $" + strconv.Itoa(from), []any{value}
+		}
+	}
 
-	case reflect.Bool:
-		return fmt.Sprintf("'%s'", value), nil
+	keys := maps.Keys(primaryKey)
+	sort.Strings(keys)
 
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return value, nil
+	reg := make([]string, len(keys))
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		reg[i] = EscapeIdentifier(key) + " = $" + strconv.Itoa(from+i)
+		args[i] = primaryKey[key]
+	}
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return value, nil
+	return strings.Join(reg, " AND "), args
+}
 
-	case reflect.Float32, reflect.Float64:
-		return value, nil
+// Format based on type, value returned is meant to be used as a bind parameter, the
+// database engine takes care of converting it to the column's type.
+func (d *postgresDialect) normalizeValueType(value string, valueType reflect.Type) (any, error) {
+	switch valueType.Kind() {
+	case reflect.String:
+		// replace unicode null character with empty string
+		return strings.ReplaceAll(value, "\u0000", ""), nil
 
 	case reflect.Struct:
 		if valueType == reflectTypeTime {
@@ -448,19 +756,20 @@ func (d *postgresDialect) normalizeValueType(value string, valueType reflect.Typ
 					return "", fmt.Errorf("could not convert %s to int: %w", value, err)
 				}
 
-				return escapeStringValue(time.Unix(int64(i), 0).Format(time.RFC3339)), nil
+				return time.Unix(int64(i), 0).Format(time.RFC3339), nil
 			}
 
-			// It's a plain string, parse by dialect it and pass it to the database
-			return d.ParseDatetimeNormalization(value), nil
+			// It's a plain string, pass it to the database which parses it
+			return value, nil
 		}
 
 		return "", fmt.Errorf("unsupported struct type %s", valueType)
 	default:
-		// It's a column's type the schema parsing don't know how to represents as
-		// a Go type. In that case, we pass it unmodified to the database engine. It
-		// will be the responsibility of the one sending the data to correctly represent
-		// it in the way accepted by the database.
+		// BYTES in Postgres are received as a string from substreams (Vec<u8> already encoded),
+		// booleans and numbers are received in their textual representation which is accepted
+		// as-is by Postgres. For column's type the schema parsing don't know how to represents
+		// as a Go type, we pass it unmodified to the database engine. It will be the responsibility
+		// of the one sending the data to correctly represent it in the way accepted by the database.
 		//
 		// In most cases, it going to just work.
 		return value, nil
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// postgresMaxBindParameters is the maximum amount of bind parameters accepted by
+	// Postgres in a single statement (the wire protocol encodes the count on 16 bits).
+	postgresMaxBindParameters = 65535
+
+	// postgresMaxInsertRows bounds the amount of rows sent in a single multi-row INSERT,
+	// keeping the amount of distinct statement shapes (and thus prepared statements) low.
+	postgresMaxInsertRows = 1000
+
+	// postgresMaxInsertBytes is the approximate maximum size of the bind parameters
+	// sent in a single multi-row INSERT, protects against huge statements when rows
+	// contain large values.
+	postgresMaxInsertBytes = 64 * 1024 * 1024
+)
+
+// insertGroup holds the insert (or upsert) operations of a single table sharing the same
+// column set, they are flushed together using multi-row INSERT statements.
+type insertGroup struct {
+	opType  OperationType
+	table   *TableInfo
+	columns []string
+	rows    [][]any
+
+	// reversible holds the operations of reversible blocks which must be recorded
+	// in the `substreams_history` table.
+	reversible []*Operation
+}
+
+// groupInserts groups the insert (or upsert) operations per operation type and column
+// set, respecting the order in which each group is first seen. Values are normalized
+// by `normalize`, see prepareColValues.
+func groupInserts(operations []*Operation, normalize normalizeValueFunc) (*OrderedMap[string, *insertGroup], error) {
+	groups := NewOrderedMap[string, *insertGroup]()
+	for _, o := range operations {
+		columns, values, err := prepareColValues(o.table, o.data, normalize)
+		if err != nil {
+			return nil, fmt.Errorf("preparing column & values for %s: %w", o, err)
+		}
+
+		key := string(o.opType) + ":" + strings.Join(columns, ",")
+		group, found := groups.Get(key)
+		if !found {
+			group = &insertGroup{opType: o.opType, table: o.table, columns: columns}
+			groups.Set(key, group)
+		}
+
+		group.rows = append(group.rows, values)
+		if o.reversibleBlockNum != nil {
+			group.reversible = append(group.reversible, o)
+		}
+	}
+
+	return groups, nil
+}
+
+// insertStatements returns the statements to apply the insert (or upsert) operations, history
+// rows come first followed by the data rows, each chunked in multi-row INSERT statements.
+func (d postgresDialect) insertStatements(schema string, operations []*Operation) ([]*statement, error) {
+	groups, err := groupInserts(operations, d.normalizeValueType)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []*statement
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		group := pair.Value
+		columns := strings.Join(group.columns, ",")
+
+		switch group.opType {
+		case OperationTypeInsert:
+			if len(group.reversible) > 0 {
+				history := make([][]any, len(group.reversible))
+				for i, o := range group.reversible {
+					history[i] = []any{"I", o.table.identifier, primaryKeyToJSON(o.primaryKey), *o.reversibleBlockNum}
+				}
+
+				statements = append(statements, multiRowInsert(
+					fmt.Sprintf("INSERT INTO %s (op,table_name,pk,block_num) values ", d.historyTable(schema)),
+					"",
+					4,
+					history,
+				)...)
+			}
+
+			statements = append(statements, multiRowInsert(
+				fmt.Sprintf("INSERT INTO %s (%s) VALUES ", group.table.identifier, columns),
+				"",
+				len(group.columns),
+				group.rows,
+			)...)
+
+		case OperationTypeUpsert:
+			// Whether the row exists or not is only known by the database, so each reversible
+			// upsert records its own history row, either as an insert or as an update
+			for _, o := range group.reversible {
+				statements = append(statements, d.saveUpsert(schema, o.table.nameEscaped, o.primaryKey, *o.reversibleBlockNum))
+			}
+
+			statements = append(statements, multiRowInsert(
+				fmt.Sprintf("INSERT INTO %s (%s) VALUES ", group.table.identifier, columns),
+				" "+onConflictClause(group.table, group.columns),
+				len(group.columns),
+				group.rows,
+			)...)
+
+		default:
+			panic(fmt.Errorf("unexpected operation type %q in insert group", group.opType))
+		}
+	}
+
+	return statements, nil
+}
+
+// onConflictClause returns the `ON CONFLICT` clause turning an INSERT into an upsert, the
+// non primary key columns are updated with the incoming values.
+func onConflictClause(table *TableInfo, escapedColumns []string) string {
+	conflictColumns := make([]string, len(table.primaryColumns))
+	isPrimary := make(map[string]bool, len(table.primaryColumns))
+	for i, column := range table.primaryColumns {
+		conflictColumns[i] = column.escapedName
+		isPrimary[column.escapedName] = true
+	}
+
+	var updates []string
+	for _, column := range escapedColumns {
+		if !isPrimary[column] {
+			updates = append(updates, column+"=EXCLUDED."+column)
+		}
+	}
+
+	if len(updates) == 0 {
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", strings.Join(conflictColumns, ","))
+	}
+
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(conflictColumns, ","), strings.Join(updates, ", "))
+}
+
+func (d postgresDialect) flushInserts(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	statements, err := d.insertStatements(l.schema, operations)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range statements {
+		if l.tracer.Enabled() {
+			l.logger.Debug("adding multi-row insert or upsert to transaction", zap.String("query", stmt.query), zap.Int("arg_count", len(stmt.args)))
+		}
+
+		if _, err := l.statements.exec(ctx, tx, stmt); err != nil {
+			return fmt.Errorf("executing query %q: %w", stmt.query, err)
+		}
+	}
+
+	return nil
+}
+
+// multiRowInsert chunks the rows into `<prefix>($1,$2),($3,$4)<suffix>;` statements, keeping
+// each of them under the Postgres bind parameters limit, `postgresMaxInsertRows` rows
+// and `postgresMaxInsertBytes` bytes of arguments.
+func multiRowInsert(prefix, suffix string, columnCount int, rows [][]any) []*statement {
+	maxRows := postgresMaxInsertRows
+	if columnCount > 0 && postgresMaxBindParameters/columnCount < maxRows {
+		maxRows = postgresMaxBindParameters / columnCount
+	}
+
+	var statements []*statement
+	for _, chunk := range chunkRows(rows, maxRows, postgresMaxInsertBytes) {
+		statements = append(statements, multiRowInsertStatement(prefix, suffix, columnCount, chunk, maxRows))
+	}
+
+	return statements
+}
+
+// chunkRows splits the rows in chunks of at most `maxRows` rows and, when `maxBytes` is not zero,
+// approximately `maxBytes` bytes of values, a row larger than that being alone in its chunk.
+func chunkRows(rows [][]any, maxRows, maxBytes int) (chunks [][][]any) {
+	for start := 0; start < len(rows); {
+		end, size := start, 0
+		for end < len(rows) && end-start < maxRows {
+			rowSize := approximateRowSize(rows[end])
+			if maxBytes > 0 && end > start && size+rowSize > maxBytes {
+				break
+			}
+
+			size += rowSize
+			end++
+		}
+
+		chunks = append(chunks, rows[start:end])
+		start = end
+	}
+
+	return chunks
+}
+
+func multiRowInsertStatement(prefix, suffix string, columnCount int, rows [][]any, maxRows int) *statement {
+	var query strings.Builder
+	query.WriteString(prefix)
+
+	args := make([]any, 0, len(rows)*columnCount)
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteByte(',')
+		}
+
+		query.WriteByte('(')
+		query.WriteString(placeholders(len(args)+1, len(row)))
+		query.WriteByte(')')
+
+		args = append(args, row...)
+	}
+	query.WriteString(suffix)
+	query.WriteByte(';')
+
+	stmt := newStatement(query.String(), args...)
+
+	// Only single row and full chunks are worth preparing, other shapes are
+	// typically the tail of a flush and would mostly pollute the statement cache.
+	stmt.oneShot = len(rows) != 1 && len(rows) != maxRows
+
+	return stmt
+}
+
+func approximateRowSize(row []any) (size int) {
+	for _, value := range row {
+		switch v := value.(type) {
+		case string:
+			size += len(v)
+		default:
+			size += 8
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// copyInTx is implemented by transactions that know how to bulk load rows through the
+// Postgres `COPY ... FROM STDIN` protocol by themselves, a `*sql.Tx` backed by `lib/pq`
+// is handled directly by `copyIn`.
+type copyInTx interface {
+	CopyIn(ctx context.Context, query string, rows [][]any) error
+}
+
+// canCopy returns true if all the operations can be bulk loaded using COPY, which is
+// the case when they are all inserts of irreversible blocks: COPY is a plain append and
+// cannot record reorg history.
+func canCopy(tx Tx, operations []*Operation) bool {
+	if !supportsCopyIn(tx) || len(operations) == 0 {
+		return false
+	}
+
+	for _, operation := range operations {
+		if operation.opType != OperationTypeInsert || operation.reversibleBlockNum != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func supportsCopyIn(tx Tx) bool {
+	switch tx.(type) {
+	case *sql.Tx, copyInTx:
+		return true
+	}
+
+	return false
+}
+
+// flushCopy streams the insert operations through `COPY ... FROM STDIN`, one COPY per
+// column set. It runs within `tx` so the rows are committed atomically with the cursor.
+func (d postgresDialect) flushCopy(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	groups, err := groupInserts(operations, d.normalizeValueType)
+	if err != nil {
+		return err
+	}
+
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		group := pair.Value
+		query := fmt.Sprintf("COPY %s (%s) FROM STDIN", group.table.identifier, strings.Join(group.columns, ","))
+
+		if l.tracer.Enabled() {
+			l.logger.Debug("copying rows to table", zap.String("query", query), zap.Int("row_count", len(group.rows)))
+		}
+
+		if err := copyIn(ctx, tx, query, group.rows); err != nil {
+			return fmt.Errorf("copy into %s: %w", group.table.identifier, err)
+		}
+	}
+
+	return nil
+}
+
+func copyIn(ctx context.Context, tx Tx, query string, rows [][]any) error {
+	switch t := tx.(type) {
+	case copyInTx:
+		return t.CopyIn(ctx, query, rows)
+
+	case *sql.Tx:
+		stmt, err := t.PrepareContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("prepare: %w", err)
+		}
+		defer stmt.Close()
+
+		for _, row := range rows {
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				return fmt.Errorf("send row: %w", err)
+			}
+		}
+
+		// An exec without any arguments flushes the COPY buffer and reports errors, if any
+		if _, err := stmt.ExecContext(ctx); err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("transaction %T does not support COPY", tx)
+}
@@ -0,0 +1,307 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+)
+
+// partitionOptions configures the management of tables partitioned by block number, set
+// through the `partition_size`, `partitions_ahead` and `partitions_retained` DSN options.
+type partitionOptions struct {
+	// size is the amount of blocks covered by each partition created.
+	size uint64
+	// ahead is the amount of partitions created past the one holding the last flushed block.
+	ahead uint64
+	// retained is the amount of partitions fully below the final block kept attached, older
+	// ones are detached. Zero keeps every partition attached.
+	retained uint64
+}
+
+var defaultPartitionOptions = partitionOptions{size: 1_000_000, ahead: 2}
+
+// postgresPartitioning is the declarative range partitioning of a table on a block number
+// column, declared with `PARTITION BY RANGE (<column>)`.
+type postgresPartitioning struct {
+	column string
+	// partitions are the attached partitions, sorted by range.
+	partitions []postgresPartition
+}
+
+// postgresPartition covers the blocks from `from` (inclusive) to `to` (exclusive).
+type postgresPartition struct {
+	name string
+	from uint64
+	to   uint64
+}
+
+// coveredUpTo returns the upper bound of the partition covering the highest blocks, zero when
+// there is no partition.
+func coveredUpTo(partitions []postgresPartition) uint64 {
+	if len(partitions) == 0 {
+		return 0
+	}
+	return partitions[len(partitions)-1].to
+}
+
+// stagedPartitions are the partitions of the tables whose partitions are created or detached by a
+// transaction, applied to the tables by apply once it's committed: a rolled back transaction
+// leaves the partitions known to the Loader as they are in the database.
+type stagedPartitions map[*TableInfo][]postgresPartition
+
+type stagedPartitionsKey struct{}
+
+func withStagedPartitions(ctx context.Context, staged stagedPartitions) context.Context {
+	return context.WithValue(ctx, stagedPartitionsKey{}, staged)
+}
+
+// partitionsOf returns the partitions of `table` as of the transaction of `ctx`.
+func partitionsOf(ctx context.Context, table *TableInfo) []postgresPartition {
+	if staged, found := ctx.Value(stagedPartitionsKey{}).(stagedPartitions); found {
+		if partitions, found := staged[table]; found {
+			return partitions
+		}
+	}
+	return table.partitioning.partitions
+}
+
+// stagePartitions records the partitions of `table` as of the transaction of `ctx`, they are
+// applied right away when the context is not the one of a transaction staging them.
+func stagePartitions(ctx context.Context, table *TableInfo, partitions []postgresPartition) {
+	if staged, found := ctx.Value(stagedPartitionsKey{}).(stagedPartitions); found {
+		staged[table] = partitions
+		return
+	}
+	table.partitioning.partitions = partitions
+}
+
+// apply sets the partitions of the tables to the staged ones, once the transaction is committed.
+func (s stagedPartitions) apply() {
+	for table, partitions := range s {
+		table.partitioning.partitions = partitions
+	}
+}
+
+var postgresPartitionBoundRegex = regexp.MustCompile(`^FOR VALUES FROM \(([^)]+)\) TO \(([^)]+)\)$`)
+
+// parsePostgresPartitionBound parses a range partition bound as rendered by `pg_get_expr`, e.g.
+// `FOR VALUES FROM ('0') TO ('1000000')`. The default partition is reported as not found.
+func parsePostgresPartitionBound(bound string) (from, to uint64, found bool, err error) {
+	if bound == "DEFAULT" {
+		return 0, 0, false, nil
+	}
+
+	matches := postgresPartitionBoundRegex.FindStringSubmatch(bound)
+	if matches == nil {
+		return 0, 0, false, fmt.Errorf("unsupported partition bound %q, expecting a range on a single column", bound)
+	}
+
+	parse := func(value string) (uint64, error) {
+		switch value = strings.Trim(value, "'"); value {
+		case "MINVALUE":
+			return 0, nil
+		case "MAXVALUE":
+			return math.MaxUint64, nil
+		}
+
+		if strings.HasPrefix(value, "-") {
+			return 0, nil
+		}
+		return strconv.ParseUint(value, 10, 64)
+	}
+
+	if from, err = parse(matches[1]); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid partition bound %q: %w", bound, err)
+	}
+	if to, err = parse(matches[2]); err != nil {
+		return 0, 0, false, fmt.Errorf("invalid partition bound %q: %w", bound, err)
+	}
+
+	return from, to, true, nil
+}
+
+// inspectPartitioning detects tables partitioned by range on a single column and lists their partitions.
+func (d postgresDialect) inspectPartitioning(db *sql.DB, table *TableInfo) error {
+	var column string
+	err := db.QueryRow(`
+		SELECT a.attname
+		FROM pg_partitioned_table p
+		JOIN pg_class c ON c.oid = p.partrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = p.partattrs[0]
+		WHERE n.nspname = $1 AND c.relname = $2 AND p.partstrat = 'r' AND p.partnatts = 1
+	`, table.schema, table.name).Scan(&column)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading partitioning: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass
+	`, table.identifier)
+	if err != nil {
+		return fmt.Errorf("listing partitions: %w", err)
+	}
+	defer rows.Close()
+
+	partitioning := &postgresPartitioning{column: column}
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return fmt.Errorf("scanning partition: %w", err)
+		}
+
+		from, to, found, err := parsePostgresPartitionBound(bound)
+		if err != nil {
+			return fmt.Errorf("partition %q: %w", name, err)
+		}
+		if found {
+			partitioning.partitions = append(partitioning.partitions, postgresPartition{name: name, from: from, to: to})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("listing partitions: %w", err)
+	}
+
+	sort.Slice(partitioning.partitions, func(i, j int) bool {
+		return partitioning.partitions[i].from < partitioning.partitions[j].from
+	})
+
+	table.partitioning = partitioning
+	return nil
+}
+
+// ensurePartitions creates the partitions of `table` missing to hold the blocks up to `stopBlock`
+// and the `ahead` following partitions. The first partition created holds `startBlock`, blocks
+// below the existing partitions are left uncovered.
+func (d postgresDialect) ensurePartitions(ctx context.Context, tx Tx, l *Loader, table *TableInfo, startBlock, stopBlock uint64) error {
+	partitions := slices.Clone(partitionsOf(ctx, table))
+	size := l.partitions.size
+
+	from := max(coveredUpTo(partitions), startBlock/size*size)
+	if from == math.MaxUint64 {
+		return nil
+	}
+
+	upTo := (stopBlock/size + 1 + l.partitions.ahead) * size
+	for from < upTo {
+		partition := postgresPartition{name: fmt.Sprintf("%s_p%d", table.name, from), from: from, to: (from/size + 1) * size}
+
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)",
+			table.schemaEscaped, EscapeIdentifier(partition.name), table.identifier, partition.from, partition.to,
+		)
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("executing query %q: %w", query, err)
+		}
+
+		l.logger.Info("created partition", zap.String("table", table.identifier), zap.String("partition", partition.name), zap.Uint64("from_block", partition.from), zap.Uint64("to_block", partition.to))
+		partitions = append(partitions, partition)
+		from = partition.to
+	}
+
+	stagePartitions(ctx, table, partitions)
+	return nil
+}
+
+// detachFinalPartitions detaches the partitions of `table` fully below `lastFinalBlock` except the
+// `retained` most recent ones. Detached partitions are kept as standalone tables. Only final blocks
+// are detached, the rows of reversible blocks that a revert may touch stay attached.
+func (d postgresDialect) detachFinalPartitions(ctx context.Context, tx Tx, l *Loader, table *TableInfo, lastFinalBlock uint64) error {
+	partitions := partitionsOf(ctx, table)
+
+	final := 0
+	for final < len(partitions) && partitions[final].to <= lastFinalBlock+1 {
+		final++
+	}
+
+	detached := final - int(min(uint64(final), l.partitions.retained))
+	for _, partition := range partitions[:detached] {
+		query := fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s.%s", table.identifier, table.schemaEscaped, EscapeIdentifier(partition.name))
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("executing query %q: %w", query, err)
+		}
+
+		l.logger.Info("detached final partition", zap.String("table", table.identifier), zap.String("partition", partition.name), zap.Uint64("from_block", partition.from), zap.Uint64("to_block", partition.to))
+	}
+
+	stagePartitions(ctx, table, partitions[detached:])
+	return nil
+}
+
+// partitionedTables returns the tables partitioned by block number, sorted by name.
+func (d postgresDialect) partitionedTables(l *Loader) (out []*TableInfo) {
+	tableNames := maps.Keys(l.tables)
+	sort.Strings(tableNames)
+
+	for _, tableName := range tableNames {
+		if table := l.tables[tableName]; table.partitioning != nil {
+			out = append(out, table)
+		}
+	}
+	return out
+}
+
+// firstFlushedBlock returns the lowest block among the rows of `entries` written to partitioned
+// tables, read from their partitioning column, false when no row holds one.
+func (d postgresDialect) firstFlushedBlock(l *Loader, entries *PendingOperations) (first uint64, found bool) {
+	for _, table := range d.partitionedTables(l) {
+		tableEntries, ok := entries.Get(table.name)
+		if !ok {
+			continue
+		}
+
+		for entryPair := tableEntries.Oldest(); entryPair != nil; entryPair = entryPair.Next() {
+			for operation := entryPair.Value; operation != nil; operation = operation.next {
+				blockNum, err := strconv.ParseUint(operation.data[table.partitioning.column], 10, 64)
+				if err != nil {
+					continue
+				}
+
+				if !found || blockNum < first {
+					first, found = blockNum, true
+				}
+			}
+		}
+	}
+	return first, found
+}
+
+// createPartitions creates, for every partitioned table, the partitions needed by the flush of
+// the blocks of `blockRange`, see ensurePartitions.
+func (d postgresDialect) createPartitions(ctx context.Context, tx Tx, l *Loader, blockRange flushRange) error {
+	for _, table := range d.partitionedTables(l) {
+		if err := d.ensurePartitions(ctx, tx, l, table, blockRange.start, blockRange.stop); err != nil {
+			return fmt.Errorf("creating partitions of %s: %w", table.identifier, err)
+		}
+	}
+	return nil
+}
+
+// detachPartitions detaches, for every partitioned table, the final partitions not retained, see
+// detachFinalPartitions. It does nothing unless `partitions_retained` is set.
+func (d postgresDialect) detachPartitions(ctx context.Context, tx Tx, l *Loader, lastFinalBlock uint64) error {
+	if l.partitions.retained == 0 {
+		return nil
+	}
+
+	for _, table := range d.partitionedTables(l) {
+		if err := d.detachFinalPartitions(ctx, tx, l, table, lastFinalBlock); err != nil {
+			return fmt.Errorf("detaching partitions of %s: %w", table.identifier, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/streamingfast/cli"
+	"go.uber.org/zap"
+)
+
+// pendingTable returns the escaped identifier of the shadow table of `table`.
+func (d postgresDialect) pendingTable(schema string, table *TableInfo) string {
+	return EscapeIdentifier(schema) + "." + EscapeIdentifier(table.name+PENDING_TABLE_SUFFIX)
+}
+
+// createPendingTableQuery returns the DDL creating the shadow table of `table` and its head view.
+// Each operation is recorded with its values (`data`) to apply it once final and the resulting
+// row (`row_value`, null when the row does not exist) for the head view, which overlays the rows
+// of the table with the latest one recorded for them.
+func (d postgresDialect) createPendingTableQuery(schema string, table *TableInfo, withPostgraphile bool) string {
+	pending := d.pendingTable(schema, table)
+
+	primaryColumns := make([]string, len(table.primaryColumns))
+	keyColumns := make([]string, len(table.primaryColumns))
+	for i, column := range table.primaryColumns {
+		primaryColumns[i] = "t." + column.escapedName
+		keyColumns[i] = "k." + column.escapedName
+	}
+
+	out := fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s
+		(
+			id           BIGSERIAL PRIMARY KEY,
+			op           text not null,
+			pk           jsonb not null,
+			data         jsonb,
+			row_value    jsonb,
+			block_num    bigint not null
+		);
+		create index if not exists %s on %s (pk);
+		create index if not exists %s on %s (block_num);
+		create or replace view %s as
+			select t.* from %s t where (%s) not in (select %s from %s p, jsonb_populate_record(null::%s, p.pk) k)
+			union all
+			select r.* from (select distinct on (pk) row_value from %s order by pk, id desc) p, jsonb_populate_record(null::%s, p.row_value) r where p.row_value is not null;
+		`),
+		pending,
+		EscapeIdentifier(table.name+PENDING_TABLE_SUFFIX+"_pk_idx"), pending,
+		EscapeIdentifier(table.name+PENDING_TABLE_SUFFIX+"_block_num_idx"), pending,
+		EscapeIdentifier(schema)+"."+EscapeIdentifier(table.name+HEAD_VIEW_SUFFIX),
+		table.identifier, strings.Join(primaryColumns, ","), strings.Join(keyColumns, ","), pending, table.identifier,
+		pending, table.identifier,
+	)
+	if withPostgraphile {
+		out += fmt.Sprintf("COMMENT ON TABLE %s IS E'@omit';", pending)
+	}
+	return out
+}
+
+// splitPending returns the operations to apply to their table and the ones to write to its shadow
+// table when the pending tables mode is enabled, those of the blocks after `lastFinalBlock`. The
+// reversible blocks up to it became final since they were received, their operations are applied
+// right away, without history: they precede the operations of all the blocks still reversible.
+func (d postgresDialect) splitPending(l *Loader, operations []*Operation, lastFinalBlock uint64) (final []*Operation, pending []*Operation) {
+	if !l.pendingTables {
+		return operations, nil
+	}
+
+	for _, operation := range operations {
+		if operation.reversibleBlockNum != nil && *operation.reversibleBlockNum > lastFinalBlock {
+			pending = append(pending, operation)
+			continue
+		}
+
+		operation.reversibleBlockNum = nil
+		final = append(final, operation)
+	}
+	return final, pending
+}
+
+func (d postgresDialect) flushPending(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	for _, operation := range operations {
+		stmt, err := d.pendingStatement(l.schema, operation)
+		if err != nil {
+			return fmt.Errorf("failed to prepare pending statement: %w", err)
+		}
+
+		if l.tracer.Enabled() {
+			l.logger.Debug("adding pending query from operation to transaction", zap.Stringer("op", operation), zap.String("query", stmt.query))
+		}
+
+		if _, err := l.statements.exec(ctx, tx, stmt); err != nil {
+			return fmt.Errorf("executing query %q: %w", stmt.query, err)
+		}
+	}
+
+	return nil
+}
+
+// pendingStatement returns the statement recording the reversible operation in the shadow table of
+// its table. The resulting row of updates and upserts is their values merged over the latest row
+// recorded in the shadow table or, when there is none, over the row of the table.
+func (d postgresDialect) pendingStatement(schema string, o *Operation) (*statement, error) {
+	pending := d.pendingTable(schema, o.table)
+	primaryKey := primaryKeyToJSON(o.primaryKey)
+
+	if o.opType == OperationTypeDelete {
+		return newStatement(fmt.Sprintf(`INSERT INTO %s (op,pk,data,row_value,block_num) VALUES ($1::text,$2::jsonb,NULL,NULL,$3::bigint);`,
+			pending,
+		), string(o.opType), primaryKey, *o.reversibleBlockNum), nil
+	}
+
+	data, err := d.pendingData(o.table, o.data)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.opType == OperationTypeInsert {
+		return newStatement(fmt.Sprintf(`INSERT INTO %s (op,pk,data,row_value,block_num) VALUES ($1::text,$2::jsonb,$3::jsonb,$3::jsonb,$4::bigint);`,
+			pending,
+		), string(o.opType), primaryKey, data, *o.reversibleBlockNum), nil
+	}
+
+	whereClause, whereArgs := getPrimaryKeyWhereClauseArgs(o.primaryKey, 5)
+	current := fmt.Sprintf(`CASE WHEN latest.op IS NULL THEN (SELECT to_jsonb(t) FROM %s t WHERE %s) WHEN latest.op <> 'DELETE' THEN latest.row_value END`,
+		o.table.identifier,
+		whereClause,
+	)
+	if o.opType == OperationTypeUpsert {
+		current = fmt.Sprintf(`COALESCE(%s, '{}'::jsonb)`, current)
+	}
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,pk,data,row_value,block_num) SELECT $1::text,$2::jsonb,$3::jsonb,%s || $3::jsonb,$4::bigint FROM (SELECT 1) AS one LEFT JOIN LATERAL (SELECT op, row_value FROM %s WHERE pk = $2::jsonb ORDER BY id DESC LIMIT 1) AS latest ON true;`,
+		pending,
+		current,
+		pending,
+	), append([]any{string(o.opType), primaryKey, data, *o.reversibleBlockNum}, whereArgs...)...), nil
+}
+
+// pendingData returns the values of an operation as a JSON object, normalized like the values bound
+// by the statements applying it so that the head view reads them like the table does.
+func (d postgresDialect) pendingData(table *TableInfo, data map[string]string) (string, error) {
+	values := make(map[string]any, len(data))
+	for columnName, value := range data {
+		columnInfo, found := table.columnsByName[columnName]
+		if !found {
+			return "", fmt.Errorf("cannot find column %q for table %q", columnName, table.identifier)
+		}
+
+		normalizedValue, err := d.normalizeValueType(value, columnInfo.scanType)
+		if err != nil {
+			return "", fmt.Errorf("getting sql value from table %s for column %q raw value %q: %w", table.identifier, columnName, value, err)
+		}
+		values[columnName] = normalizedValue
+	}
+
+	out, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("marshalling values: %w", err)
+	}
+	return string(out), nil
+}
+
+// promotePending applies to their table the operations recorded in the shadow tables for the blocks
+// up to `lastFinalBlock` and removes them, returning the amount of operations applied. The
+// operations of a row are chained in the order they were recorded, which is the order of their
+// blocks, and applied like the operations of final blocks.
+func (d postgresDialect) promotePending(ctx context.Context, tx Tx, l *Loader, lastFinalBlock uint64) (int, error) {
+	entries := NewOrderedMap[string, *OrderedMap[string, *Operation]]()
+	for _, table := range l.userTables() {
+		operations, err := d.takePending(ctx, tx, l, table, lastFinalBlock)
+		if err != nil {
+			return 0, err
+		}
+		if len(operations) == 0 {
+			continue
+		}
+
+		tableEntries := NewOrderedMap[string, *Operation]()
+		for _, operation := range operations {
+			uniqueID := createRowUniqueID(operation.primaryKey)
+			if head, found := tableEntries.Get(uniqueID); found {
+				_, tail := head.tail()
+				tail.next = operation
+				continue
+			}
+			tableEntries.Set(uniqueID, operation)
+		}
+		entries.Set(table.name, tableEntries)
+	}
+
+	rowCount, err := l.flushByGeneration(entries, func(tableName string, operations []*Operation) error {
+		if err := d.flushOperations(ctx, tx, l, operations); err != nil {
+			return fmt.Errorf("promoting pending operations of table %q: %w", tableName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if rowCount > 0 {
+		l.logger.Debug("promoted pending operations", zap.Uint64("last_final_block", lastFinalBlock), zap.Int("row_count", rowCount))
+	}
+	return rowCount, nil
+}
+
+// takePending removes the operations recorded in the shadow table of `table` for the blocks up
+// to `lastFinalBlock` and returns them as final operations, in the order they were recorded.
+func (d postgresDialect) takePending(ctx context.Context, tx Tx, l *Loader, table *TableInfo, lastFinalBlock uint64) ([]*Operation, error) {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE "block_num" <= %d RETURNING id, op, pk, data`,
+		d.pendingTable(l.schema, table),
+		lastFinalBlock,
+	)
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("executing query %q: %w", query, err)
+	}
+	if rows == nil { // rows will be nil with no error only in testing scenarios
+		return nil, nil
+	}
+	defer rows.Close()
+
+	type pendingRow struct {
+		id        int64
+		operation *Operation
+	}
+
+	var pendingRows []pendingRow
+	for rows.Next() {
+		var id int64
+		var op, pk string
+		var data sql.NullString
+		if err := rows.Scan(&id, &op, &pk, &data); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		primaryKey, err := jsonToPrimaryKey(pk)
+		if err != nil {
+			return nil, fmt.Errorf("decoding primary key %q: %w", pk, err)
+		}
+
+		var values map[string]string
+		if data.Valid {
+			if err := json.Unmarshal([]byte(data.String), &values); err != nil {
+				return nil, fmt.Errorf("decoding data %q: %w", data.String, err)
+			}
+		}
+
+		var operation *Operation
+		switch OperationType(op) {
+		case OperationTypeInsert:
+			operation = l.newInsertOperation(table, primaryKey, values, nil)
+		case OperationTypeUpdate:
+			operation = l.newUpdateOperation(table, primaryKey, values, nil)
+		case OperationTypeUpsert:
+			operation = l.newUpsertOperation(table, primaryKey, values, nil)
+		case OperationTypeDelete:
+			operation = l.newDeleteOperation(table, primaryKey, nil)
+		default:
+			return nil, fmt.Errorf("unknown operation %q recorded in %s", op, d.pendingTable(l.schema, table))
+		}
+		pendingRows = append(pendingRows, pendingRow{id: id, operation: operation})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating on rows from query %q: %w", query, err)
+	}
+
+	// RETURNING does not order the rows
+	sort.Slice(pendingRows, func(i, j int) bool { return pendingRows[i].id < pendingRows[j].id })
+
+	operations := make([]*Operation, len(pendingRows))
+	for i, row := range pendingRows {
+		operations[i] = row.operation
+	}
+	return operations, nil
+}
+
+// revertPending removes the operations recorded in the shadow tables for the blocks after
+// `lastValidFinalBlock`, the tables themselves never hold them.
+func (d postgresDialect) revertPending(ctx context.Context, tx Tx, l *Loader, lastValidFinalBlock uint64) error {
+	for _, table := range l.userTables() {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE "block_num" > %d;`, d.pendingTable(l.schema, table), lastValidFinalBlock)
+
+		result, err := tx.ExecContext(ctx, query)
+		if err != nil {
+			return fmt.Errorf("executing revert query %q: %w", query, err)
+		}
+
+		revertedRows, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("rows affected: %w", err)
+		}
+		if revertedRows > 0 {
+			l.recordRevertedRows(ctx, table.identifier, revertedRows)
+		}
+	}
+
+	return nil
+}
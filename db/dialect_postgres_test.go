@@ -2,6 +2,9 @@ package db
 
 import (
 	"context"
+	"errors"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -93,64 +96,397 @@ func TestJSONToPrimaryKey(t *testing.T) {
 
 }
 
-func TestRevertOp(t *testing.T) {
+func TestRevertQueries(t *testing.T) {
+	reverted := func(table string) string {
+		return `WITH reverted AS (SELECT DISTINCT ON (pk) op, pk, prev_value FROM "testschema"."substreams_history" WHERE table_name = '"testschema"."` + table + `"' AND "block_num" > 9999 ORDER BY pk, "block_num", id)`
+	}
 
-	type row struct {
-		op         string
-		table_name string
-		pk         string
-		prev_value string
+	tests := []struct {
+		name   string
+		table  string
+		expect []string
+	}{
+		{
+			name:  "single key",
+			table: "xfer",
+			expect: []string{
+				reverted("xfer") + ` DELETE FROM "testschema"."xfer" WHERE ("id") IN (SELECT k."id" FROM reverted, jsonb_populate_record(null::"testschema"."xfer", reverted.pk) k WHERE reverted.op = 'I');`,
+				reverted("xfer") + ` INSERT INTO "testschema"."xfer" ("from","id","to") SELECT r."from",r."id",r."to" FROM reverted, jsonb_populate_record(null::"testschema"."xfer", reverted.prev_value) r WHERE reverted.op IN ('U','D') ON CONFLICT ("id") DO UPDATE SET "from"=EXCLUDED."from", "to"=EXCLUDED."to";`,
+			},
+		},
+		{
+			name:  "composite key",
+			table: "balance",
+			expect: []string{
+				reverted("balance") + ` DELETE FROM "testschema"."balance" WHERE ("owner","token") IN (SELECT k."owner",k."token" FROM reverted, jsonb_populate_record(null::"testschema"."balance", reverted.pk) k WHERE reverted.op = 'I');`,
+				reverted("balance") + ` INSERT INTO "testschema"."balance" ("amount","owner","token") SELECT r."amount",r."owner",r."token" FROM reverted, jsonb_populate_record(null::"testschema"."balance", reverted.prev_value) r WHERE reverted.op IN ('U','D') ON CONFLICT ("owner","token") DO UPDATE SET "amount"=EXCLUDED."amount";`,
+			},
+		},
 	}
 
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := TestTables("testschema")[test.table]
+			deleteInserted, restoreChanged := postgresDialect{}.revertQueries("testschema", table, 9999)
+			assert.Equal(t, test.expect, []string{deleteInserted, restoreChanged})
+		})
+	}
+}
+
+func TestPostgresRevertTablesForeignKeys(t *testing.T) {
+	ctx := context.Background()
+	l, tx := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+
+	// Each balance references the transfer that last changed it
+	balance, xfer := l.tables["balance"], l.tables["xfer"]
+	balance.references = []string{xfer.identifier}
+
+	d := postgresDialect{}
+	require.NoError(t, d.revertTables(ctx, tx, l, []*TableInfo{balance, xfer}, 10))
+
+	deleteBalances, restoreBalances := d.revertQueries("testschema", balance, 10)
+	deleteXfers, restoreXfers := d.revertQueries("testschema", xfer, 10)
+	assert.Equal(t, []string{
+		deleteBalances,
+		deleteXfers,
+		restoreXfers,
+		restoreBalances,
+	}, tx.Results(), "referencing rows are deleted before the rows they reference, which are restored before them")
+}
+
+func TestSortByReferences(t *testing.T) {
+	table := func(name string, references ...string) *TableInfo {
+		return &TableInfo{name: name, identifier: name, references: references}
+	}
+	names := func(tables []*TableInfo) (out []string) {
+		for _, table := range tables {
+			out = append(out, table.name)
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"a", "b", "c"}, names(sortByReferences([]*TableInfo{table("a"), table("b"), table("c")})))
+	assert.Equal(t, []string{"c", "b", "a"}, names(sortByReferences([]*TableInfo{table("a", "b"), table("b", "c"), table("c")})))
+	assert.Equal(t, []string{"b", "a", "c"}, names(sortByReferences([]*TableInfo{table("a", "b", "unknown"), table("b"), table("c", "a")})))
+	assert.Equal(t, []string{"b", "a"}, names(sortByReferences([]*TableInfo{table("a", "b"), table("b", "a")})), "a cycle of references is broken at its first table")
+}
+
+func TestPrepareStatement(t *testing.T) {
+	blockNum := uint64(10)
+	table := mustNewTableInfo("testschema", "xfer", []string{"id", "idx"}, map[string]*ColumnInfo{
+		"id":   NewColumnInfo("id", "text", ""),
+		"idx":  NewColumnInfo("idx", "integer", int64(0)),
+		"from": NewColumnInfo("from", "text", ""),
+		"to":   NewColumnInfo("to", "text", ""),
+	})
+	primaryKey := map[string]string{"id": "1234", "idx": "3"}
+
 	tests := []struct {
 		name   string
-		row    row
-		expect string
+		op     *Operation
+		expect []string
 	}{
 		{
-			name: "rollback insert row",
-			row: row{
-				op:         "I",
-				table_name: `"testschema"."xfer"`,
-				pk:         `{"id":"2345"}`,
-				prev_value: "", // unused
+			name: "insert",
+			op:   &Operation{table: table, opType: OperationTypeInsert, primaryKey: primaryKey, data: map[string]string{"id": "1234", "idx": "3", "from": "sender'1"}},
+			expect: []string{
+				`INSERT INTO "testschema"."xfer" ("from","id","idx") VALUES ($1,$2,$3); -- [sender'1, 1234, 3]`,
+			},
+		},
+		{
+			name: "reversible insert",
+			op:   &Operation{table: table, opType: OperationTypeInsert, primaryKey: primaryKey, data: map[string]string{"id": "1234", "idx": "3"}, reversibleBlockNum: &blockNum},
+			expect: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234","idx":"3"}, 10]`,
+				`INSERT INTO "testschema"."xfer" ("id","idx") VALUES ($1,$2); -- [1234, 3]`,
 			},
-			expect: `DELETE FROM "testschema"."xfer" WHERE "id" = '2345';`,
 		},
 		{
-			name: "rollback delete row",
-			row: row{
-				op:         "D",
-				table_name: `"testschema"."xfer"`,
-				pk:         `{"id":"2345"}`,
-				prev_value: `{"id":"2345","sender":"0xdead","receiver":"0xbeef"}`,
+			name: "reversible update",
+			op:   &Operation{table: table, opType: OperationTypeUpdate, primaryKey: primaryKey, data: map[string]string{"from": "a", "to": "b"}, reversibleBlockNum: &blockNum},
+			expect: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("xfer"),$4::bigint FROM "testschema"."xfer" WHERE "id" = $5 AND "idx" = $6; -- [U, "testschema"."xfer", {"id":"1234","idx":"3"}, 10, 1234, 3]`,
+				`UPDATE "testschema"."xfer" SET "from"=$1, "to"=$2 WHERE "id" = $3 AND "idx" = $4 -- [a, b, 1234, 3]`,
 			},
-			expect: `INSERT INTO "testschema"."xfer" SELECT * FROM json_populate_record(null::"testschema"."xfer",` +
-				`'{"id":"2345","sender":"0xdead","receiver":"0xbeef"}');`,
 		},
 		{
-			name: "rollback update row",
-			row: row{
-				op:         "U",
-				table_name: `"testschema"."xfer"`,
-				pk:         `{"id":"2345"}`,
-				prev_value: `{"id":"2345","sender":"0xdead","receiver":"0xbeef"}`,
+			name: "delete",
+			op:   &Operation{table: table, opType: OperationTypeDelete, primaryKey: primaryKey},
+			expect: []string{
+				`DELETE FROM "testschema"."xfer" WHERE "id" = $1 AND "idx" = $2 -- [1234, 3]`,
 			},
-			expect: `UPDATE "testschema"."xfer" SET("id","receiver","sender")=((SELECT "id","receiver","sender" FROM json_populate_record(null::"testschema"."xfer",` +
-				`'{"id":"2345","sender":"0xdead","receiver":"0xbeef"}'))) WHERE "id" = '2345';`,
 		},
 	}
+
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
+			d := postgresDialect{}
 			tx := &TestTx{}
-			ctx := context.Background()
-			pd := postgresDialect{}
 
-			row := test.row
-			err := pd.revertOp(tx, ctx, row.op, row.table_name, row.pk, row.prev_value, 9999)
+			statements, err := d.prepareStatement("testschema", test.op)
+			require.NoError(t, err)
+
+			for _, stmt := range statements {
+				_, err := (*statementCache)(nil).exec(context.Background(), tx, stmt)
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, test.expect, tx.Results())
+		})
+	}
+}
+
+func TestInsertStatements(t *testing.T) {
+	blockNum := uint64(10)
+	table := mustNewTableInfo("testschema", "xfer", []string{"id"}, map[string]*ColumnInfo{
+		"id":   NewColumnInfo("id", "text", ""),
+		"from": NewColumnInfo("from", "text", ""),
+		"to":   NewColumnInfo("to", "text", ""),
+	})
+
+	insert := func(id string, reversible bool, fieldsAndValues ...string) *Operation {
+		data := map[string]string{"id": id}
+		for i := 0; i < len(fieldsAndValues); i += 2 {
+			data[fieldsAndValues[i]] = fieldsAndValues[i+1]
+		}
+
+		o := &Operation{table: table, opType: OperationTypeInsert, primaryKey: map[string]string{"id": id}, data: data}
+		if reversible {
+			o.reversibleBlockNum = &blockNum
+		}
+		return o
+	}
+
+	d := postgresDialect{}
+	statements, err := d.insertStatements("testschema", []*Operation{
+		insert("1", false, "from", "a", "to", "b"),
+		insert("2", true, "from", "c"),
+		insert("3", true, "from", "d", "to", "e"),
+	})
+	require.NoError(t, err)
+
+	tx := &TestTx{}
+	for _, stmt := range statements {
+		_, err := (*statementCache)(nil).exec(context.Background(), tx, stmt)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{
+		`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"3"}, 10]`,
+		`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3),($4,$5,$6); -- [a, 1, b, d, 3, e]`,
+		`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"2"}, 10]`,
+		`INSERT INTO "testschema"."xfer" ("from","id") VALUES ($1,$2); -- [c, 2]`,
+	}, tx.Results())
+}
+
+func TestMultiRowInsertChunking(t *testing.T) {
+	rows := func(count, columnCount int, value string) [][]any {
+		out := make([][]any, count)
+		for i := range out {
+			out[i] = make([]any, columnCount)
+			for j := range out[i] {
+				out[i][j] = value
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name          string
+		columnCount   int
+		rows          [][]any
+		expectChunks  []int
+		expectOneShot []bool
+	}{
+		{"single row", 3, rows(1, 3, "a"), []int{1}, []bool{false}},
+		{"max rows", 3, rows(2500, 3, "a"), []int{1000, 1000, 500}, []bool{false, false, true}},
+		{"bind parameters limit", 100, rows(1000, 100, "a"), []int{655, 345}, []bool{false, true}},
+		{"bytes limit", 1, rows(3, 1, strings.Repeat("a", postgresMaxInsertBytes/2)), []int{2, 1}, []bool{true, false}},
+		{"single row over bytes limit", 1, rows(2, 1, strings.Repeat("a", postgresMaxInsertBytes+1)), []int{1, 1}, []bool{false, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements := multiRowInsert("INSERT INTO t VALUES ", "", test.columnCount, test.rows)
+
+			chunks := make([]int, len(statements))
+			oneShots := make([]bool, len(statements))
+			for i, stmt := range statements {
+				require.LessOrEqual(t, len(stmt.args), postgresMaxBindParameters)
+				chunks[i] = len(stmt.args) / test.columnCount
+				oneShots[i] = stmt.oneShot
+			}
+
+			assert.Equal(t, test.expectChunks, chunks)
+			assert.Equal(t, test.expectOneShot, oneShots)
+		})
+	}
+}
+
+func TestCanCopy(t *testing.T) {
+	blockNum := uint64(10)
+	table := mustNewTableInfo("testschema", "xfer", []string{"id"}, map[string]*ColumnInfo{
+		"id": NewColumnInfo("id", "text", ""),
+	})
+
+	operations := func(ops ...*Operation) []*Operation {
+		return ops
+	}
+
+	insert := &Operation{table: table, opType: OperationTypeInsert, primaryKey: map[string]string{"id": "1"}}
+	reversibleInsert := &Operation{table: table, opType: OperationTypeInsert, primaryKey: map[string]string{"id": "2"}, reversibleBlockNum: &blockNum}
+	update := &Operation{table: table, opType: OperationTypeUpdate, primaryKey: map[string]string{"id": "3"}}
+
+	assert.True(t, canCopy(&TestTx{}, operations(insert)))
+	assert.False(t, canCopy(&TestTx{}, operations()))
+	assert.False(t, canCopy(&TestTx{}, operations(insert, reversibleInsert)))
+	assert.False(t, canCopy(&TestTx{}, operations(insert, update)))
+}
+
+func TestOnConflictClause(t *testing.T) {
+	table := mustNewTableInfo("testschema", "pool_tick", []string{"pool", "tick"}, map[string]*ColumnInfo{
+		"pool":      NewColumnInfo("pool", "text", ""),
+		"tick":      NewColumnInfo("tick", "integer", int64(0)),
+		"liquidity": NewColumnInfo("liquidity", "numeric", ""),
+	})
+
+	assert.Equal(t, `ON CONFLICT ("pool","tick") DO UPDATE SET "liquidity"=EXCLUDED."liquidity"`, onConflictClause(table, []string{`"liquidity"`, `"pool"`, `"tick"`}))
+	assert.Equal(t, `ON CONFLICT ("pool","tick") DO NOTHING`, onConflictClause(table, []string{`"pool"`, `"tick"`}))
+}
+
+func TestParsePostgresPartitionBound(t *testing.T) {
+	tests := []struct {
+		bound       string
+		expectFrom  uint64
+		expectTo    uint64
+		expectFound bool
+		expectError bool
+	}{
+		{bound: "FOR VALUES FROM (0) TO (1000000)", expectTo: 1000000, expectFound: true},
+		{bound: "FOR VALUES FROM ('1000000') TO ('2000000')", expectFrom: 1000000, expectTo: 2000000, expectFound: true},
+		{bound: "FOR VALUES FROM (MINVALUE) TO (10)", expectTo: 10, expectFound: true},
+		{bound: "FOR VALUES FROM (10) TO (MAXVALUE)", expectFrom: 10, expectTo: math.MaxUint64, expectFound: true},
+		{bound: "DEFAULT"},
+		{bound: "FOR VALUES IN (1, 2)", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bound, func(t *testing.T) {
+			from, to, found, err := parsePostgresPartitionBound(test.bound)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+
 			require.NoError(t, err)
-			assert.Equal(t, []string{test.expect}, tx.Results())
+			assert.Equal(t, test.expectFound, found)
+			assert.Equal(t, test.expectFrom, from)
+			assert.Equal(t, test.expectTo, to)
 		})
 	}
+}
+
+func TestPostgresPartitions(t *testing.T) {
+	ctx := context.Background()
+	l, tx := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+	l.partitions = partitionOptions{size: 100, ahead: 1, retained: 1}
+
+	xfer := l.tables["xfer"]
+	xfer.partitioning = &postgresPartitioning{column: "block_num", partitions: []postgresPartition{{name: "xfer_p0", from: 0, to: 100}}}
+
+	d := postgresDialect{}
+	require.NoError(t, d.createPartitions(ctx, tx, l, flushRange{start: 50, stop: 150}))
+	require.NoError(t, d.createPartitions(ctx, tx, l, flushRange{start: 151, stop: 199}), "partitions are already created")
+	require.NoError(t, d.detachPartitions(ctx, tx, l, 198))
+	require.NoError(t, d.detachPartitions(ctx, tx, l, 199))
+
+	assert.Equal(t, []string{
+		`CREATE TABLE IF NOT EXISTS "testschema"."xfer_p100" PARTITION OF "testschema"."xfer" FOR VALUES FROM (100) TO (200)`,
+		`CREATE TABLE IF NOT EXISTS "testschema"."xfer_p200" PARTITION OF "testschema"."xfer" FOR VALUES FROM (200) TO (300)`,
+		`ALTER TABLE "testschema"."xfer" DETACH PARTITION "testschema"."xfer_p0"`,
+	}, tx.Results(), "the partition holding block 199 is detached once a more recent one is final")
+	assert.Equal(t, []postgresPartition{{name: "xfer_p100", from: 100, to: 200}, {name: "xfer_p200", from: 200, to: 300}}, xfer.partitioning.partitions)
+
+	l, tx = NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+	l.partitions = defaultPartitionOptions
+	l.tables["xfer"].partitioning = &postgresPartitioning{column: "block_num"}
+
+	require.NoError(t, d.createPartitions(ctx, tx, l, flushRange{start: 18_000_001, stop: 18_000_100}))
+	require.NoError(t, d.detachPartitions(ctx, tx, l, 18_000_100))
+	assert.Equal(t, []string{
+		`CREATE TABLE IF NOT EXISTS "testschema"."xfer_p18000000" PARTITION OF "testschema"."xfer" FOR VALUES FROM (18000000) TO (19000000)`,
+		`CREATE TABLE IF NOT EXISTS "testschema"."xfer_p19000000" PARTITION OF "testschema"."xfer" FOR VALUES FROM (19000000) TO (20000000)`,
+		`CREATE TABLE IF NOT EXISTS "testschema"."xfer_p20000000" PARTITION OF "testschema"."xfer" FOR VALUES FROM (20000000) TO (21000000)`,
+	}, tx.Results(), "the first partition holds the start block and partitions are never detached by default")
+}
+
+func TestPostgresPartitionsFirstFlush(t *testing.T) {
+	ctx := context.Background()
+	tables := TestTables("testschema")
+	tables["xfer"] = mustNewTableInfo("testschema", "xfer", []string{"id"}, map[string]*ColumnInfo{
+		"id":        NewColumnInfo("id", "text", ""),
+		"block_num": NewColumnInfo("block_num", "int8", ""),
+	})
+	l, tx := NewTestLoader(zlog, tracer, "testschema", tables)
+	l.partitions = partitionOptions{size: 100}
+
+	xfer := l.tables["xfer"]
+	xfer.partitioning = &postgresPartitioning{column: "block_num"}
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"block_num": "1150"}, nil))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"block_num": "1099"}, nil))
+
+	tx.commitErr = errors.New("connection lost")
+	_, err := l.Flush(ctx, "abc", finalCursor(1150), 1150)
+	require.ErrorContains(t, err, "connection lost")
+	assert.Empty(t, xfer.partitioning.partitions, "the partitions of a failed flush are not kept")
+
+	tx.commitErr = nil
+	_, err = l.Flush(ctx, "abc", finalCursor(1150), 1150)
+	require.NoError(t, err)
+
+	assert.Equal(t, []postgresPartition{{name: "xfer_p1000", from: 1000, to: 1100}, {name: "xfer_p1100", from: 1100, to: 1200}}, xfer.partitioning.partitions, "without a cursor, the first partition holds the first flushed block")
+}
+
+func TestPostgresPendingTables(t *testing.T) {
+	ctx := context.Background()
+	l, tx := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+	l.pendingTables = true
+	blockNum := func(num uint64) *uint64 { return &num }
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, nil))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"from": "b"}, blockNum(10)))
+	require.NoError(t, l.Update("xfer", map[string]string{"id": "2"}, map[string]string{"to": "c"}, blockNum(11)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "alice", "token": "eth"}, map[string]string{"amount": "100"}, blockNum(11)))
+	require.NoError(t, l.Delete("xfer", map[string]string{"id": "1"}, blockNum(12)))
+
+	d := postgresDialect{}
+	_, err := d.Flush(tx, ctx, l, l.entries, "abc", 10)
+	require.NoError(t, err)
+	require.NoError(t, d.Revert(tx, ctx, l, 11))
+
+	assert.Equal(t, []string{
+		`DELETE FROM "testschema"."balance_pending" WHERE "block_num" <= 10 RETURNING id, op, pk, data`,
+		`DELETE FROM "testschema"."xfer_pending" WHERE "block_num" <= 10 RETURNING id, op, pk, data`,
+		`COPY "testschema"."xfer" ("from","id") FROM STDIN -- [a, 1] [b, 2]`,
+		`INSERT INTO "testschema"."xfer_pending" (op,pk,data,row_value,block_num) VALUES ($1::text,$2::jsonb,NULL,NULL,$3::bigint); -- [DELETE, {"id":"1"}, 12]`,
+		`INSERT INTO "testschema"."xfer_pending" (op,pk,data,row_value,block_num) SELECT $1::text,$2::jsonb,$3::jsonb,CASE WHEN latest.op IS NULL THEN (SELECT to_jsonb(t) FROM "testschema"."xfer" t WHERE "id" = $5) WHEN latest.op <> 'DELETE' THEN latest.row_value END || $3::jsonb,$4::bigint FROM (SELECT 1) AS one LEFT JOIN LATERAL (SELECT op, row_value FROM "testschema"."xfer_pending" WHERE pk = $2::jsonb ORDER BY id DESC LIMIT 1) AS latest ON true; -- [UPDATE, {"id":"2"}, {"to":"c"}, 11, 2]`,
+		`INSERT INTO "testschema"."balance_pending" (op,pk,data,row_value,block_num) SELECT $1::text,$2::jsonb,$3::jsonb,COALESCE(CASE WHEN latest.op IS NULL THEN (SELECT to_jsonb(t) FROM "testschema"."balance" t WHERE "owner" = $5 AND "token" = $6) WHEN latest.op <> 'DELETE' THEN latest.row_value END, '{}'::jsonb) || $3::jsonb,$4::bigint FROM (SELECT 1) AS one LEFT JOIN LATERAL (SELECT op, row_value FROM "testschema"."balance_pending" WHERE pk = $2::jsonb ORDER BY id DESC LIMIT 1) AS latest ON true; -- [UPSERT, {"owner":"alice","token":"eth"}, {"amount":"100","owner":"alice","token":"eth"}, 11, alice, eth]`,
+		`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 10 LIMIT 10000);`,
+		`DELETE FROM "testschema"."balance_pending" WHERE "block_num" > 11;`,
+		`DELETE FROM "testschema"."xfer_pending" WHERE "block_num" > 11;`,
+		`SELECT DISTINCT table_name FROM "testschema"."substreams_history" WHERE "block_num" > 11 ORDER BY table_name`,
+		`DELETE FROM "testschema"."substreams_history" WHERE "block_num" > 11;`,
+	}, tx.Results(), "operations of reversible blocks up to the final one are applied, the ones after it are recorded in the pending tables")
+}
+
+func TestCreatePendingTableQuery(t *testing.T) {
+	query := postgresDialect{}.createPendingTableQuery("testschema", TestTables("testschema")["balance"], true)
 
+	assert.Contains(t, query, `create table if not exists "testschema"."balance_pending"`)
+	assert.Contains(t, query, `create or replace view "testschema"."balance_head" as
+	select t.* from "testschema"."balance" t where (t."owner",t."token") not in (select k."owner",k."token" from "testschema"."balance_pending" p, jsonb_populate_record(null::"testschema"."balance", p.pk) k)
+	union all
+	select r.* from (select distinct on (pk) row_value from "testschema"."balance_pending" order by pk, id desc) p, jsonb_populate_record(null::"testschema"."balance", p.row_value) r where p.row_value is not null;`)
+	assert.True(t, strings.HasSuffix(query, `COMMENT ON TABLE "testschema"."balance_pending" IS E'@omit';`))
 }
@@ -0,0 +1,438 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/streamingfast/cli"
+	sink "github.com/streamingfast/substreams-sink"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+)
+
+// sqliteMaxBindParameters is the default maximum amount of bind parameters accepted by
+// SQLite in a single statement (`SQLITE_MAX_VARIABLE_NUMBER` since SQLite 3.32.0).
+const sqliteMaxBindParameters = 32766
+
+// sqliteDialect handles SQLite databases, reorgs are supported by recording the previous value
+// of rows as JSON in the history table using SQLite JSON functions (`json_object` to save a row,
+// `json_extract` to restore it), BLOB columns cannot be represented in JSON and are thus not
+// supported in reversible segments.
+//
+// Statements are executed directly within the transaction, the statement cache prepares
+// statements on the connection pool which is limited to the single connection already held
+// by the transaction.
+type sqliteDialect struct{}
+
+// Revert undoes the operations recorded in the history one by one, see revertFromHistory.
+func (d sqliteDialect) Revert(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64) error {
+	return revertFromHistory(tx, ctx, l, lastValidFinalBlock,
+		fmt.Sprintf(`SELECT op,table_name,pk,prev_value,block_num FROM %s WHERE "block_num" > %d ORDER BY "block_num" DESC, "id" DESC`, d.historyTable(l.schema), lastValidFinalBlock),
+		fmt.Sprintf(`DELETE FROM %s WHERE "block_num" > %d;`, d.historyTable(l.schema), lastValidFinalBlock),
+		d.revertOp,
+	)
+}
+
+// revertOp restores the row as it was before the operation, `prev_value` holds the row's
+// columns as a JSON object, each column is extracted from it with `json_extract`.
+func (d sqliteDialect) revertOp(tx Tx, ctx context.Context, op, escaped_table_name, pk, prev_value string) error {
+	pkmap := make(map[string]string)
+	if err := json.Unmarshal([]byte(pk), &pkmap); err != nil {
+		return fmt.Errorf("revertOp: unmarshalling %q: %w", pk, err)
+	}
+
+	var stmt *statement
+	switch op {
+	case "I":
+		stmt = newStatement(fmt.Sprintf(`DELETE FROM %s WHERE %s;`,
+			escaped_table_name,
+			getPrimaryKeyWhereClause(pkmap),
+		))
+
+	case "D":
+		columns, err := jsonObjectKeys(prev_value)
+		if err != nil {
+			return err
+		}
+
+		escapedColumns := make([]string, len(columns))
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			escapedColumns[i] = EscapeIdentifier(column)
+			values[i] = d.jsonExtract(column)
+		}
+
+		stmt = newStatement(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s);`,
+			escaped_table_name,
+			strings.Join(escapedColumns, ","),
+			strings.Join(values, ","),
+		), prev_value)
+
+	case "U":
+		columns, err := jsonObjectKeys(prev_value)
+		if err != nil {
+			return err
+		}
+
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = EscapeIdentifier(column) + "=" + d.jsonExtract(column)
+		}
+
+		stmt = newStatement(fmt.Sprintf(`UPDATE %s SET %s WHERE %s;`,
+			escaped_table_name,
+			strings.Join(updates, ", "),
+			getPrimaryKeyWhereClause(pkmap),
+		), prev_value)
+
+	default:
+		panic("invalid op in revert command")
+	}
+
+	if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+		return fmt.Errorf("executing revert query %q: %w", stmt.query, err)
+	}
+	return nil
+}
+
+// jsonExtract returns the expression extracting `column` from the JSON object bound as the
+// first parameter of the statement.
+func (d sqliteDialect) jsonExtract(column string) string {
+	return "json_extract(?1," + escapeStringValue(`$."`+column+`"`) + ")"
+}
+
+func (d sqliteDialect) Flush(tx Tx, ctx context.Context, l *Loader, entries *PendingOperations, outputModuleHash string, lastFinalBlock uint64) (int, error) {
+	rowCount, err := l.flushByGeneration(entries, func(tableName string, operations []*Operation) error {
+		if err := d.flushOperations(ctx, tx, l, operations); err != nil {
+			return fmt.Errorf("flushing table %q: %w", tableName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.pruneReversibleSegment(tx, ctx, l.schema, lastFinalBlock); err != nil {
+		return 0, err
+	}
+
+	return rowCount, nil
+}
+
+// flushOperations applies operations of a single table, each for a different row.
+func (d sqliteDialect) flushOperations(ctx context.Context, tx Tx, l *Loader, operations []*Operation) error {
+	var statements []*statement
+	var inserts []*Operation
+	for _, operation := range operations {
+		if operation.opType == OperationTypeInsert || operation.opType == OperationTypeUpsert {
+			inserts = append(inserts, operation)
+			continue
+		}
+
+		operationStatements, err := d.prepareStatement(l.schema, operation)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		statements = append(statements, operationStatements...)
+	}
+
+	if len(inserts) > 0 {
+		insertStatements, err := d.insertStatements(l.schema, inserts)
+		if err != nil {
+			return fmt.Errorf("preparing inserts: %w", err)
+		}
+		statements = append(statements, insertStatements...)
+	}
+
+	for _, stmt := range statements {
+		if l.tracer.Enabled() {
+			l.logger.Debug("adding query to transaction", zap.String("query", stmt.query), zap.Int("arg_count", len(stmt.args)))
+		}
+
+		if _, err := tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("executing query %q: %w", stmt.query, err)
+		}
+	}
+
+	return nil
+}
+
+// insertStatements returns the statements to apply the insert (or upsert) operations grouped
+// per operation type and column set, history rows come first followed by the data rows.
+func (d sqliteDialect) insertStatements(schema string, operations []*Operation) ([]*statement, error) {
+	groups, err := groupInserts(operations, d.normalizeValueType)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []*statement
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		group := pair.Value
+		prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", group.table.identifier, strings.Join(group.columns, ","))
+
+		switch group.opType {
+		case OperationTypeInsert:
+			if len(group.reversible) > 0 {
+				history := make([][]any, len(group.reversible))
+				for i, o := range group.reversible {
+					history[i] = []any{"I", o.table.identifier, primaryKeyToJSON(o.primaryKey), *o.reversibleBlockNum}
+				}
+
+				statements = append(statements, positionalMultiRowInsert(
+					fmt.Sprintf("INSERT INTO %s (op,table_name,pk,block_num) VALUES ", d.historyTable(schema)),
+					"",
+					4,
+					history,
+					sqliteMaxBindParameters,
+					0,
+				)...)
+			}
+
+			statements = append(statements, positionalMultiRowInsert(prefix, "", len(group.columns), group.rows, sqliteMaxBindParameters, 0)...)
+
+		case OperationTypeUpsert:
+			for _, o := range group.reversible {
+				statements = append(statements, d.saveUpsert(schema, o.table, o.primaryKey, *o.reversibleBlockNum))
+			}
+
+			statements = append(statements, positionalMultiRowInsert(prefix, " "+onConflictClause(group.table, group.columns), len(group.columns), group.rows, sqliteMaxBindParameters, 0)...)
+
+		default:
+			panic(fmt.Errorf("unexpected operation type %q in insert group", group.opType))
+		}
+	}
+
+	return statements, nil
+}
+
+// prepareStatement returns the statement(s) required to apply an update or delete operation,
+// when the operation is reversible, the history statement is returned first and must be executed
+// before the actual operation statement.
+func (d sqliteDialect) prepareStatement(schema string, o *Operation) ([]*statement, error) {
+	// A table without a primary key set yield a `primaryKey` map with a single entry where the key is an empty string
+	if _, found := o.primaryKey[""]; found {
+		return nil, fmt.Errorf("trying to perform %s operation but table %q don't have a primary key set, this is not accepted", o.opType, o.table.name)
+	}
+
+	switch o.opType {
+	case OperationTypeUpdate:
+		columns, values, err := prepareColValues(o.table, o.data, d.normalizeValueType)
+		if err != nil {
+			return nil, fmt.Errorf("preparing column & values: %w", err)
+		}
+
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			updates[i] = column + "=?"
+		}
+
+		primaryKeySelector, primaryKeyArgs := positionalPrimaryKeyWhereClause(o.primaryKey, EscapeIdentifier)
+		updateQuery := newStatement(fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+			o.table.identifier,
+			strings.Join(updates, ", "),
+			primaryKeySelector,
+		), append(values, primaryKeyArgs...)...)
+
+		if o.reversibleBlockNum != nil {
+			return []*statement{d.saveRow("U", schema, o.table, o.primaryKey, *o.reversibleBlockNum), updateQuery}, nil
+		}
+		return []*statement{updateQuery}, nil
+
+	case OperationTypeDelete:
+		primaryKeySelector, primaryKeyArgs := positionalPrimaryKeyWhereClause(o.primaryKey, EscapeIdentifier)
+		deleteQuery := newStatement(fmt.Sprintf("DELETE FROM %s WHERE %s",
+			o.table.identifier,
+			primaryKeySelector,
+		), primaryKeyArgs...)
+
+		if o.reversibleBlockNum != nil {
+			return []*statement{d.saveRow("D", schema, o.table, o.primaryKey, *o.reversibleBlockNum), deleteQuery}, nil
+		}
+		return []*statement{deleteQuery}, nil
+
+	default:
+		panic(fmt.Errorf("unexpected operation type %q", o.opType))
+	}
+}
+
+func (d sqliteDialect) saveRow(op, schema string, table *TableInfo, primaryKey map[string]string, blockNum uint64) *statement {
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(primaryKey, EscapeIdentifier)
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT ?,?,?,%s,? FROM %s WHERE %s;`,
+		d.historyTable(schema),
+		d.rowToJSON(table),
+		table.identifier,
+		whereClause,
+	), append([]any{op, table.identifier, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
+}
+
+// saveUpsert records the history of an upsert, since it's only known by the database if the
+// row exists, the recorded operation is an insert ('I') when the row does not exist yet and
+// an update ('U') holding the previous value otherwise.
+func (d sqliteDialect) saveUpsert(schema string, table *TableInfo, primaryKey map[string]string, blockNum uint64) *statement {
+	whereClause, whereArgs := positionalPrimaryKeyWhereClause(primaryKey, EscapeIdentifier)
+
+	return newStatement(fmt.Sprintf(`INSERT INTO %s (op,table_name,pk,prev_value,block_num) SELECT CASE WHEN prev IS NULL THEN 'I' ELSE 'U' END,?,?,prev,? FROM (SELECT (SELECT %s FROM %s WHERE %s) AS prev);`,
+		d.historyTable(schema),
+		d.rowToJSON(table),
+		table.identifier,
+		whereClause,
+	), append([]any{table.identifier, primaryKeyToJSON(primaryKey), blockNum}, whereArgs...)...)
+}
+
+// rowToJSON returns the `json_object(...)` expression holding all the columns of the table,
+// the SQLite equivalent of Postgres `row_to_json`.
+func (d sqliteDialect) rowToJSON(table *TableInfo) string {
+	columns := maps.Keys(table.columnsByName)
+	sort.Strings(columns)
+
+	pairs := make([]string, len(columns))
+	for i, column := range columns {
+		pairs[i] = escapeStringValue(column) + "," + table.columnsByName[column].escapedName
+	}
+
+	return "json_object(" + strings.Join(pairs, ",") + ")"
+}
+
+func (d sqliteDialect) pruneReversibleSegment(tx Tx, ctx context.Context, schema string, highestFinalBlock uint64) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE block_num <= %d;`, d.historyTable(schema), highestFinalBlock)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("executing prune query %q: %w", query, err)
+	}
+	return nil
+}
+
+// Format based on type, value returned is meant to be used as a bind parameter. SQLite
+// converts textual values according to the column's type affinity, except for booleans
+// and timestamps which have no storage class of their own.
+func (d sqliteDialect) normalizeValueType(value string, valueType reflect.Type) (any, error) {
+	switch valueType.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, nil
+		}
+
+		return value, nil
+
+	case reflect.Struct:
+		if valueType == reflectTypeTime {
+			if integerRegex.MatchString(value) {
+				i, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return "", fmt.Errorf("could not convert %s to int: %w", value, err)
+				}
+
+				return time.Unix(i, 0).UTC(), nil
+			}
+
+			return value, nil
+		}
+
+		return "", fmt.Errorf("unsupported struct type %s", valueType)
+
+	default:
+		return value, nil
+	}
+}
+
+func (d sqliteDialect) GetCreateCursorQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id         text not null constraint %s primary key,
+			cursor     text,
+			block_num  bigint,
+			block_id   text
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(CURSORS_TABLE), EscapeIdentifier(CURSORS_TABLE+"_pk"))
+}
+
+func (d sqliteDialect) GetCreateHistoryQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s
+		(
+			id           integer primary key,
+			op           char,
+			table_name   text,
+			pk           text,
+			prev_value   text,
+			block_num    bigint
+		);
+		`), d.historyTable(schema))
+}
+
+func (d sqliteDialect) GetCreateCompletionsQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id           text not null constraint %s primary key,
+			block_num    bigint,
+			block_id     text,
+			completed_at timestamp default current_timestamp
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(COMPLETIONS_TABLE), EscapeIdentifier(COMPLETIONS_TABLE+"_pk"))
+}
+
+func (d sqliteDialect) createReorgsQuery(schema string, withPostgraphile bool) string {
+	return fmt.Sprintf(cli.Dedent(`
+		create table if not exists %s.%s
+		(
+			id               integer primary key,
+			module_hash      text,
+			last_valid_block bigint,
+			cursor_before    text,
+			cursor_after     text,
+			reverted_rows    text,
+			duration_ms      bigint,
+			reverted_at      timestamp default current_timestamp
+		);
+		`), EscapeIdentifier(schema), EscapeIdentifier(REORGS_TABLE))
+}
+
+func (d sqliteDialect) ExecuteSetupScript(ctx context.Context, l *Loader, schemaSql string) error {
+	if _, err := l.ExecContext(ctx, schemaSql); err != nil {
+		return fmt.Errorf("exec schema: %w", err)
+	}
+	return nil
+}
+
+func (d sqliteDialect) GetUpdateCursorQuery(table, moduleHash string, cursor *sink.Cursor, block_num uint64, block_id string) string {
+	return query(`
+		UPDATE %s set cursor = '%s', block_num = %d, block_id = '%s' WHERE id = '%s';
+	`, table, cursor, block_num, block_id, moduleHash)
+}
+
+func (d sqliteDialect) GetMarkCompletedQuery(table, moduleHash string, block_num uint64, block_id string) string {
+	return query(`
+		INSERT INTO %s (id, block_num, block_id, completed_at) VALUES ('%s', %d, '%s', current_timestamp)
+		ON CONFLICT (id) DO UPDATE SET block_num = EXCLUDED.block_num, block_id = EXCLUDED.block_id, completed_at = EXCLUDED.completed_at;
+	`, table, moduleHash, block_num, block_id)
+}
+
+func (d sqliteDialect) DriverSupportRowsAffected() bool {
+	return true
+}
+
+func (d sqliteDialect) EscapeIdentifier(valueToEscape string) string {
+	return EscapeIdentifier(valueToEscape)
+}
+
+func (d sqliteDialect) OnlyInserts() bool {
+	return false
+}
+
+func (d sqliteDialect) CreateUser(tx Tx, ctx context.Context, l *Loader, username string, password string, database string, readOnly bool) error {
+	return fmt.Errorf("sqlite does not support users, access is controlled by the database file permissions")
+}
+
+func (d sqliteDialect) historyTable(schema string) string {
+	return fmt.Sprintf("%s.%s", EscapeIdentifier(schema), EscapeIdentifier(HISTORY_TABLE))
+}
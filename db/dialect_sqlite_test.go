@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sqliteTestSchema = `
+	create table xfer (id text primary key, "from" text, amount numeric, at timestamp);
+	create table balance (owner text, token text, amount integer, frozen boolean, primary key (owner, token));
+`
+
+func newSQLiteTestLoader(t *testing.T) *Loader {
+	t.Helper()
+
+	ctx := context.Background()
+	l, err := NewLoader("sqlite://"+filepath.Join(t.TempDir(), "test.db"), OnModuleHashMismatchIgnore, nil, zlog, tracer)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	require.NoError(t, l.Setup(ctx, sqliteTestSchema, false))
+	require.NoError(t, l.LoadTables())
+	require.NoError(t, l.InsertCursor(ctx, "abc", sink.NewBlankCursor()))
+
+	return l
+}
+
+func TestSQLiteFlushAndRevert(t *testing.T) {
+	ctx := context.Background()
+	l := newSQLiteTestLoader(t)
+	blockNum := func(num uint64) *uint64 { return &num }
+
+	flush := func(lastFinalBlock uint64) {
+		t.Helper()
+		_, err := l.Flush(ctx, "abc", sink.NewBlankCursor(), lastFinalBlock)
+		require.NoError(t, err)
+	}
+
+	// Irreversible block, not recorded in history
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "0"}, map[string]string{"from": "genesis", "amount": "1", "at": "1700000000"}, nil))
+	flush(5)
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a", "amount": "10", "at": "2023-11-14 22:13:21"}, blockNum(10)))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"from": "b", "amount": "20"}, blockNum(10)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "alice", "token": "eth"}, map[string]string{"amount": "100", "frozen": "false"}, blockNum(10)))
+	flush(5)
+
+	require.NoError(t, l.Update("xfer", map[string]string{"id": "1"}, map[string]string{"from": "c"}, blockNum(11)))
+	require.NoError(t, l.Delete("xfer", map[string]string{"id": "2"}, blockNum(11)))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "3"}, map[string]string{"from": "d", "amount": "30"}, blockNum(11)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "alice", "token": "eth"}, map[string]string{"amount": "150", "frozen": "true"}, blockNum(11)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "bob", "token": "eth"}, map[string]string{"amount": "5", "frozen": "false"}, blockNum(11)))
+	flush(5)
+
+	assert.Equal(t, []string{
+		"0|genesis|1|1700000000",
+		"1|c|10|1700000001",
+		"3|d|30|<nil>",
+	}, sqliteRows(t, l, `SELECT id, "from", amount, strftime('%s', at) FROM xfer ORDER BY id`))
+	assert.Equal(t, []string{
+		"alice|eth|150|true",
+		"bob|eth|5|false",
+	}, sqliteRows(t, l, `SELECT owner, token, amount, frozen FROM balance ORDER BY owner`))
+	assert.Equal(t, []string{
+		"I|10", "I|10", "I|10",
+		"U|11", "D|11", "I|11", "U|11", "I|11",
+	}, sqliteRows(t, l, `SELECT op, block_num FROM substreams_history ORDER BY id`))
+
+	require.NoError(t, l.Revert(ctx, "abc", sink.NewBlankCursor(), 10))
+
+	assert.Equal(t, []string{
+		"0|genesis|1|1700000000",
+		"1|a|10|1700000001",
+		"2|b|20|<nil>",
+	}, sqliteRows(t, l, `SELECT id, "from", amount, strftime('%s', at) FROM xfer ORDER BY id`))
+	assert.Equal(t, []string{
+		"alice|eth|100|false",
+	}, sqliteRows(t, l, `SELECT owner, token, amount, frozen FROM balance ORDER BY owner`))
+
+	require.NoError(t, l.Revert(ctx, "abc", sink.NewBlankCursor(), 5))
+
+	assert.Equal(t, []string{
+		"0|genesis|1|1700000000",
+	}, sqliteRows(t, l, `SELECT id, "from", amount, strftime('%s', at) FROM xfer ORDER BY id`))
+	assert.Empty(t, sqliteRows(t, l, `SELECT owner FROM balance`))
+	assert.Empty(t, sqliteRows(t, l, `SELECT op FROM substreams_history`))
+
+	assert.Equal(t, []string{
+		`abc|10|{"balance":2,"xfer":3}`,
+		`abc|5|{"balance":1,"xfer":2}`,
+	}, sqliteRows(t, l, `SELECT module_hash, last_valid_block, reverted_rows FROM substreams_reorgs ORDER BY id`))
+}
+
+func TestSQLitePruneHistory(t *testing.T) {
+	ctx := context.Background()
+	l := newSQLiteTestLoader(t)
+	blockNum := func(num uint64) *uint64 { return &num }
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, blockNum(10)))
+	_, err := l.Flush(ctx, "abc", sink.NewBlankCursor(), 5)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"from": "b"}, blockNum(11)))
+	_, err = l.Flush(ctx, "abc", sink.NewBlankCursor(), 10)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"I|11"}, sqliteRows(t, l, `SELECT op, block_num FROM substreams_history ORDER BY id`))
+}
+
+func TestSQLiteCloseStatements(t *testing.T) {
+	ctx := context.Background()
+	l := newSQLiteTestLoader(t)
+
+	_, err := l.statements.get(ctx, `INSERT INTO xfer (id) VALUES (?)`)
+	require.NoError(t, err)
+	require.Len(t, l.statements.stmts, 1)
+
+	require.NoError(t, l.Close())
+	assert.Empty(t, l.statements.stmts)
+}
+
+func TestSQLiteMarkCompleted(t *testing.T) {
+	ctx := context.Background()
+	l := newSQLiteTestLoader(t)
+
+	require.NoError(t, l.MarkCompleted(ctx, "abc", sink.NewBlankCursor()))
+	require.NoError(t, l.MarkCompleted(ctx, "abc", sink.NewBlankCursor()))
+
+	assert.Equal(t, []string{"abc|0"}, sqliteRows(t, l, `SELECT id, block_num FROM substreams_completions`))
+}
+
+// sqliteRows returns the rows of the query, each rendered with its columns separated by '|'.
+func sqliteRows(t *testing.T, l *Loader, query string) (out []string) {
+	t.Helper()
+
+	rows, err := l.Query(query)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	require.NoError(t, err)
+
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		require.NoError(t, rows.Scan(pointers...))
+
+		rendered := make([]string, len(values))
+		for i, value := range values {
+			if bytes, ok := value.([]byte); ok {
+				value = string(bytes)
+			}
+			rendered[i] = fmt.Sprintf("%v", value)
+		}
+		out = append(out, strings.Join(rendered, "|"))
+	}
+	require.NoError(t, rows.Err())
+
+	return out
+}
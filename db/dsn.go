@@ -12,6 +12,7 @@ import (
 )
 
 type DSN struct {
+	scheme   string
 	driver   string
 	original string
 
@@ -22,12 +23,27 @@ type DSN struct {
 	database string
 	schema   string
 	options  []string
+
+	partitions partitionOptions
+
+	// historyPruneInterval is set by the `history_prune_interval` option of Postgres DSNs.
+	historyPruneInterval uint64
+
+	// pendingTables is set by the `pending_tables` option of Postgres DSNs.
+	pendingTables bool
+
+	// clickhouseCluster is the cluster set by the `cluster` option of ClickHouse DSNs.
+	clickhouseCluster string
 }
 
+// driverMap maps the DSN schemes to the database/sql driver to use, see RegisterDialect.
 var driverMap = map[string]string{
 	"psql":       "postgres",
 	"postgres":   "postgres",
 	"clickhouse": "clickhouse",
+	"sqlite":     "sqlite3",
+	"mysql":      "mysql",
+	"duckdb":     "duckdb",
 }
 
 func ParseDSN(dsn string) (*DSN, error) {
@@ -56,6 +72,9 @@ func ParseDSN(dsn string) (*DSN, error) {
 	host := dsnURL.Hostname()
 
 	port := int64(5432)
+	if driver == "mysql" {
+		port = 3306
+	}
 	if strings.Contains(dsnURL.Host, ":") {
 		port, _ = strconv.ParseInt(dsnURL.Port(), 10, 32)
 	}
@@ -73,6 +92,7 @@ func ParseDSN(dsn string) (*DSN, error) {
 
 	d := &DSN{
 		original: dsn,
+		scheme:   dsnURL.Scheme,
 		driver:   driver,
 		host:     host,
 		port:     port,
@@ -80,38 +100,163 @@ func ParseDSN(dsn string) (*DSN, error) {
 		password: password,
 		database: database,
 		schema:   "public",
+
+		partitions:           defaultPartitionOptions,
+		historyPruneInterval: defaultHistoryPruneInterval,
 	}
 
-	if driver == "clickhouse" {
+	if driver == "clickhouse" || driver == "mysql" {
 		d.schema = database
 	}
 
-	options := make([]string, len(query))
-	for i, key := range keys {
+	if driver == "sqlite3" || driver == "duckdb" {
+		// The database is a file path, either relative (`sqlite://./data.db`), absolute
+		// (`sqlite:///var/data.db`) or in memory (`sqlite://:memory:`), DuckDB paths
+		// follow the same rules.
+		d.database = dsnURL.Host + dsnURL.Path
+		d.host = ""
+		d.port = 0
+		d.schema = "main"
+	}
+
+	var options []string
+	for _, key := range keys {
 		if key == "schema" {
 			d.schema = query[key][0]
 			continue
 		}
 
-		options[i] = fmt.Sprintf("%s=%s", key, strings.Join(query[key], ","))
+		if key == "cluster" && driver == "clickhouse" {
+			d.clickhouseCluster = query[key][0]
+			continue
+		}
+
+		if key == "history_prune_interval" && driver == "postgres" {
+			value, err := strconv.ParseUint(query[key][0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s option %q: %w", key, query[key][0], err)
+			}
+			d.historyPruneInterval = value
+			continue
+		}
+
+		if key == "pending_tables" && driver == "postgres" {
+			value, err := strconv.ParseBool(query[key][0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s option %q: %w", key, query[key][0], err)
+			}
+			d.pendingTables = value
+			continue
+		}
+
+		if option, found := partitionOptionsByKey[key]; found && driver == "postgres" {
+			value, err := strconv.ParseUint(query[key][0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s option %q: %w", key, query[key][0], err)
+			}
+			*option(&d.partitions) = value
+			continue
+		}
+
+		options = append(options, fmt.Sprintf("%s=%s", key, strings.Join(query[key], ",")))
 	}
 	d.options = options
+
+	if d.partitions.size == 0 {
+		return nil, fmt.Errorf("invalid partition_size option, it must be greater than 0")
+	}
 	return d, nil
 }
 
+// defaultHistoryPruneInterval is the default amount of final blocks between two prunes of the
+// Postgres history table, see Loader.shouldPruneHistory.
+const defaultHistoryPruneInterval = 1000
+
+// builtinDrivers are the drivers whose connection string is built from the parsed DSN.
+var builtinDrivers = map[string]bool{"postgres": true, "clickhouse": true, "sqlite3": true, "mysql": true, "duckdb": true}
+
+// Scheme returns the DSN scheme, which selects the dialect.
+func (c *DSN) Scheme() string {
+	return c.scheme
+}
+
+// partitionOptionsByKey are the DSN options configuring the partitioning of tables by block
+// number, see partitionOptions.
+var partitionOptionsByKey = map[string]func(*partitionOptions) *uint64{
+	"partition_size":      func(o *partitionOptions) *uint64 { return &o.size },
+	"partitions_ahead":    func(o *partitionOptions) *uint64 { return &o.ahead },
+	"partitions_retained": func(o *partitionOptions) *uint64 { return &o.retained },
+}
+
 func (c *DSN) Driver() string {
 	return c.driver
 }
 
 func (c *DSN) ConnString() string {
 	if c.driver == "clickhouse" {
+		return c.clickhouseConnString()
+	}
+	if !builtinDrivers[c.driver] {
+		// Drivers of dialects registered by RegisterDialect parse the DSN themselves
+		return c.original
+	}
+	if c.driver == "mysql" {
+		return c.mysqlConnString()
+	}
+	if c.driver == "sqlite3" || c.driver == "duckdb" {
+		out := c.database
+		if c.driver == "sqlite3" {
+			out = "file:" + out
+		}
+		if len(c.options) > 0 {
+			out += "?" + strings.Join(c.options, "&")
+		}
+		return out
+	}
+
+	parameters := append([]string{
+		fmt.Sprintf("host=%s", c.host),
+		fmt.Sprintf("port=%d", c.port),
+		fmt.Sprintf("user=%s", c.username),
+		fmt.Sprintf("dbname=%s", c.database),
+	}, c.options...)
+	if c.password != "" {
+		parameters = append(parameters, "password="+c.password)
+	}
+	return strings.Join(parameters, " ")
+}
+
+// clickhouseConnString returns the DSN without the options handled by the sink, the other ones
+// being ClickHouse settings.
+func (c *DSN) clickhouseConnString() string {
+	if c.clickhouseCluster == "" {
 		return c.original
 	}
-	out := fmt.Sprintf("host=%s port=%d user=%s dbname=%s %s", c.host, c.port, c.username, c.database, strings.Join(c.options, " "))
+
+	dsnURL, err := url.Parse(c.original)
+	if err != nil {
+		// The DSN was already parsed successfully by ParseDSN
+		panic(fmt.Errorf("invalid url: %w", err))
+	}
+
+	query := dsnURL.Query()
+	query.Del("cluster")
+	dsnURL.RawQuery = query.Encode()
+	return dsnURL.String()
+}
+
+// mysqlConnString returns the connection string in go-sql-driver/mysql format. Times are parsed,
+// multiple statements are accepted (for setup scripts) and the affected rows of an UPDATE are the
+// matched ones, like on Postgres, user options override those defaults.
+func (c *DSN) mysqlConnString() string {
+	options := append([]string{"clientFoundRows=true", "multiStatements=true", "parseTime=true"}, c.options...)
+
+	credentials := c.username
 	if c.password != "" {
-		out = out + " password=" + c.password
+		credentials += ":" + c.password
 	}
-	return out
+
+	return fmt.Sprintf("%s@tcp(%s:%d)/%s?%s", credentials, c.host, c.port, c.database, strings.Join(options, "&"))
 }
 
 func (c *DSN) Schema() string {
@@ -10,8 +10,91 @@ import (
 	"go.uber.org/zap"
 )
 
+// inflightFlush tracks a flush started by FlushAsync, `err` is only read after `done`
+// has been closed.
+type inflightFlush struct {
+	done chan struct{}
+	err  error
+}
+
+// Flush writes the pending operations and the cursor to the database in a single
+// transaction and waits for it to complete. A flush started by FlushAsync, if any,
+// is completed first.
 func (l *Loader) Flush(ctx context.Context, outputModuleHash string, cursor *sink.Cursor, lastFinalBlock uint64) (rowFlushedCount int, err error) {
+	if err := l.WaitForFlush(); err != nil {
+		return 0, err
+	}
+
+	rowFlushedCount, err = l.flush(ctx, l.entries, outputModuleHash, cursor, lastFinalBlock)
+	if err != nil {
+		return 0, err
+	}
+	l.reset()
+
+	return rowFlushedCount, nil
+}
+
+// FlushAsync starts writing the pending operations and the cursor to the database in the
+// background and returns right away, operations received meanwhile accumulate in a second
+// buffer flushed by the next call. A single flush is in flight at any time: if the previous
+// one is still running, FlushAsync first waits for it, so cursors are committed strictly
+// in order.
+//
+// The `onFlushed` callback is invoked from the background goroutine when the flush completes,
+// it must not call back into the Loader. A failed flush loses its operations, its error is
+// thus returned by every subsequent call to Flush, FlushAsync, WaitForFlush and Revert.
+func (l *Loader) FlushAsync(ctx context.Context, outputModuleHash string, cursor *sink.Cursor, lastFinalBlock uint64, onFlushed func(rowFlushedCount int, took time.Duration, err error)) error {
+	if err := l.WaitForFlush(); err != nil {
+		return err
+	}
+
+	entries := l.entries
+	l.entries, l.flushing = l.flushing, entries
+	l.entriesCount = 0
+	l.entriesSize = 0
+
+	flush := &inflightFlush{done: make(chan struct{})}
+	l.inflight = flush
+
+	go func() {
+		defer close(flush.done)
+
+		startAt := time.Now()
+		rowFlushedCount, err := l.flush(ctx, entries, outputModuleHash, cursor, lastFinalBlock)
+		if err == nil {
+			resetEntries(entries)
+		}
+
+		flush.err = err
+		if onFlushed != nil {
+			onFlushed(rowFlushedCount, time.Since(startAt), err)
+		}
+	}()
+
+	return nil
+}
+
+// WaitForFlush waits for the flush started by FlushAsync, if any, to complete and returns
+// its error.
+func (l *Loader) WaitForFlush() error {
+	if l.inflight == nil {
+		return nil
+	}
+
+	<-l.inflight.done
+	if l.inflight.err != nil {
+		return fmt.Errorf("background flush: %w", l.inflight.err)
+	}
+
+	return nil
+}
+
+func (l *Loader) flush(ctx context.Context, entries *PendingOperations, outputModuleHash string, cursor *sink.Cursor, lastFinalBlock uint64) (rowFlushedCount int, err error) {
 	ctx = clickhouse.Context(context.Background(), clickhouse.WithStdAsync(false))
+	ctx = withFlushRange(ctx, flushRange{start: l.committedBlockNum() + 1, stop: cursor.Block().Num(), stopID: cursor.Block().ID()})
+
+	partitions := stagedPartitions{}
+	ctx = withStagedPartitions(ctx, partitions)
 
 	startAt := time.Now()
 	tx, err := l.BeginTx(ctx, nil)
@@ -26,7 +109,7 @@ func (l *Loader) Flush(ctx context.Context, outputModuleHash string, cursor *sin
 		}
 	}()
 
-	rowFlushedCount, err = l.getDialect().Flush(tx, ctx, l, outputModuleHash, lastFinalBlock)
+	rowFlushedCount, err = l.getDialect().Flush(tx, ctx, l, entries, outputModuleHash, lastFinalBlock)
 	if err != nil {
 		return 0, fmt.Errorf("dialect flush: %w", err)
 	}
@@ -39,14 +122,97 @@ func (l *Loader) Flush(ctx context.Context, outputModuleHash string, cursor *sin
 	if err := tx.Commit(); err != nil {
 		return 0, fmt.Errorf("failed to commit db transaction: %w", err)
 	}
-	l.reset()
+	l.committedCursor = cursor
+	partitions.apply()
 
 	// We add + 1 to the table count because the `cursors` table is an implicit table
-	l.logger.Debug("flushed table(s) rows to database", zap.Int("table_count", l.entries.Len()+1), zap.Int("row_count", rowFlushedCount), zap.Duration("took", time.Since(startAt)))
+	l.logger.Debug("flushed table(s) rows to database", zap.Int("table_count", entries.Len()+1), zap.Int("row_count", rowFlushedCount), zap.Duration("took", time.Since(startAt)))
 	return rowFlushedCount, nil
 }
 
+// flushRange is the range of blocks whose operations are flushed, from `start` to the block
+// `stop` of the flushed cursor, both inclusive. It is deterministic across restarts as long
+// as the flush boundaries are: the stream resumes from the last committed cursor.
+type flushRange struct {
+	start  uint64
+	stop   uint64
+	stopID string
+}
+
+type flushRangeKey struct{}
+
+func withFlushRange(ctx context.Context, blockRange flushRange) context.Context {
+	return context.WithValue(ctx, flushRangeKey{}, blockRange)
+}
+
+// flushRangeFromContext returns the range of blocks being flushed, false when the context
+// is not the one of a flush.
+func flushRangeFromContext(ctx context.Context) (flushRange, bool) {
+	blockRange, found := ctx.Value(flushRangeKey{}).(flushRange)
+	return blockRange, found
+}
+
+// shouldPruneHistory returns true when the history of the blocks up to `lastFinalBlock` is due
+// for pruning, recording it as pruned. The history being only read above the final block, it's
+// pruned once every `historyPruneInterval` final blocks (every flush when zero) instead of on
+// every flush, the first flush of a run pruning what previous runs left.
+func (l *Loader) shouldPruneHistory(lastFinalBlock uint64) bool {
+	if l.historyPrunedBlockNum != nil && lastFinalBlock < *l.historyPrunedBlockNum+l.historyPruneInterval {
+		return false
+	}
+
+	l.historyPrunedBlockNum = &lastFinalBlock
+	return true
+}
+
+// flushByGeneration calls `apply` with the operations of each table, each of them for a different
+// row. Operations chained on a row must be applied after the ones preceding them, so a table is
+// flushed by generation: the first operation of every row, then the second ones, and so on.
+// It returns the amount of operations applied.
+func (l *Loader) flushByGeneration(entries *PendingOperations, apply func(tableName string, operations []*Operation) error) (int, error) {
+	var rowCount int
+	for entriesPair := entries.Oldest(); entriesPair != nil; entriesPair = entriesPair.Next() {
+		tableName := entriesPair.Key
+		tableEntries := entriesPair.Value
+
+		if l.tracer.Enabled() {
+			l.logger.Debug("flushing table rows", zap.String("table_name", tableName), zap.Int("row_count", tableEntries.Len()))
+		}
+
+		operations := make([]*Operation, 0, tableEntries.Len())
+		for entryPair := tableEntries.Oldest(); entryPair != nil; entryPair = entryPair.Next() {
+			operations = append(operations, entryPair.Value)
+		}
+
+		for generation := 0; len(operations) > 0; generation++ {
+			if l.tracer.Enabled() && generation > 0 {
+				l.logger.Debug("flushing chained table rows", zap.String("table_name", tableName), zap.Int("generation", generation), zap.Int("row_count", len(operations)))
+			}
+
+			if err := apply(tableName, operations); err != nil {
+				return 0, err
+			}
+			rowCount += len(operations)
+
+			var next []*Operation
+			for _, operation := range operations {
+				if operation.next != nil {
+					next = append(next, operation.next)
+				}
+			}
+			operations = next
+		}
+	}
+
+	return rowCount, nil
+}
+
 func (l *Loader) Revert(ctx context.Context, outputModuleHash string, cursor *sink.Cursor, lastValidBlock uint64) error {
+	// The history of the blocks being flushed must be written before it can be reverted
+	if err := l.WaitForFlush(); err != nil {
+		return err
+	}
+
 	tx, err := l.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to being db transaction: %w", err)
@@ -59,7 +225,9 @@ func (l *Loader) Revert(ctx context.Context, outputModuleHash string, cursor *si
 		}
 	}()
 
-	if err := l.getDialect().Revert(tx, ctx, l, lastValidBlock); err != nil {
+	startAt := l.now()
+	reverted := revertedRows{}
+	if err := l.getDialect().Revert(tx, withRevertedRows(ctx, reverted), l, lastValidBlock); err != nil {
 		return err
 	}
 
@@ -67,16 +235,50 @@ func (l *Loader) Revert(ctx context.Context, outputModuleHash string, cursor *si
 		return fmt.Errorf("update cursor after revert: %w", err)
 	}
 
+	r := &reorg{
+		moduleHash:     outputModuleHash,
+		lastValidBlock: lastValidBlock,
+		cursorBefore:   l.committedCursor,
+		cursorAfter:    cursor,
+		revertedRows:   reverted,
+		duration:       l.now().Sub(startAt),
+	}
+	if err := l.recordReorg(ctx, tx, r); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit db transaction: %w", err)
 	}
+	l.committedCursor = cursor
+	r.observe()
 
-	l.logger.Debug("reverted changes to database", zap.Uint64("last_valid_block", lastValidBlock))
+	l.logger.Debug("reverted changes to database", zap.Uint64("last_valid_block", lastValidBlock), zap.Any("reverted_rows", reverted), zap.Duration("took", r.duration))
 	return nil
 }
 
+// hasCommittedCursor returns true when a cursor other than the blank one has been committed, the
+// block the stream resumes from being then known.
+func (l *Loader) hasCommittedCursor() bool {
+	return l.committedCursor != nil && !l.committedCursor.IsBlank()
+}
+
+// committedBlockNum returns the block of the committed cursor, zero when it's not known.
+func (l *Loader) committedBlockNum() uint64 {
+	if l.committedCursor == nil {
+		return 0
+	}
+	return l.committedCursor.Block().Num()
+}
+
 func (l *Loader) reset() {
-	for entriesPair := l.entries.Oldest(); entriesPair != nil; entriesPair = entriesPair.Next() {
-		l.entries.Set(entriesPair.Key, NewOrderedMap[string, *Operation]())
+	resetEntries(l.entries)
+	l.entriesCount = 0
+	l.entriesSize = 0
+}
+
+func resetEntries(entries *PendingOperations) {
+	for entriesPair := entries.Oldest(); entriesPair != nil; entriesPair = entriesPair.Next() {
+		entries.Set(entriesPair.Key, NewOrderedMap[string, *Operation]())
 	}
 }
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushAsync(t *testing.T) {
+	ctx := context.Background()
+	l, tx := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+
+	var flushedRows []int
+	onFlushed := func(rowFlushedCount int, _ time.Duration, err error) {
+		require.NoError(t, err)
+		flushedRows = append(flushedRows, rowFlushedCount)
+	}
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, nil))
+	require.NoError(t, l.FlushAsync(ctx, "abc", sink.NewBlankCursor(), 0, onFlushed))
+
+	// Accumulates in the second buffer while the first one is being flushed
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"from": "b"}, nil))
+	assert.Equal(t, uint64(1), l.PendingRows())
+	assert.Equal(t, uint64(len("id2")+len("id2from")+len("b")), l.PendingBytes())
+
+	require.NoError(t, l.FlushAsync(ctx, "abc", sink.NewBlankCursor(), 0, onFlushed))
+	require.NoError(t, l.WaitForFlush())
+
+	assert.Equal(t, []int{2, 2}, flushedRows)
+	assert.Equal(t, uint64(0), l.PendingRows())
+	assert.Equal(t, uint64(0), l.PendingBytes())
+	assert.Equal(t, []string{
+		`COPY "testschema"."xfer" ("from","id") FROM STDIN -- [a, 1]`,
+		`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 0 LIMIT 10000);`,
+		`UPDATE "testschema"."cursors" set cursor = '', block_num = 0, block_id = '' WHERE id = 'abc';`,
+		`COMMIT`,
+		`COPY "testschema"."xfer" ("from","id") FROM STDIN -- [b, 2]`,
+		`UPDATE "testschema"."cursors" set cursor = '', block_num = 0, block_id = '' WHERE id = 'abc';`,
+		`COMMIT`,
+	}, tx.Results())
+}
+
+func TestFlushAsyncError(t *testing.T) {
+	ctx := context.Background()
+	l, tx := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+	tx.commitErr = errors.New("connection lost")
+
+	var flushErr error
+	onFlushed := func(_ int, _ time.Duration, err error) {
+		flushErr = err
+	}
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, nil))
+	require.NoError(t, l.FlushAsync(ctx, "abc", sink.NewBlankCursor(), 0, onFlushed))
+
+	require.ErrorContains(t, l.WaitForFlush(), "connection lost")
+	assert.ErrorContains(t, flushErr, "connection lost")
+
+	// The error sticks, the operations of the failed flush being lost
+	assert.ErrorContains(t, l.FlushAsync(ctx, "abc", sink.NewBlankCursor(), 0, onFlushed), "connection lost")
+	_, err := l.Flush(ctx, "abc", sink.NewBlankCursor(), 0)
+	assert.ErrorContains(t, err, "connection lost")
+	assert.ErrorContains(t, l.Revert(ctx, "abc", sink.NewBlankCursor(), 0), "connection lost")
+}
+
+func TestShouldPruneHistory(t *testing.T) {
+	l, _ := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+	l.historyPruneInterval = 100
+
+	assert.True(t, l.shouldPruneHistory(50), "the first flush prunes what previous runs left")
+	assert.False(t, l.shouldPruneHistory(51))
+	assert.False(t, l.shouldPruneHistory(149))
+	assert.True(t, l.shouldPruneHistory(150))
+	assert.False(t, l.shouldPruneHistory(150))
+
+	l.historyPruneInterval = 0
+	assert.True(t, l.shouldPruneHistory(150), "every flush prunes with a zero interval")
+	assert.True(t, l.shouldPruneHistory(151))
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"go.uber.org/zap"
+)
+
+// HistoryEntry counts the operations recorded in the history table for a table at a block.
+type HistoryEntry struct {
+	BlockNum uint64
+	// Table is the escaped schema and table name, as recorded in the history.
+	Table   string
+	Inserts uint64
+	Updates uint64
+	Deletes uint64
+}
+
+// History returns the operations recorded in the history table grouped by block and table,
+// sorted by block then table.
+func (l *Loader) History(ctx context.Context) ([]*HistoryEntry, error) {
+	query := fmt.Sprintf("SELECT block_num, table_name, op, COUNT(*) FROM %s GROUP BY block_num, table_name, op ORDER BY block_num, table_name",
+		l.historyTable(),
+	)
+
+	rows, err := l.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("executing query %q: %w", query, err)
+	}
+	defer rows.Close()
+
+	var out []*HistoryEntry
+	for rows.Next() {
+		var blockNum, count uint64
+		var table, op string
+		if err := rows.Scan(&blockNum, &table, &op, &count); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		if len(out) == 0 || out[len(out)-1].BlockNum != blockNum || out[len(out)-1].Table != table {
+			out = append(out, &HistoryEntry{BlockNum: blockNum, Table: table})
+		}
+
+		entry := out[len(out)-1]
+		switch op {
+		case "I":
+			entry.Inserts += count
+		case "U":
+			entry.Updates += count
+		case "D":
+			entry.Deletes += count
+		default:
+			return nil, fmt.Errorf("unknown operation %q recorded in the history", op)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating on rows from query %q: %w", query, err)
+	}
+	return out, nil
+}
+
+// OldestHistoryBlock returns the lowest block having operations recorded in the history table,
+// false when the history is empty.
+func (l *Loader) OldestHistoryBlock(ctx context.Context) (uint64, bool, error) {
+	query := fmt.Sprintf("SELECT block_num FROM %s ORDER BY block_num LIMIT 1", l.historyTable())
+
+	var blockNum uint64
+	err := l.DB.QueryRowContext(ctx, query).Scan(&blockNum)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("executing query %q: %w", query, err)
+	}
+
+	return blockNum, true, nil
+}
+
+// Rollback reverts the operations recorded for the blocks after `toBlock` and rewrites the cursor
+// of `moduleHash` to `toBlock` in a single transaction, like an undo signal received from the
+// stream would, see Revert. It returns the cursor written, see rollbackCursor.
+//
+// The operations of reversible blocks being pruned from the lowest blocks, those of the blocks
+// below the oldest one retained may have been lost: it refuses to roll back further than right
+// before the oldest block retained, see OldestRevertibleBlock.
+func (l *Loader) Rollback(ctx context.Context, moduleHash string, toBlock bstream.BlockRef) (*sink.Cursor, error) {
+	cursors, err := l.GetAllCursors(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get cursors: %w", err)
+	}
+
+	current, found := cursors[moduleHash]
+	if !found {
+		return nil, fmt.Errorf("module %s: %w", moduleHash, ErrCursorNotFound)
+	}
+	if toBlock.Num() >= current.Block().Num() {
+		return nil, fmt.Errorf("cursor of module %s is at block %d, it must be after block %d to roll back", moduleHash, current.Block().Num(), toBlock.Num())
+	}
+
+	oldest, found, err := l.OldestRevertibleBlock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get oldest revertible block: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("the history is empty, there are no changes to roll back")
+	}
+	if toBlock.Num()+1 < oldest {
+		return nil, fmt.Errorf("cannot roll back to block %d, the oldest block retained in the history is %d: the changes of the blocks in between may have been pruned", toBlock.Num(), oldest)
+	}
+
+	cursor, err := rollbackCursor(current, toBlock)
+	if err != nil {
+		return nil, fmt.Errorf("create cursor of block %s: %w", toBlock, err)
+	}
+
+	l.committedCursor = current
+	if err := l.Revert(ctx, moduleHash, cursor, toBlock.Num()); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// rollbackCursor returns the cursor of `toBlock` as the stream would have sent it before reaching
+// the block of `current`: `toBlock` is marked as final only when it's not after the last final
+// block of `current`, which is kept otherwise so that the stream still undoes `toBlock` if it's
+// forked out.
+func rollbackCursor(current *sink.Cursor, toBlock bstream.BlockRef) (*sink.Cursor, error) {
+	step, lib := bstream.StepNewIrreversible, toBlock
+	if current.LIB != nil && toBlock.Num() > current.LIB.Num() {
+		step, lib = bstream.StepNew, current.LIB
+	}
+
+	return sink.NewCursor((&bstream.Cursor{Step: step, Block: toBlock, LIB: lib, HeadBlock: toBlock}).ToOpaque())
+}
+
+// OldestRevertibleBlock returns the lowest block whose operations can be reverted, recorded in
+// the history table or, in the pending tables mode, in the shadow tables. It's false when there
+// is none.
+func (l *Loader) OldestRevertibleBlock(ctx context.Context) (uint64, bool, error) {
+	oldest, found, err := l.OldestHistoryBlock(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	writer, ok := dialectAs[pendingTablesWriter](l.getDialect())
+	if !l.pendingTables || !ok {
+		return oldest, found, nil
+	}
+
+	for _, table := range l.userTables() {
+		query := fmt.Sprintf("SELECT MIN(block_num) FROM %s", writer.pendingTable(l.schema, table))
+
+		var blockNum sql.NullInt64
+		if err := l.DB.QueryRowContext(ctx, query).Scan(&blockNum); err != nil {
+			return 0, false, fmt.Errorf("executing query %q: %w", query, err)
+		}
+
+		if blockNum.Valid && (!found || uint64(blockNum.Int64) < oldest) {
+			oldest, found = uint64(blockNum.Int64), true
+		}
+	}
+	return oldest, found, nil
+}
+
+// historyRevertOp restores the row of the table `escapedTableName` identified by `pk` (a JSON object)
+// as it was before the operation `op` recorded in the history, `prevValue` being its previous value.
+type historyRevertOp func(tx Tx, ctx context.Context, op, escapedTableName, pk, prevValue string) error
+
+// revertFromHistory reverts the operations recorded in the history for the blocks after
+// `lastValidFinalBlock` one by one with `revertOp`, the most recent first, then removes them from
+// the history with `pruneQuery`. The entries are read with `selectQuery`, returning the op,
+// table_name, pk, prev_value and block_num columns in the order they must be reverted.
+func revertFromHistory(tx Tx, ctx context.Context, l *Loader, lastValidFinalBlock uint64, selectQuery, pruneQuery string, revertOp historyRevertOp) error {
+	rows, err := tx.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return err
+	}
+
+	var reversions []func() error
+	l.logger.Info("reverting forked block block(s)", zap.Uint64("last_valid_final_block", lastValidFinalBlock))
+	if rows != nil { // rows will be nil with no error only in testing scenarios
+		defer rows.Close()
+		for rows.Next() {
+			var op string
+			var table_name string
+			var pk string
+			var prev_value_nullable sql.NullString
+			var block_num uint64
+			if err := rows.Scan(&op, &table_name, &pk, &prev_value_nullable, &block_num); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			l.logger.Debug("reverting", zap.String("operation", op), zap.String("table_name", table_name), zap.String("pk", pk), zap.Uint64("block_num", block_num))
+			prev_value := prev_value_nullable.String
+
+			reversions = append(reversions, func() error {
+				if err := revertOp(tx, ctx, op, table_name, pk, prev_value); err != nil {
+					return fmt.Errorf("revertOp: %w", err)
+				}
+				l.recordRevertedRows(ctx, table_name, 1)
+				return nil
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("iterating on rows from query %q: %w", selectQuery, err)
+		}
+
+		// The history rows must be fully read before executing other statements in the transaction,
+		// the connection being busy until they are closed
+		rows.Close()
+
+		for _, reversion := range reversions {
+			if err := reversion(); err != nil {
+				return fmt.Errorf("execution revert operation: %w", err)
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, pruneQuery); err != nil {
+		return fmt.Errorf("executing pruneHistory: %w", err)
+	}
+	return nil
+}
+
+func (l *Loader) historyTable() string {
+	return l.getDialect().EscapeIdentifier(l.schema) + "." + l.getDialect().EscapeIdentifier(HISTORY_TABLE)
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// finalCursor returns a cursor on block `num`, marked as final.
+func finalCursor(num uint64) *sink.Cursor {
+	block := bstream.NewBlockRef(fmt.Sprintf("%d", num), num)
+	return sink.MustNewCursor((&bstream.Cursor{Step: bstream.StepNewIrreversible, Block: block, LIB: block, HeadBlock: block}).ToOpaque())
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	ctx := context.Background()
+	l := newSQLiteTestLoader(t)
+	blockNum := func(num uint64) *uint64 { return &num }
+
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, blockNum(10)))
+	require.NoError(t, l.Insert("xfer", map[string]string{"id": "2"}, map[string]string{"from": "b"}, blockNum(10)))
+	_, err := l.Flush(ctx, "abc", finalCursor(10), 5)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Update("xfer", map[string]string{"id": "1"}, map[string]string{"from": "c"}, blockNum(11)))
+	require.NoError(t, l.Upsert("balance", map[string]string{"owner": "alice", "token": "eth"}, map[string]string{"amount": "100"}, blockNum(11)))
+	_, err = l.Flush(ctx, "abc", finalCursor(11), 5)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Delete("xfer", map[string]string{"id": "2"}, blockNum(12)))
+	_, err = l.Flush(ctx, "abc", finalCursor(12), 5)
+	require.NoError(t, err)
+
+	entries, err := l.History(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []*HistoryEntry{
+		{BlockNum: 10, Table: `"main"."xfer"`, Inserts: 2},
+		{BlockNum: 11, Table: `"main"."balance"`, Inserts: 1},
+		{BlockNum: 11, Table: `"main"."xfer"`, Updates: 1},
+		{BlockNum: 12, Table: `"main"."xfer"`, Deletes: 1},
+	}, entries)
+
+	block := func(num uint64) bstream.BlockRef { return bstream.NewBlockRef(fmt.Sprintf("%d", num), num) }
+
+	_, err = l.Rollback(ctx, "abc", block(8))
+	assert.ErrorContains(t, err, "the oldest block retained in the history is 10")
+	_, err = l.Rollback(ctx, "abc", block(12))
+	assert.ErrorContains(t, err, "it must be after block 12")
+	_, err = l.Rollback(ctx, "other", block(10))
+	assert.ErrorIs(t, err, ErrCursorNotFound)
+
+	cursor, err := l.Rollback(ctx, "abc", block(10))
+	require.NoError(t, err)
+	assert.Equal(t, finalCursor(10).String(), cursor.String())
+
+	assert.Equal(t, []string{"1|a", "2|b"}, sqliteRows(t, l, `SELECT id, "from" FROM xfer ORDER BY id`))
+	assert.Empty(t, sqliteRows(t, l, `SELECT owner FROM balance`))
+	assert.Equal(t, []string{"abc|10"}, sqliteRows(t, l, `SELECT id, block_num FROM cursors`))
+	assert.Equal(t, []string{"abc|10"}, sqliteRows(t, l, `SELECT module_hash, last_valid_block FROM substreams_reorgs`))
+
+	oldest, found, err := l.OldestRevertibleBlock(ctx)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(10), oldest)
+
+	_, err = l.Rollback(ctx, "abc", block(9))
+	require.NoError(t, err, "the oldest block of the history can be reverted")
+	assert.Empty(t, sqliteRows(t, l, `SELECT id FROM xfer`))
+
+	_, found, err = l.OldestRevertibleBlock(ctx)
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestRollbackCursor(t *testing.T) {
+	head, lib := bstream.NewBlockRef("12", 12), bstream.NewBlockRef("8", 8)
+	current := sink.MustNewCursor((&bstream.Cursor{Step: bstream.StepNew, Block: head, LIB: lib, HeadBlock: head}).ToOpaque())
+
+	cursor, err := rollbackCursor(current, bstream.NewBlockRef("7", 7))
+	require.NoError(t, err)
+	assert.Equal(t, finalCursor(7).String(), cursor.String(), "a final block is marked as final")
+
+	cursor, err = rollbackCursor(current, bstream.NewBlockRef("10", 10))
+	require.NoError(t, err)
+	assert.Equal(t, bstream.StepNew, cursor.Step)
+	assert.Equal(t, uint64(10), cursor.Block().Num())
+	assert.Equal(t, lib, cursor.LIB, "a reversible block keeps the final block of the current cursor")
+}
@@ -0,0 +1,16 @@
+package db
+
+import (
+	"github.com/streamingfast/dmetrics"
+)
+
+func RegisterMetrics() {
+	metrics.Register()
+}
+
+var metrics = dmetrics.NewSet()
+
+var ReorgsCount = metrics.NewCounter("substreams_sink_sql_reorgs_count", "The amount of reorgs reverted so far")
+var ReorgDuration = metrics.NewCounter("substreams_sink_sql_reorg_duration", "The amount of time spent reverting reorgs (in nanoseconds)")
+var ReorgDepth = metrics.NewHistogram("substreams_sink_sql_reorg_depth", "The amount of blocks undone by each reorg")
+var RevertedRowsCount = metrics.NewCounterVec("substreams_sink_sql_reverted_rows_count", []string{"table"}, "The number of rows reverted by reorgs so far, per table")
@@ -5,14 +5,17 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
+
+	"golang.org/x/exp/maps"
 )
 
 type TypeGetter func(tableName string, columnName string) (reflect.Type, error)
 
 type Queryable interface {
-	query(d dialect) (string, error)
+	query(d Dialect) (string, error)
 }
 
 type OperationType string
@@ -21,6 +24,7 @@ const (
 	OperationTypeInsert OperationType = "INSERT"
 	OperationTypeUpdate OperationType = "UPDATE"
 	OperationTypeDelete OperationType = "DELETE"
+	OperationTypeUpsert OperationType = "UPSERT"
 )
 
 type Operation struct {
@@ -29,12 +33,63 @@ type Operation struct {
 	primaryKey         map[string]string
 	data               map[string]string
 	reversibleBlockNum *uint64 // nil if that block is known to be irreversible
+
+	// next is the operation to apply on the same row once this one has been applied, used
+	// when operations on a row cannot be folded in a single statement, either because the
+	// row is re-created after a delete or because they are for different reversible blocks,
+	// each requiring its own history.
+	next *Operation
+}
+
+// Table returns the table the operation applies to.
+func (o *Operation) Table() *TableInfo {
+	return o.table
+}
+
+// Type returns the operation's type.
+func (o *Operation) Type() OperationType {
+	return o.opType
+}
+
+// PrimaryKey returns the primary key of the row, keyed by column name.
+func (o *Operation) PrimaryKey() map[string]string {
+	return o.primaryKey
+}
+
+// Data returns the values of the row, keyed by column name, empty for deletes.
+func (o *Operation) Data() map[string]string {
+	return o.data
+}
+
+// ReversibleBlockNum returns the block of the operation, nil if that block is known to be
+// irreversible, in which case no history must be recorded.
+func (o *Operation) ReversibleBlockNum() *uint64 {
+	return o.reversibleBlockNum
+}
+
+// Next returns the operation to apply on the same row once this one has been applied, if any.
+func (o *Operation) Next() *Operation {
+	return o.next
 }
 
 func (o *Operation) String() string {
 	return fmt.Sprintf("%s/%s (%s)", o.table.identifier, createRowUniqueID(o.primaryKey), strings.ToLower(string(o.opType)))
 }
 
+// approximateSize returns the approximate amount of bytes of the operation's primary key
+// and data, used to bound the memory held by the pending operations.
+func (o *Operation) approximateSize() (size uint64) {
+	for column, value := range o.primaryKey {
+		size += uint64(len(column) + len(value))
+	}
+
+	for column, value := range o.data {
+		size += uint64(len(column) + len(value))
+	}
+
+	return size
+}
+
 func (l *Loader) newInsertOperation(table *TableInfo, primaryKey map[string]string, data map[string]string, reversibleBlockNum *uint64) *Operation {
 	return &Operation{
 		table:              table,
@@ -55,6 +110,16 @@ func (l *Loader) newUpdateOperation(table *TableInfo, primaryKey map[string]stri
 	}
 }
 
+func (l *Loader) newUpsertOperation(table *TableInfo, primaryKey map[string]string, data map[string]string, reversibleBlockNum *uint64) *Operation {
+	return &Operation{
+		table:              table,
+		opType:             OperationTypeUpsert,
+		primaryKey:         primaryKey,
+		data:               data,
+		reversibleBlockNum: reversibleBlockNum,
+	}
+}
+
 func (l *Loader) newDeleteOperation(table *TableInfo, primaryKey map[string]string, reversibleBlockNum *uint64) *Operation {
 	return &Operation{
 		table:              table,
@@ -64,6 +129,28 @@ func (l *Loader) newDeleteOperation(table *TableInfo, primaryKey map[string]stri
 	}
 }
 
+// tail returns the last operation of the chain along with its parent, nil
+// if the operation is not chained.
+func (o *Operation) tail() (parent *Operation, tail *Operation) {
+	tail = o
+	for tail.next != nil {
+		parent, tail = tail, tail.next
+	}
+
+	return parent, tail
+}
+
+// sameHistorySegment returns true if the incoming operation can be folded in this one
+// without losing history, which is the case when both are for the same reversible
+// block or when the incoming one is irreversible.
+func (o *Operation) sameHistorySegment(incoming *Operation) bool {
+	if incoming.reversibleBlockNum == nil {
+		return true
+	}
+
+	return o.reversibleBlockNum != nil && *o.reversibleBlockNum == *incoming.reversibleBlockNum
+}
+
 func (o *Operation) mergeData(newData map[string]string) error {
 	if o.opType == OperationTypeDelete {
 		return fmt.Errorf("unable to merge data for a delete operation")
@@ -112,3 +199,17 @@ func jsonToPrimaryKey(in string) (map[string]string, error) {
 	}
 	return out, nil
 }
+
+// jsonObjectKeys returns the keys of the JSON object sorted alphabetically, used to
+// list the columns of a row saved in the history table.
+func jsonObjectKeys(in string) ([]string, error) {
+	valueMap := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(in), &valueMap); err != nil {
+		return nil, fmt.Errorf("unmarshalling %q into valueMap: %w", in, err)
+	}
+
+	keys := maps.Keys(valueMap)
+	sort.Strings(keys)
+
+	return keys, nil
+}
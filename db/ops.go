@@ -11,10 +11,8 @@ import (
 // Insert a row in the DB, it is assumed the table exists, you can do a
 // check before with HasTable()
 func (l *Loader) Insert(tableName string, primaryKey map[string]string, data map[string]string, reversibleBlockNum *uint64) error {
-	uniqueID := createRowUniqueID(primaryKey)
-
 	if l.tracer.Enabled() {
-		l.logger.Debug("processing insert operation", zap.String("table_name", tableName), zap.String("primary_key", uniqueID), zap.Int("field_count", len(data)))
+		l.logger.Debug("processing insert operation", zap.String("table_name", tableName), zap.String("primary_key", createRowUniqueID(primaryKey)), zap.Int("field_count", len(data)))
 	}
 
 	table, found := l.tables[tableName]
@@ -22,34 +20,14 @@ func (l *Loader) Insert(tableName string, primaryKey map[string]string, data map
 		return fmt.Errorf("unknown table %q", tableName)
 	}
 
-	entry, found := l.entries.Get(tableName)
-	if !found {
-		if l.tracer.Enabled() {
-			l.logger.Debug("adding tracking of table never seen before", zap.String("table_name", tableName))
-		}
-
-		entry = NewOrderedMap[string, *Operation]()
-		l.entries.Set(tableName, entry)
-	}
-
-	if _, found := entry.Get(uniqueID); found {
-		return fmt.Errorf("attempting to insert in table %q a primary key %q, that is already scheduled for insertion, insert should only be called once for a given primary key", tableName, primaryKey)
-	}
-
-	if l.tracer.Enabled() {
-		l.logger.Debug("primary key entry never existed for table, adding insert operation", zap.String("primary_key", uniqueID), zap.String("table_name", tableName))
-	}
-
 	// We need to make sure to add the primary key(s) in the data so that those column get created correctly, but only if there is data
-	for _, primary := range l.tables[tableName].primaryColumns {
+	for _, primary := range table.primaryColumns {
 		if dataFromPrimaryKey, ok := primaryKey[primary.name]; ok {
 			data[primary.name] = dataFromPrimaryKey
 		}
 	}
 
-	entry.Set(uniqueID, l.newInsertOperation(table, primaryKey, data, reversibleBlockNum))
-	l.entriesCount++
-	return nil
+	return l.schedule(l.newInsertOperation(table, primaryKey, data, reversibleBlockNum))
 }
 
 func createRowUniqueID(m map[string]string) string {
@@ -102,9 +80,8 @@ func (l *Loader) Update(tableName string, primaryKey map[string]string, data map
 		return fmt.Errorf("update operation is not supported by the current database")
 	}
 
-	uniqueID := createRowUniqueID(primaryKey)
 	if l.tracer.Enabled() {
-		l.logger.Debug("processing update operation", zap.String("table_name", tableName), zap.String("primary_key", uniqueID), zap.Int("field_count", len(data)))
+		l.logger.Debug("processing update operation", zap.String("table_name", tableName), zap.String("primary_key", createRowUniqueID(primaryKey)), zap.Int("field_count", len(data)))
 	}
 
 	table, found := l.tables[tableName]
@@ -116,38 +93,51 @@ func (l *Loader) Update(tableName string, primaryKey map[string]string, data map
 		return fmt.Errorf("trying to perform an UPDATE operation but table %q don't have a primary key(s) set, this is not accepted", tableName)
 	}
 
-	entry, found := l.entries.Get(tableName)
-	if !found {
-		if l.tracer.Enabled() {
-			l.logger.Debug("adding tracking of table never seen before", zap.String("table_name", tableName))
-		}
-
-		entry = NewOrderedMap[string, *Operation]()
-		l.entries.Set(tableName, entry)
+	if err := table.checkPrimaryKey(primaryKey); err != nil {
+		return fmt.Errorf("trying to perform an UPDATE operation: %w", err)
 	}
 
-	if op, found := entry.Get(uniqueID); found {
-		if op.opType == OperationTypeDelete {
-			return fmt.Errorf("attempting to update an object with primary key %q, that schedule to be deleted", primaryKey)
-		}
+	if err := l.validateMutation(table, OperationTypeUpdate); err != nil {
+		return fmt.Errorf("trying to perform an UPDATE operation: %w", err)
+	}
 
-		if l.tracer.Enabled() {
-			l.logger.Debug("primary key entry already exist for table, merging fields together", zap.String("primary_key", uniqueID), zap.String("table_name", tableName))
-		}
+	return l.schedule(l.newUpdateOperation(table, primaryKey, data, reversibleBlockNum))
+}
 
-		op.mergeData(data)
-		entry.Set(uniqueID, op)
-		return nil
-	} else {
-		l.entriesCount++
+// Upsert a row in the DB, inserting it if it does not exist yet or updating the
+// provided columns otherwise. It is assumed the table exists, you can do a check
+// before with HasTable()
+func (l *Loader) Upsert(tableName string, primaryKey map[string]string, data map[string]string, reversibleBlockNum *uint64) error {
+	if l.getDialect().OnlyInserts() {
+		return fmt.Errorf("upsert operation is not supported by the current database")
 	}
 
 	if l.tracer.Enabled() {
-		l.logger.Debug("primary key entry never existed for table, adding update operation", zap.String("primary_key", uniqueID), zap.String("table_name", tableName))
+		l.logger.Debug("processing upsert operation", zap.String("table_name", tableName), zap.String("primary_key", createRowUniqueID(primaryKey)), zap.Int("field_count", len(data)))
 	}
 
-	entry.Set(uniqueID, l.newUpdateOperation(table, primaryKey, data, reversibleBlockNum))
-	return nil
+	table, found := l.tables[tableName]
+	if !found {
+		return fmt.Errorf("unknown table %q", tableName)
+	}
+
+	if err := table.checkPrimaryKey(primaryKey); err != nil {
+		return fmt.Errorf("trying to perform an UPSERT operation: %w", err)
+	}
+
+	if err := l.validateMutation(table, OperationTypeUpsert); err != nil {
+		return fmt.Errorf("trying to perform an UPSERT operation: %w", err)
+	}
+
+	// We need to make sure to add the primary key(s) in the data so that those column get created correctly,
+	// the row might not exist in which case it is inserted
+	for _, primary := range table.primaryColumns {
+		if dataFromPrimaryKey, ok := primaryKey[primary.name]; ok {
+			data[primary.name] = dataFromPrimaryKey
+		}
+	}
+
+	return l.schedule(l.newUpsertOperation(table, primaryKey, data, reversibleBlockNum))
 }
 
 // Delete a row in the DB, it is assumed the table exists, you can do a
@@ -157,9 +147,8 @@ func (l *Loader) Delete(tableName string, primaryKey map[string]string, reversib
 		return fmt.Errorf("delete operation is not supported by the current database")
 	}
 
-	uniqueID := createRowUniqueID(primaryKey)
 	if l.tracer.Enabled() {
-		l.logger.Debug("processing delete operation", zap.String("table_name", tableName), zap.String("primary_key", uniqueID))
+		l.logger.Debug("processing delete operation", zap.String("table_name", tableName), zap.String("primary_key", createRowUniqueID(primaryKey)))
 	}
 
 	table, found := l.tables[tableName]
@@ -167,10 +156,61 @@ func (l *Loader) Delete(tableName string, primaryKey map[string]string, reversib
 		return fmt.Errorf("unknown table %q", tableName)
 	}
 
-	if len(table.primaryColumns) != 1 {
+	if len(table.primaryColumns) == 0 {
 		return fmt.Errorf("trying to perform a DELETE operation but table %q don't have a primary key(s) set, this is not accepted", tableName)
 	}
 
+	if err := table.checkPrimaryKey(primaryKey); err != nil {
+		return fmt.Errorf("trying to perform a DELETE operation: %w", err)
+	}
+
+	if err := l.validateMutation(table, OperationTypeDelete); err != nil {
+		return fmt.Errorf("trying to perform a DELETE operation: %w", err)
+	}
+
+	return l.schedule(l.newDeleteOperation(table, primaryKey, reversibleBlockNum))
+}
+
+// validateMutation checks that the dialect supports the update, upsert or delete operation
+// on the table, some dialects only support them for some tables.
+func (l *Loader) validateMutation(table *TableInfo, opType OperationType) error {
+	if validator, ok := dialectAs[mutationValidator](l.getDialect()); ok {
+		return validator.validateMutation(table, opType)
+	}
+	return nil
+}
+
+// schedule adds the operation to the pending entries, folding it with the operations
+// already scheduled for the same primary key within the batch.
+//
+// Operations on a row are folded together as long as they are part of the same history
+// segment, that is they are either for the same reversible block or the incoming operation
+// is irreversible (in which case the history of the batch is pruned at flush time anyway).
+// The folding rules, for a scheduled operation followed by an incoming one, are:
+//
+//   - INSERT + UPDATE|UPSERT => INSERT of the merged fields, the row is known to not exist yet
+//   - INSERT + DELETE        => nothing, the row never reaches the database
+//   - UPDATE + UPDATE        => UPDATE of the merged fields
+//   - UPDATE + UPSERT        => UPSERT of the merged fields, existence is only known by the database
+//   - UPSERT + UPDATE|UPSERT => UPSERT of the merged fields
+//   - UPDATE|UPSERT + DELETE => DELETE
+//   - DELETE + DELETE        => DELETE
+//   - DELETE + INSERT|UPSERT => DELETE followed by an INSERT, the row is re-created from scratch
+//     so the INSERT is chained to run after the DELETE
+//   - INSERT|UPDATE|UPSERT + INSERT => error, the row is already scheduled to exist
+//   - DELETE + UPDATE               => error, the row is scheduled to be deleted
+//
+// When the incoming operation is for another reversible block than the scheduled one,
+// it's chained after it instead of being folded (errors still apply) so that each block
+// records its own history and can be reverted independently.
+func (l *Loader) schedule(incoming *Operation) error {
+	tableName := incoming.table.name
+	uniqueID := createRowUniqueID(incoming.primaryKey)
+
+	// Folded operations are accounted in full, the size is thus an upper bound of the
+	// data held by the pending operations.
+	l.entriesSize += incoming.approximateSize()
+
 	entry, found := l.entries.Get(tableName)
 	if !found {
 		if l.tracer.Enabled() {
@@ -181,18 +221,83 @@ func (l *Loader) Delete(tableName string, primaryKey map[string]string, reversib
 		l.entries.Set(tableName, entry)
 	}
 
-	if _, found := entry.Get(uniqueID); !found {
+	head, found := entry.Get(uniqueID)
+	if !found {
 		if l.tracer.Enabled() {
-			l.logger.Debug("primary key entry never existed for table", zap.String("primary_key", uniqueID), zap.String("table_name", tableName))
+			l.logger.Debug("primary key entry never existed for table, adding operation", zap.Stringer("op", incoming))
 		}
 
+		entry.Set(uniqueID, incoming)
 		l.entriesCount++
+		return nil
+	}
+
+	parent, tail := head.tail()
+	rowExists := tail.opType != OperationTypeDelete
+
+	if incoming.opType == OperationTypeInsert && rowExists {
+		return fmt.Errorf("attempting to insert in table %q a primary key %q, that is already scheduled for %s, insert should only be called once for a given primary key", tableName, incoming.primaryKey, strings.ToLower(string(tail.opType)))
 	}
 
+	if incoming.opType == OperationTypeUpdate && !rowExists {
+		return fmt.Errorf("attempting to update an object with primary key %q, that schedule to be deleted", incoming.primaryKey)
+	}
+
+	if !rowExists && incoming.opType != OperationTypeDelete {
+		// The row is re-created after being deleted, since it's known to not exist anymore
+		// once the DELETE ran, an UPSERT is an INSERT.
+		incoming.opType = OperationTypeInsert
+		return l.chain(tail, incoming)
+	}
+
+	if !tail.sameHistorySegment(incoming) {
+		return l.chain(tail, incoming)
+	}
+
+	if l.tracer.Enabled() {
+		l.logger.Debug("primary key entry already exist for table, folding operations together", zap.Stringer("op", tail), zap.Stringer("incoming", incoming))
+	}
+
+	switch incoming.opType {
+	case OperationTypeDelete:
+		if tail.opType == OperationTypeInsert {
+			// The row never reached the database, both operations cancel each other
+			if parent == nil {
+				entry.Delete(uniqueID)
+			} else {
+				parent.next = nil
+			}
+
+			l.entriesCount--
+			return nil
+		}
+
+		tail.opType = OperationTypeDelete
+		tail.data = nil
+
+	case OperationTypeUpdate, OperationTypeUpsert:
+		if incoming.opType == OperationTypeUpsert && tail.opType == OperationTypeUpdate {
+			tail.opType = OperationTypeUpsert
+		}
+
+		if err := tail.mergeData(incoming.data); err != nil {
+			return err
+		}
+
+	default:
+		panic(fmt.Errorf("unexpected operation type %q to fold", incoming.opType))
+	}
+
+	tail.reversibleBlockNum = incoming.reversibleBlockNum
+	return nil
+}
+
+func (l *Loader) chain(tail *Operation, incoming *Operation) error {
 	if l.tracer.Enabled() {
-		l.logger.Debug("adding deleting operation", zap.String("primary_key", uniqueID), zap.String("table_name", tableName))
+		l.logger.Debug("chaining operation to be applied after the scheduled one", zap.Stringer("op", tail), zap.Stringer("incoming", incoming))
 	}
 
-	entry.Set(uniqueID, l.newDeleteOperation(table, primaryKey, reversibleBlockNum))
+	tail.next = incoming
+	l.entriesCount++
 	return nil
 }
@@ -63,3 +63,112 @@ func TestGetPrimaryKey(t *testing.T) {
 	}
 
 }
+
+func TestUpsert(t *testing.T) {
+	blockNum := uint64(10)
+
+	tests := []struct {
+		name         string
+		apply        func(l *Loader) error
+		expectOpType OperationType
+		expectData   map[string]string
+		expectError  bool
+	}{
+		{
+			name: "upsert alone",
+			apply: func(l *Loader) error {
+				return l.Upsert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, &blockNum)
+			},
+			expectOpType: OperationTypeUpsert,
+			expectData:   map[string]string{"id": "1", "from": "a"},
+		},
+		{
+			name: "upsert after insert stays an insert",
+			apply: func(l *Loader) error {
+				require.NoError(t, l.Insert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a", "to": "b"}, &blockNum))
+				return l.Upsert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "c"}, &blockNum)
+			},
+			expectOpType: OperationTypeInsert,
+			expectData:   map[string]string{"id": "1", "from": "c", "to": "b"},
+		},
+		{
+			name: "upsert after update becomes an upsert",
+			apply: func(l *Loader) error {
+				require.NoError(t, l.Update("xfer", map[string]string{"id": "1"}, map[string]string{"to": "b"}, &blockNum))
+				return l.Upsert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "c"}, &blockNum)
+			},
+			expectOpType: OperationTypeUpsert,
+			expectData:   map[string]string{"id": "1", "from": "c", "to": "b"},
+		},
+		{
+			name: "update after upsert stays an upsert",
+			apply: func(l *Loader) error {
+				require.NoError(t, l.Upsert("xfer", map[string]string{"id": "1"}, map[string]string{"from": "a"}, &blockNum))
+				return l.Update("xfer", map[string]string{"id": "1"}, map[string]string{"to": "b"}, &blockNum)
+			},
+			expectOpType: OperationTypeUpsert,
+			expectData:   map[string]string{"id": "1", "from": "a", "to": "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, _ := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+
+			err := test.apply(l)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			entries, found := l.entries.Get("xfer")
+			require.True(t, found)
+			op, found := entries.Get("1")
+			require.True(t, found)
+
+			assert.Equal(t, test.expectOpType, op.opType)
+			assert.Equal(t, test.expectData, op.data)
+			assert.Equal(t, uint64(1), l.entriesCount)
+		})
+	}
+}
+
+func TestDeleteCompositePrimaryKey(t *testing.T) {
+	blockNum := uint64(10)
+
+	tests := []struct {
+		name        string
+		primaryKey  map[string]string
+		expectError bool
+	}{
+		{
+			name:       "full composite key",
+			primaryKey: map[string]string{"owner": "0xdead", "token": "0xbeef"},
+		},
+		{
+			name:        "partial composite key",
+			primaryKey:  map[string]string{"owner": "0xdead"},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, _ := NewTestLoader(zlog, tracer, "testschema", TestTables("testschema"))
+
+			err := l.Delete("balance", test.primaryKey, &blockNum)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			entries, found := l.entries.Get("balance")
+			require.True(t, found)
+			op, found := entries.Get(createRowUniqueID(test.primaryKey))
+			require.True(t, found)
+			assert.Equal(t, OperationTypeDelete, op.opType)
+		})
+	}
+}
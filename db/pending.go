@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// PENDING_TABLE_SUFFIX is appended to the name of a table to name the shadow table holding the
+// operations of its rows in blocks that are not final yet.
+const PENDING_TABLE_SUFFIX = "_pending"
+
+// HEAD_VIEW_SUFFIX is appended to the name of a table to name the view of its rows as of the
+// latest block, the final rows overlaid with the operations of the shadow table.
+const HEAD_VIEW_SUFFIX = "_head"
+
+// SetupPendingTables creates the shadow table and the head view of every table of the schema when
+// the pending tables mode is enabled, tables must have been loaded by LoadTables. It does nothing
+// otherwise.
+//
+// In this mode, the operations of reversible blocks are written to the shadow table of their table
+// instead of the table itself, which thus only holds final rows. Once their block is final, they
+// are applied to the table and removed from the shadow table, and reverts only have to remove them.
+func (l *Loader) SetupPendingTables(ctx context.Context, withPostgraphile bool) error {
+	if !l.pendingTables {
+		return nil
+	}
+
+	writer, ok := dialectAs[pendingTablesWriter](l.getDialect())
+	if !ok {
+		return fmt.Errorf("pending tables are not supported by dialect %T", l.getDialect())
+	}
+
+	for _, table := range l.userTables() {
+		l.logger.Info("creating pending table", zap.String("table", table.identifier))
+		if _, err := l.ExecContext(ctx, writer.createPendingTableQuery(l.schema, table, withPostgraphile)); err != nil {
+			return fmt.Errorf("creating pending table of %s: %w", table.identifier, err)
+		}
+	}
+
+	return nil
+}
+
+// userTables returns the tables of the schema other than the system tables, sorted by name.
+func (l *Loader) userTables() (out []*TableInfo) {
+	for name, table := range l.tables {
+		switch name {
+		case CURSORS_TABLE, HISTORY_TABLE, COMPLETIONS_TABLE, REORGS_TABLE:
+			continue
+		}
+		out = append(out, table)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
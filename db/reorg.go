@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	sink "github.com/streamingfast/substreams-sink"
+)
+
+// revertedRows counts the rows reverted by Dialect.Revert per table name, dialects report them
+// with Loader.recordRevertedRows.
+type revertedRows map[string]int64
+
+type revertedRowsKey struct{}
+
+func withRevertedRows(ctx context.Context, rows revertedRows) context.Context {
+	return context.WithValue(ctx, revertedRowsKey{}, rows)
+}
+
+// recordRevertedRows adds `count` to the rows reverted in the table identified by `identifier`
+// (escaped schema and table name), it does nothing when the context is not the one of a revert.
+func (l *Loader) recordRevertedRows(ctx context.Context, identifier string, count int64) {
+	rows, found := ctx.Value(revertedRowsKey{}).(revertedRows)
+	if !found {
+		return
+	}
+
+	name := identifier
+	if table := l.tableByIdentifier(identifier); table != nil {
+		name = table.name
+	}
+	rows[name] += count
+}
+
+// reorg is a revert of the blocks after `lastValidBlock`, recorded in the reorgs table.
+type reorg struct {
+	moduleHash     string
+	lastValidBlock uint64
+	// cursorBefore is the cursor committed before the revert, nil when it's not known.
+	cursorBefore *sink.Cursor
+	cursorAfter  *sink.Cursor
+	revertedRows revertedRows
+	duration     time.Duration
+}
+
+// depth returns the amount of blocks undone, false when the cursor before the revert is not known.
+func (r *reorg) depth() (uint64, bool) {
+	if r.cursorBefore == nil || r.cursorBefore.Block().Num() < r.lastValidBlock {
+		return 0, false
+	}
+	return r.cursorBefore.Block().Num() - r.lastValidBlock, true
+}
+
+// insertQuery returns the query recording the revert in `table`, the columns are the same on
+// every database, the time of the revert being set by the column's default value.
+func (r *reorg) insertQuery(table string) string {
+	cursorBefore := ""
+	if r.cursorBefore != nil {
+		cursorBefore = r.cursorBefore.String()
+	}
+
+	revertedRows, err := json.Marshal(r.revertedRows)
+	if err != nil {
+		panic(fmt.Errorf("marshalling reverted rows: %w", err))
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (module_hash, last_valid_block, cursor_before, cursor_after, reverted_rows, duration_ms) VALUES (%s, %d, %s, %s, %s, %d)",
+		table,
+		escapeStringValue(r.moduleHash),
+		r.lastValidBlock,
+		escapeStringValue(cursorBefore),
+		escapeStringValue(r.cursorAfter.String()),
+		escapeStringValue(string(revertedRows)),
+		r.duration.Milliseconds(),
+	)
+}
+
+// observe reports the revert to the metrics.
+func (r *reorg) observe() {
+	ReorgsCount.Inc()
+	ReorgDuration.AddInt64(r.duration.Nanoseconds())
+	if depth, known := r.depth(); known {
+		ReorgDepth.ObserveInt64(int64(depth))
+	}
+	for table, count := range r.revertedRows {
+		RevertedRowsCount.AddInt64(count, table)
+	}
+}
+
+// recordReorg records the revert in the reorgs table within `tx`, the table is created if needed,
+// for schemas set up by prior versions. It does nothing on dialects without a reorgs table.
+func (l *Loader) recordReorg(ctx context.Context, tx Tx, r *reorg) error {
+	recorder, ok := dialectAs[reorgRecorder](l.getDialect())
+	if !ok {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, recorder.createReorgsQuery(l.schema, false)); err != nil {
+		return fmt.Errorf("create reorgs table: %w", err)
+	}
+
+	table := l.getDialect().EscapeIdentifier(l.schema) + "." + l.getDialect().EscapeIdentifier(REORGS_TABLE)
+	if _, err := tx.ExecContext(ctx, r.insertQuery(table)); err != nil {
+		return fmt.Errorf("record reorg: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/maps"
+)
+
+// maxCachedStatements bounds the amount of server-side prepared statements kept
+// alive by the loader. Queries are generated per table and per column set, so in
+// practice this limit is only reached by schemas with an unusual amount of tables
+// or by Substreams emitting very sparse column sets. Past the limit, statements
+// are executed directly without being cached.
+const maxCachedStatements = 1024
+
+// statement is a query along with its bind parameters, the query uses the
+// placeholders of its dialect (e.g. `$N` for Postgres, `?` for SQLite).
+type statement struct {
+	query string
+	args  []any
+
+	// oneShot statements are never prepared, used for query shapes that are
+	// unlikely to be seen again (e.g. the last partial chunk of a multi-row insert)
+	// and that would only pollute the cache.
+	oneShot bool
+}
+
+func newStatement(query string, args ...any) *statement {
+	return &statement{query: query, args: args}
+}
+
+func (s *statement) String() string {
+	return s.query
+}
+
+// statementCache holds prepared statements keyed by their query text. Queries are
+// generated deterministically from the table, the operation and the sorted column
+// set, so there is effectively one prepared statement per table/column-set pair.
+//
+// Statements are prepared against the database pool and bound to the flush transaction
+// through `(*sql.Tx).StmtContext`, `database/sql` takes care of re-preparing them on
+// the transaction's connection when needed.
+type statementCache struct {
+	db *sql.DB
+
+	lock  sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStatementCache(db *sql.DB) *statementCache {
+	return &statementCache{
+		db:    db,
+		stmts: map[string]*sql.Stmt{},
+	}
+}
+
+// exec runs the statement within `tx`. When `tx` is a real `*sql.Tx`, the query is
+// prepared once and then re-used for all subsequent executions, otherwise (testing)
+// the query is executed directly.
+func (c *statementCache) exec(ctx context.Context, tx Tx, s *statement) (sql.Result, error) {
+	sqlTx, ok := tx.(*sql.Tx)
+	if !ok || c == nil || s.oneShot {
+		return tx.ExecContext(ctx, s.query, s.args...)
+	}
+
+	stmt, err := c.get(ctx, s.query)
+	if err != nil {
+		return nil, fmt.Errorf("prepare statement: %w", err)
+	}
+
+	if stmt == nil {
+		return tx.ExecContext(ctx, s.query, s.args...)
+	}
+
+	return sqlTx.StmtContext(ctx, stmt).ExecContext(ctx, s.args...)
+}
+
+// get returns the prepared statement for the query, preparing it if it's the first
+// time it is seen. A nil statement is returned when the cache is full.
+func (c *statementCache) get(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if stmt, found := c.stmts[query]; found {
+		return stmt, nil
+	}
+
+	if len(c.stmts) >= maxCachedStatements {
+		return nil, nil
+	}
+
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *statementCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for query, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil {
+			return fmt.Errorf("close statement %q: %w", query, err)
+		}
+		delete(c.stmts, query)
+	}
+
+	return nil
+}
+
+// placeholders returns `count` Postgres bind placeholders starting at `$from`,
+// comma separated.
+func placeholders(from, count int) string {
+	var b strings.Builder
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(from + i))
+	}
+	return b.String()
+}
+
+// maxPositionalInsertRows bounds the amount of rows sent in a single multi-row INSERT
+// using positional placeholders.
+const maxPositionalInsertRows = 1000
+
+// positionalMultiRowInsert is like multiRowInsert but for dialects using `?` placeholders,
+// each statement holding at most `maxBindParameters` bind parameters and, when `maxBytes` is
+// not zero, approximately `maxBytes` bytes of arguments.
+func positionalMultiRowInsert(prefix, suffix string, columnCount int, rows [][]any, maxBindParameters int, maxBytes int) []*statement {
+	maxRows := maxPositionalInsertRows
+	if columnCount > 0 && maxBindParameters/columnCount < maxRows {
+		maxRows = maxBindParameters / columnCount
+	}
+
+	rowPlaceholders := "(" + strings.TrimSuffix(strings.Repeat("?,", columnCount), ",") + ")"
+
+	var statements []*statement
+	for _, chunk := range chunkRows(rows, maxRows, maxBytes) {
+		var query strings.Builder
+		query.WriteString(prefix)
+
+		args := make([]any, 0, len(chunk)*columnCount)
+		for i, row := range chunk {
+			if i > 0 {
+				query.WriteByte(',')
+			}
+			query.WriteString(rowPlaceholders)
+			args = append(args, row...)
+		}
+		query.WriteString(suffix)
+		query.WriteByte(';')
+
+		stmt := newStatement(query.String(), args...)
+		stmt.oneShot = len(chunk) != 1 && len(chunk) != maxRows
+		statements = append(statements, stmt)
+	}
+
+	return statements
+}
+
+// positionalPrimaryKeyWhereClause is like getPrimaryKeyWhereClauseArgs but uses `?` placeholders,
+// the column names being escaped by `escape`.
+func positionalPrimaryKeyWhereClause(primaryKey map[string]string, escape func(string) string) (string, []any) {
+	keys := maps.Keys(primaryKey)
+	sort.Strings(keys)
+
+	reg := make([]string, len(keys))
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		reg[i] = escape(key) + " = ?"
+		args[i] = primaryKey[key]
+	}
+
+	return strings.Join(reg, " AND "), args
+}
@@ -3,6 +3,9 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/streamingfast/logging"
 	"go.uber.org/zap"
@@ -15,11 +18,12 @@ func NewTestLoader(
 	tables map[string]*TableInfo,
 ) (*Loader, *TestTx) {
 
-	loader, err := NewLoader("psql://x:5432/x", 0, OnModuleHashMismatchIgnore, nil, zlog, tracer)
+	loader, err := NewLoader("psql://x:5432/x", OnModuleHashMismatchIgnore, nil, zlog, tracer)
 	if err != nil {
 		panic(err)
 	}
 	loader.testTx = &TestTx{}
+	loader.now = func() time.Time { return time.Time{} }
 	loader.tables = tables
 	loader.schema = schema
 	loader.cursorTable = tables[CURSORS_TABLE]
@@ -34,6 +38,11 @@ func TestTables(schema string) map[string]*TableInfo {
 			"from": NewColumnInfo("from", "text", ""),
 			"to":   NewColumnInfo("to", "text", ""),
 		}),
+		"balance": mustNewTableInfo(schema, "balance", []string{"owner", "token"}, map[string]*ColumnInfo{
+			"owner":  NewColumnInfo("owner", "text", ""),
+			"token":  NewColumnInfo("token", "text", ""),
+			"amount": NewColumnInfo("amount", "numeric", ""),
+		}),
 		CURSORS_TABLE: mustNewTableInfo(schema, CURSORS_TABLE, []string{"id"}, map[string]*ColumnInfo{
 			"block_num": NewColumnInfo("id", "int64", ""),
 			"block_id":  NewColumnInfo("from", "text", ""),
@@ -54,6 +63,8 @@ func mustNewTableInfo(schema, name string, pkList []string, columnsByName map[st
 type TestTx struct {
 	queries []string
 	next    []*sql.Rows
+
+	commitErr error // returned by Commit when set
 }
 
 func (t *TestTx) Rollback() error {
@@ -63,11 +74,11 @@ func (t *TestTx) Rollback() error {
 
 func (t *TestTx) Commit() error {
 	t.queries = append(t.queries, "COMMIT")
-	return nil
+	return t.commitErr
 }
 
 func (t *TestTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
-	t.queries = append(t.queries, query)
+	t.queries = append(t.queries, testQuery(query, args))
 	return &testResult{}, nil
 }
 
@@ -76,10 +87,37 @@ func (t *TestTx) Results() []string {
 }
 
 func (t *TestTx) QueryContext(ctx context.Context, query string, args ...any) (out *sql.Rows, err error) {
-	t.queries = append(t.queries, query)
+	t.queries = append(t.queries, testQuery(query, args))
 	return nil, nil
 }
 
+// CopyIn records the COPY query along with all its rows, in the form
+// `<query> -- [<row1 arg1>, <row1 arg2>] [<row2 arg1>, <row2 arg2>]`.
+func (t *TestTx) CopyIn(ctx context.Context, query string, rows [][]any) error {
+	renderedRows := make([]string, len(rows))
+	for i, row := range rows {
+		renderedRows[i] = strings.TrimPrefix(testQuery("", row), " -- ")
+	}
+
+	t.queries = append(t.queries, query+" -- "+strings.Join(renderedRows, " "))
+	return nil
+}
+
+// testQuery renders the query along with its bind parameters, if any, in the
+// form `<query> -- [<arg1>, <arg2>]` so tests can assert on both at once.
+func testQuery(query string, args []any) string {
+	if len(args) == 0 {
+		return query
+	}
+
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = fmt.Sprintf("%v", arg)
+	}
+
+	return query + " -- [" + strings.Join(values, ", ") + "]"
+}
+
 type testResult struct{}
 
 func (t *testResult) LastInsertId() (int64, error) {
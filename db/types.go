@@ -1,8 +1,11 @@
 package db
 
 import (
+	"database/sql"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 )
 
 //go:generate go-enum -f=$GOFILE --marshal --names -nocase
@@ -27,11 +30,28 @@ type TableInfo struct {
 	// Identifier is equivalent to 'escape(<schema>).escape(<name>)' but pre-computed
 	// for usage when computing queries.
 	identifier string
+
+	// engine is the ClickHouse table engine, zero on other databases.
+	engine clickhouseEngine
+
+	// partitioning is the Postgres range partitioning of the table on a block number column,
+	// nil when the table is not partitioned.
+	partitioning *postgresPartitioning
+
+	// references are the identifiers of the other tables referenced by the Postgres foreign keys
+	// of the table.
+	references []string
 }
 
 func NewTableInfo(schema, name string, pkList []string, columnsByName map[string]*ColumnInfo) (*TableInfo, error) {
-	schemaEscaped := EscapeIdentifier(schema)
-	nameEscaped := EscapeIdentifier(name)
+	return newTableInfo(schema, name, pkList, columnsByName, EscapeIdentifier)
+}
+
+// newTableInfo is like NewTableInfo but escapes the schema and table names using `escape`,
+// the escaping of identifiers being dialect specific.
+func newTableInfo(schema, name string, pkList []string, columnsByName map[string]*ColumnInfo, escape func(string) string) (*TableInfo, error) {
+	schemaEscaped := escape(schema)
+	nameEscaped := escape(name)
 	primaryColumns := make([]*ColumnInfo, len(pkList))
 
 	for i, primaryKeyColumnName := range pkList {
@@ -57,6 +77,53 @@ func NewTableInfo(schema, name string, pkList []string, columnsByName map[string
 	}, nil
 }
 
+// Schema returns the table's schema name.
+func (t *TableInfo) Schema() string {
+	return t.schema
+}
+
+// Name returns the table's name.
+func (t *TableInfo) Name() string {
+	return t.name
+}
+
+// Identifier returns the escaped `<schema>.<name>` identifier of the table.
+func (t *TableInfo) Identifier() string {
+	return t.identifier
+}
+
+// Column returns the column named `name`.
+func (t *TableInfo) Column(name string) (*ColumnInfo, bool) {
+	column, found := t.columnsByName[name]
+	return column, found
+}
+
+// PrimaryColumns returns the columns of the table's primary key, in order.
+func (t *TableInfo) PrimaryColumns() []*ColumnInfo {
+	return t.primaryColumns
+}
+
+// checkPrimaryKey ensures the primary key received has a value for each of the table's primary
+// key column(s), a partial key used in a WHERE clause would otherwise match more than one row.
+func (t *TableInfo) checkPrimaryKey(primaryKey map[string]string) error {
+	for _, column := range t.primaryColumns {
+		if _, found := primaryKey[column.name]; !found {
+			return fmt.Errorf("primary key %q is missing column %q of table %s primary key (columns: %s)", createRowUniqueID(primaryKey), column.name, t.identifier, t.primaryColumnNames())
+		}
+	}
+
+	return nil
+}
+
+func (t *TableInfo) primaryColumnNames() string {
+	names := make([]string, len(t.primaryColumns))
+	for i, column := range t.primaryColumns {
+		names[i] = column.name
+	}
+
+	return strings.Join(names, ",")
+}
+
 type ColumnInfo struct {
 	name             string
 	escapedName      string
@@ -72,3 +139,47 @@ func NewColumnInfo(name string, databaseTypeName string, scanType any) *ColumnIn
 		scanType:         reflect.TypeOf(scanType),
 	}
 }
+
+// Name returns the column's name.
+func (c *ColumnInfo) Name() string {
+	return c.name
+}
+
+// EscapedName returns the column's name escaped by the dialect.
+func (c *ColumnInfo) EscapedName() string {
+	return c.escapedName
+}
+
+// DatabaseTypeName returns the column's type as reported by the database.
+func (c *ColumnInfo) DatabaseTypeName() string {
+	return c.databaseTypeName
+}
+
+// ScanType returns the Go type of the column's values.
+func (c *ColumnInfo) ScanType() reflect.Type {
+	return c.scanType
+}
+
+// driverScanTypes maps the scan types reported by some drivers to the Go type of the column's
+// values: `sql.Null*` types, reported for columns that can hold NULL (e.g. SQLite, MySQL), to
+// the type they wrap and `sql.RawBytes`, reported for textual columns (e.g. MySQL), to string.
+var driverScanTypes = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(sql.NullString{}):  reflect.TypeOf(""),
+	reflect.TypeOf(sql.NullInt64{}):   reflect.TypeOf(int64(0)),
+	reflect.TypeOf(sql.NullInt32{}):   reflect.TypeOf(int32(0)),
+	reflect.TypeOf(sql.NullInt16{}):   reflect.TypeOf(int16(0)),
+	reflect.TypeOf(sql.NullFloat64{}): reflect.TypeOf(float64(0)),
+	reflect.TypeOf(sql.NullBool{}):    reflect.TypeOf(false),
+	reflect.TypeOf(sql.NullTime{}):    reflect.TypeOf(time.Time{}),
+	reflect.TypeOf(sql.RawBytes{}):    reflect.TypeOf(""),
+}
+
+// columnScanType returns the Go type of the column's values, see driverScanTypes.
+func columnScanType(column *sql.ColumnType) reflect.Type {
+	scanType := column.ScanType()
+	if unwrapped, found := driverScanTypes[scanType]; found {
+		return unwrapped
+	}
+
+	return scanType
+}
@@ -0,0 +1,107 @@
+package sinker
+
+import (
+	"time"
+)
+
+// FlushPolicy decides when the pending operations are written to the database, a flush
+// is triggered by whichever limit is reached first. A zero limit is disabled.
+type FlushPolicy struct {
+	// Blocks flushes on each block whose number is a multiple of it while catching up,
+	// defaults to HISTORICAL_BLOCK_FLUSH_EACH when zero.
+	Blocks uint64
+
+	// LiveBlocks flushes on each block whose number is a multiple of it when live,
+	// defaults to LIVE_BLOCK_FLUSH_EACH when zero.
+	LiveBlocks uint64
+
+	// LiveMaxLatency bounds the time a live block waits to be flushed when batching
+	// live blocks, the flush happens even if no other block is received meanwhile.
+	LiveMaxLatency time.Duration
+
+	// Rows flushes once that many rows are waiting to be written.
+	Rows uint64
+
+	// Bytes flushes once the data waiting to be written reaches approximately that size.
+	Bytes uint64
+
+	// Interval flushes once that much time has elapsed since the last flush.
+	Interval time.Duration
+}
+
+type flushReason string
+
+const (
+	flushReasonNone     flushReason = ""
+	flushReasonBlocks   flushReason = "blocks"
+	flushReasonRows     flushReason = "rows"
+	flushReasonBytes    flushReason = "bytes"
+	flushReasonInterval flushReason = "interval"
+	flushReasonLatency  flushReason = "latency"
+	flushReasonUndo     flushReason = "undo"
+)
+
+// pendingState describes the operations waiting to be written to the database.
+type pendingState struct {
+	rows  uint64
+	bytes uint64
+
+	sinceLastFlush time.Duration
+
+	// sinceFirstBlock is the time elapsed since the oldest block waiting to be
+	// written was received.
+	sinceFirstBlock time.Duration
+}
+
+// flushReason returns why the pending operations must be flushed after block `blockNum`,
+// flushReasonNone if they can keep accumulating.
+func (p FlushPolicy) flushReason(blockNum uint64, isLive bool, pending pendingState) flushReason {
+	if blockNum%p.blockModulo(isLive) == 0 {
+		return flushReasonBlocks
+	}
+
+	if p.Rows > 0 && pending.rows >= p.Rows {
+		return flushReasonRows
+	}
+
+	if p.Bytes > 0 && pending.bytes >= p.Bytes {
+		return flushReasonBytes
+	}
+
+	if p.Interval > 0 && pending.sinceLastFlush >= p.Interval {
+		return flushReasonInterval
+	}
+
+	if isLive && p.LiveMaxLatency > 0 && pending.sinceFirstBlock >= p.LiveMaxLatency {
+		return flushReasonLatency
+	}
+
+	return flushReasonNone
+}
+
+func (p FlushPolicy) blockModulo(isLive bool) uint64 {
+	if isLive {
+		if p.LiveBlocks > 0 {
+			return p.LiveBlocks
+		}
+
+		return LIVE_BLOCK_FLUSH_EACH
+	}
+
+	if p.Blocks > 0 {
+		return p.Blocks
+	}
+
+	return HISTORICAL_BLOCK_FLUSH_EACH
+}
+
+// withoutTimeLimits returns the policy without the limits triggering flushes after some time,
+// flushes then end on blocks that do not depend on when the blocks were received. It also reports
+// whether such a limit had an effect.
+func (p FlushPolicy) withoutTimeLimits() (FlushPolicy, bool) {
+	hadEffect := p.Interval > 0 || (p.LiveMaxLatency > 0 && p.blockModulo(true) > 1)
+
+	p.Interval = 0
+	p.LiveMaxLatency = 0
+	return p, hadEffect
+}
@@ -0,0 +1,77 @@
+package sinker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushPolicy_flushReason(t *testing.T) {
+	type state struct {
+		blockNum        uint64
+		isLive          bool
+		pendingRows     uint64
+		pendingBytes    uint64
+		sinceLastFlush  time.Duration
+		sinceFirstBlock time.Duration
+	}
+
+	tests := []struct {
+		name   string
+		policy FlushPolicy
+		state  state
+		expect flushReason
+	}{
+		{"default blocks, not reached", FlushPolicy{}, state{blockNum: 999}, flushReasonNone},
+		{"default blocks, reached", FlushPolicy{}, state{blockNum: 2000}, flushReasonBlocks},
+		{"custom blocks, reached", FlushPolicy{Blocks: 10}, state{blockNum: 30}, flushReasonBlocks},
+		{"custom blocks, not reached", FlushPolicy{Blocks: 10}, state{blockNum: 31}, flushReasonNone},
+		{"live flushes every block by default", FlushPolicy{Blocks: 10}, state{blockNum: 31, isLive: true}, flushReasonBlocks},
+		{"live blocks, reached", FlushPolicy{LiveBlocks: 5}, state{blockNum: 35, isLive: true}, flushReasonBlocks},
+		{"live blocks, not reached", FlushPolicy{LiveBlocks: 5}, state{blockNum: 36, isLive: true}, flushReasonNone},
+		{"live blocks, not used when catching up", FlushPolicy{LiveBlocks: 5}, state{blockNum: 35}, flushReasonNone},
+
+		{"live latency, reached", FlushPolicy{LiveBlocks: 5, LiveMaxLatency: time.Second}, state{blockNum: 36, isLive: true, sinceFirstBlock: time.Second}, flushReasonLatency},
+		{"live latency, not reached", FlushPolicy{LiveBlocks: 5, LiveMaxLatency: time.Second}, state{blockNum: 36, isLive: true, sinceFirstBlock: time.Millisecond}, flushReasonNone},
+		{"live latency, not used when catching up", FlushPolicy{LiveMaxLatency: time.Second}, state{blockNum: 36, sinceFirstBlock: time.Hour}, flushReasonNone},
+
+		{"rows, reached", FlushPolicy{Rows: 100}, state{blockNum: 1, pendingRows: 100}, flushReasonRows},
+		{"rows, not reached", FlushPolicy{Rows: 100}, state{blockNum: 1, pendingRows: 99}, flushReasonNone},
+		{"rows, disabled", FlushPolicy{}, state{blockNum: 1, pendingRows: 1_000_000}, flushReasonNone},
+
+		{"bytes, reached", FlushPolicy{Bytes: 1024}, state{blockNum: 1, pendingBytes: 2048}, flushReasonBytes},
+		{"bytes, not reached", FlushPolicy{Bytes: 1024}, state{blockNum: 1, pendingBytes: 1023}, flushReasonNone},
+		{"bytes, disabled", FlushPolicy{}, state{blockNum: 1, pendingBytes: 1 << 40}, flushReasonNone},
+
+		{"interval, reached", FlushPolicy{Interval: time.Minute}, state{blockNum: 1, sinceLastFlush: 2 * time.Minute}, flushReasonInterval},
+		{"interval, not reached", FlushPolicy{Interval: time.Minute}, state{blockNum: 1, sinceLastFlush: time.Second}, flushReasonNone},
+		{"interval, disabled", FlushPolicy{}, state{blockNum: 1, sinceLastFlush: time.Hour}, flushReasonNone},
+
+		{"first limit hit wins", FlushPolicy{Rows: 100, Bytes: 1024}, state{blockNum: 1, pendingRows: 10, pendingBytes: 4096}, flushReasonBytes},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.state
+			assert.Equal(t, test.expect, test.policy.flushReason(s.blockNum, s.isLive, pendingState{
+				rows:            s.pendingRows,
+				bytes:           s.pendingBytes,
+				sinceLastFlush:  s.sinceLastFlush,
+				sinceFirstBlock: s.sinceFirstBlock,
+			}))
+		})
+	}
+}
+
+func TestFlushPolicy_withoutTimeLimits(t *testing.T) {
+	policy, hadEffect := FlushPolicy{Blocks: 10, Rows: 100, Interval: time.Minute, LiveMaxLatency: time.Second}.withoutTimeLimits()
+	assert.Equal(t, FlushPolicy{Blocks: 10, Rows: 100}, policy)
+	assert.True(t, hadEffect)
+
+	_, hadEffect = FlushPolicy{LiveMaxLatency: time.Second}.withoutTimeLimits()
+	assert.False(t, hadEffect, "latency is not used when flushing every live block")
+
+	_, hadEffect = FlushPolicy{LiveBlocks: 5, LiveMaxLatency: time.Second}.withoutTimeLimits()
+	assert.True(t, hadEffect)
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/logging"
 	"github.com/streamingfast/shutter"
 	sink "github.com/streamingfast/substreams-sink"
@@ -22,6 +25,11 @@ const (
 	LIVE_BLOCK_FLUSH_EACH       = 1
 )
 
+// TableChange_UPSERT is the `UPSERT` value of the `sf.substreams.sink.database.v1.TableChange.Operation`
+// enum. The generated bindings we depend on predate it, Protobuf enums being open, the value
+// is still received as-is.
+const TableChange_UPSERT pbdatabase.TableChange_Operation = 4
+
 type SQLSinker struct {
 	*shutter.Shutter
 	*sink.Sinker
@@ -30,10 +38,33 @@ type SQLSinker struct {
 	logger *zap.Logger
 	tracer logging.Tracer
 
+	flushPolicy FlushPolicy
+	lastFlushAt time.Time
+
+	// lock protects the loader and the pending batch, live blocks being flushed either
+	// by the stream handlers or by the latency timer.
+	lock sync.Mutex
+
+	// pendingCursor is the cursor of the last block applied to the loader that has not
+	// been flushed yet, nil if there is none.
+	pendingCursor  *sink.Cursor
+	pendingSince   time.Time
+	latencyTimer   *time.Timer
+	lastFinalBlock uint64
+
+	completed atomic.Bool
+
 	stats *Stats
 }
 
-func New(sink *sink.Sinker, loader *db.Loader, logger *zap.Logger, tracer logging.Tracer) (*SQLSinker, error) {
+func New(sink *sink.Sinker, loader *db.Loader, flushPolicy FlushPolicy, logger *zap.Logger, tracer logging.Tracer) (*SQLSinker, error) {
+	if loader.DeduplicatesReplays() {
+		var hadTimeLimits bool
+		if flushPolicy, hadTimeLimits = flushPolicy.withoutTimeLimits(); hadTimeLimits {
+			logger.Warn("time based flush limits are ignored, the database deduplicates replayed flushes only when they end on the same blocks")
+		}
+	}
+
 	return &SQLSinker{
 		Shutter: shutter.New(),
 		Sinker:  sink,
@@ -42,6 +73,9 @@ func New(sink *sink.Sinker, loader *db.Loader, logger *zap.Logger, tracer loggin
 		logger: logger,
 		tracer: tracer,
 
+		flushPolicy: flushPolicy,
+		lastFlushAt: time.Now(),
+
 		stats: NewStats(logger),
 	}, nil
 }
@@ -69,6 +103,14 @@ func (s *SQLSinker) Run(ctx context.Context) {
 	}
 
 	s.Sinker.OnTerminating(s.Shutdown)
+	s.OnTerminating(func(err error) {
+		// On a clean termination, the last flush must complete for its cursor to be persisted
+		if err == nil {
+			if err := s.loader.WaitForFlush(); err != nil {
+				s.logger.Warn("last flush to database failed", zap.Error(err))
+			}
+		}
+	})
 	s.OnTerminating(func(err error) {
 		s.stats.LogNow()
 		s.logger.Info("sql sinker terminating", zap.Stringer("last_block_written", s.stats.lastBlock))
@@ -84,17 +126,27 @@ func (s *SQLSinker) Run(ctx context.Context) {
 	}
 
 	s.stats.Start(logEach, cursor)
+	s.lastFlushAt = time.Now()
 
 	s.logger.Info("starting sql sink",
 		zap.Duration("stats_refresh_each", logEach),
 		zap.Stringer("restarting_at", cursor.Block()),
 		zap.String("database", s.loader.GetDatabase()),
 		zap.String("schema", s.loader.GetSchema()),
+		zap.Uint64("flush_blocks", s.flushPolicy.blockModulo(false)),
+		zap.Uint64("flush_live_blocks", s.flushPolicy.blockModulo(true)),
+		zap.Duration("flush_live_max_latency", s.flushPolicy.LiveMaxLatency),
+		zap.Uint64("flush_max_rows", s.flushPolicy.Rows),
+		zap.Uint64("flush_max_bytes", s.flushPolicy.Bytes),
+		zap.Duration("flush_max_delay", s.flushPolicy.Interval),
 	)
 	s.Sinker.Run(ctx, cursor, s)
 }
 
 func (s *SQLSinker) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	output := data.Output
 
 	if output.Name != s.OutputModuleName() {
@@ -118,16 +170,79 @@ func (s *SQLSinker) HandleBlockScopedData(ctx context.Context, data *pbsubstream
 		return fmt.Errorf("apply database changes: %w", err)
 	}
 
-	if data.Clock.Number%s.batchBlockModulo(data, isLive) == 0 {
-		s.logger.Debug("flushing to database", zap.Stringer("block", cursor.Block()), zap.Bool("is_live", *isLive))
+	if isLive == nil {
+		panic(fmt.Errorf("liveness checker has been disabled on the Sinker instance, this is invalid in the context of 'substreams-sink-sql'"))
+	}
+
+	if s.pendingCursor == nil {
+		s.pendingSince = time.Now()
+	}
+	s.pendingCursor = cursor
+	s.lastFinalBlock = data.FinalBlockHeight
+
+	reason := s.flushPolicy.flushReason(data.Clock.Number, *isLive, pendingState{
+		rows:            s.loader.PendingRows(),
+		bytes:           s.loader.PendingBytes(),
+		sinceLastFlush:  time.Since(s.lastFlushAt),
+		sinceFirstBlock: time.Since(s.pendingSince),
+	})
+
+	if reason != flushReasonNone {
+		return s.flush(ctx, reason)
+	}
+
+	// Batched live blocks must not wait for the next block to be flushed, which could take
+	// an arbitrary amount of time, the timer flushes them once the latency bound is reached.
+	if *isLive && s.flushPolicy.LiveMaxLatency > 0 && s.latencyTimer == nil {
+		s.latencyTimer = time.AfterFunc(s.flushPolicy.LiveMaxLatency-time.Since(s.pendingSince), s.onLatencyTimeout)
+	}
+
+	return nil
+}
+
+// flush writes the pending blocks to the database. The flush runs in the background while
+// the next blocks accumulate, the cursor being committed along the flushed operations. A
+// failed flush shuts down the sinker.
+func (s *SQLSinker) flush(ctx context.Context, reason flushReason) error {
+	cursor := s.pendingCursor
+	s.logger.Debug("flushing to database", zap.Stringer("block", cursor.Block()), zap.String("reason", string(reason)))
+
+	s.pendingCursor = nil
+	s.lastFlushAt = time.Now()
+	if s.latencyTimer != nil {
+		s.latencyTimer.Stop()
+		s.latencyTimer = nil
+	}
+
+	if err := s.loader.FlushAsync(ctx, s.OutputModuleHash(), cursor, s.lastFinalBlock, s.onFlushed(cursor.Block())); err != nil {
+		return fmt.Errorf("failed to flush at block %s: %w", cursor.Block(), err)
+	}
+
+	return nil
+}
+
+func (s *SQLSinker) onLatencyTimeout() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The pending blocks might have been flushed while the timer was firing, in which
+	// case a new batch could have started and be waiting on its own timer.
+	if s.IsTerminating() || s.pendingCursor == nil || time.Since(s.pendingSince) < s.flushPolicy.LiveMaxLatency {
+		return
+	}
+
+	if err := s.flush(context.Background(), flushReasonLatency); err != nil {
+		s.Shutdown(err)
+	}
+}
 
-		flushStart := time.Now()
-		rowFlushedCount, err := s.loader.Flush(ctx, s.OutputModuleHash(), cursor, data.FinalBlockHeight)
+func (s *SQLSinker) onFlushed(block bstream.BlockRef) func(rowFlushedCount int, flushDuration time.Duration, err error) {
+	return func(rowFlushedCount int, flushDuration time.Duration, err error) {
 		if err != nil {
-			return fmt.Errorf("failed to flush at block %s: %w", cursor.Block(), err)
+			s.Shutdown(fmt.Errorf("failed to flush at block %s: %w", block, err))
+			return
 		}
 
-		flushDuration := time.Since(flushStart)
 		if flushDuration > 5*time.Second {
 			level := zap.InfoLevel
 			if flushDuration > 30*time.Second {
@@ -141,11 +256,9 @@ func (s *SQLSinker) HandleBlockScopedData(ctx context.Context, data *pbsubstream
 		FlushedRowsCount.AddInt(rowFlushedCount)
 		FlushDuration.AddInt64(flushDuration.Nanoseconds())
 
-		s.stats.RecordBlock(cursor.Block())
+		s.stats.RecordBlock(block)
 		s.stats.RecordFlushDuration(flushDuration)
 	}
-
-	return nil
 }
 
 func (s *SQLSinker) applyDatabaseChanges(dbChanges *pbdatabase.DatabaseChanges, blockNum, finalBlockNum uint64) error {
@@ -199,6 +312,11 @@ func (s *SQLSinker) applyDatabaseChanges(dbChanges *pbdatabase.DatabaseChanges,
 			if err != nil {
 				return fmt.Errorf("database delete: %w", err)
 			}
+		case TableChange_UPSERT:
+			err := s.loader.Upsert(change.Table, primaryKeys, changes, reversibleBlockNum)
+			if err != nil {
+				return fmt.Errorf("database upsert: %w", err)
+			}
 		default:
 			//case database.TableChange_UNSET:
 		}
@@ -206,22 +324,52 @@ func (s *SQLSinker) applyDatabaseChanges(dbChanges *pbdatabase.DatabaseChanges,
 	return nil
 }
 
-func (s *SQLSinker) HandleBlockUndoSignal(ctx context.Context, data *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
-	return s.loader.Revert(ctx, s.OutputModuleHash(), cursor, data.LastValidBlock.Number)
-}
+// HandleBlockRangeCompletion is called once the requested block range has been fully processed,
+// the pending operations are flushed along the final cursor and the module is marked as completed.
+func (s *SQLSinker) HandleBlockRangeCompletion(ctx context.Context, cursor *sink.Cursor) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-func (s *SQLSinker) batchBlockModulo(blockData *pbsubstreamsrpc.BlockScopedData, isLive *bool) uint64 {
-	if isLive == nil {
-		panic(fmt.Errorf("liveness checker has been disabled on the Sinker instance, this is invalid in the context of 'substreams-sink-sql'"))
+	s.logger.Info("stream completed, flushing pending operations and final cursor", zap.Stringer("block", cursor.Block()))
+
+	s.pendingCursor = nil
+	if s.latencyTimer != nil {
+		s.latencyTimer.Stop()
+		s.latencyTimer = nil
 	}
 
-	if *isLive {
-		return LIVE_BLOCK_FLUSH_EACH
+	flushStart := time.Now()
+	rowFlushedCount, err := s.loader.Flush(ctx, s.OutputModuleHash(), cursor, s.lastFinalBlock)
+	if err != nil {
+		return fmt.Errorf("failed to flush at block %s: %w", cursor.Block(), err)
 	}
+	s.onFlushed(cursor.Block())(rowFlushedCount, time.Since(flushStart), nil)
 
-	if s.loader.FlushInterval() > 0 {
-		return uint64(s.loader.FlushInterval())
+	if err := s.loader.MarkCompleted(ctx, s.OutputModuleHash(), cursor); err != nil {
+		return fmt.Errorf("mark module as completed: %w", err)
 	}
 
-	return HISTORICAL_BLOCK_FLUSH_EACH
+	s.completed.Store(true)
+	return nil
+}
+
+// Completed returns true once the requested block range has been fully processed and
+// written to the database.
+func (s *SQLSinker) Completed() bool {
+	return s.completed.Load()
+}
+
+func (s *SQLSinker) HandleBlockUndoSignal(ctx context.Context, data *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Batched live blocks are flushed first, recording their history, the ones above the
+	// last valid block being then reverted like any other block.
+	if s.pendingCursor != nil {
+		if err := s.flush(ctx, flushReasonUndo); err != nil {
+			return err
+		}
+	}
+
+	return s.loader.Revert(ctx, s.OutputModuleHash(), cursor, data.LastValidBlock.Number)
 }
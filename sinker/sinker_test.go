@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/logging"
@@ -29,6 +30,17 @@ func init() {
 	logger, tracer = logging.ApplicationLogger("test", "test")
 }
 
+// createReorgsTableSQL is the DDL run before recording a revert in the reorgs table.
+var createReorgsTableSQL = "create table if not exists \"testschema\".\"substreams_reorgs\"\n(\n" +
+	"\tid               BIGSERIAL PRIMARY KEY,\n" +
+	"\tmodule_hash      text,\n" +
+	"\tlast_valid_block bigint,\n" +
+	"\tcursor_before    text,\n" +
+	"\tcursor_after     text,\n" +
+	"\treverted_rows    jsonb,\n" +
+	"\tduration_ms      bigint,\n" +
+	"\treverted_at      timestamp with time zone default now()\n);"
+
 func TestInserts(t *testing.T) {
 
 	type event struct {
@@ -40,6 +52,7 @@ func TestInserts(t *testing.T) {
 
 	tests := []struct {
 		name           string
+		flushPolicy    FlushPolicy
 		events         []event
 		expectSQL      []string
 		queryResponses []*sql.Rows
@@ -54,8 +67,8 @@ func TestInserts(t *testing.T) {
 				},
 			},
 			expectSQL: []string{
-				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender1','1234','receiver1');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 10;`,
+				`COPY "testschema"."xfer" ("from","id","to") FROM STDIN -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 10 LIMIT 10000);`,
 				`UPDATE "testschema"."cursors" set cursor = 'bN7dsAhRyo44yl_ykkjA36WwLpc_DFtvXwrlIBBBj4r2', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
 				`COMMIT`,
 			},
@@ -75,16 +88,34 @@ func TestInserts(t *testing.T) {
 				},
 			},
 			expectSQL: []string{
-				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender1','1234','receiver1');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 10;`,
+				`COPY "testschema"."xfer" ("from","id","to") FROM STDIN -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 10 LIMIT 10000);`,
 				`UPDATE "testschema"."cursors" set cursor = 'bN7dsAhRyo44yl_ykkjA36WwLpc_DFtvXwrlIBBBj4r2', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
 				`COMMIT`,
-				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender2','2345','receiver2');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 11;`,
+				`COPY "testschema"."xfer" ("from","id","to") FROM STDIN -- [sender2, 2345, receiver2]`,
 				`UPDATE "testschema"."cursors" set cursor = 'dR5-m-1v1TQvlVRfIM9SXaWwLpc_DFtuXwrkIBBAj4r3', block_num = 11, block_id = '11' WHERE id = '756e75736564';`,
 				`COMMIT`,
 			},
 		},
+		{
+			name: "insert two rows in a final block (copy)",
+			events: []event{
+				{
+					blockNum: 10,
+					libNum:   10,
+					tableChanges: []*pbdatabase.TableChange{
+						insertRowSinglePK("xfer", "1234", "from", "sender1", "to", "receiver1"),
+						insertRowSinglePK("xfer", "2345", "from", "sender2", "to", "receiver2"),
+					},
+				},
+			},
+			expectSQL: []string{
+				`COPY "testschema"."xfer" ("from","id","to") FROM STDIN -- [sender1, 1234, receiver1] [sender2, 2345, receiver2]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 10 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'bN7dsAhRyo44yl_ykkjA36WwLpc_DFtvXwrlIBBBj4r2', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				`COMMIT`,
+			},
+		},
 		{
 			name: "insert a reversible blocks",
 			events: []event{
@@ -95,9 +126,9 @@ func TestInserts(t *testing.T) {
 				},
 			},
 			expectSQL: []string{
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ('I','"testschema"."xfer"','{"id":"1234"}',10);` +
-					`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender1','1234','receiver1');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 5;`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234"}, 10]`,
+				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3); -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
 				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
 				`COMMIT`,
 			},
@@ -119,14 +150,13 @@ func TestInserts(t *testing.T) {
 				},
 			},
 			expectSQL: []string{
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ('I','"testschema"."xfer"','{"id":"1234","idx":"3"}',10);` +
-					`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender1','1234','receiver1');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 5;`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234","idx":"3"}, 10]`,
+				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3); -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
 				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
 				`COMMIT`,
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT 'U','"testschema"."xfer"','{"id":"2345","idx":"3"}',row_to_json("xfer"),11 FROM "testschema"."xfer" WHERE "id" = '2345' AND "idx" = '3';` +
-					`UPDATE "testschema"."xfer" SET "from"='sender2', "to"='receiver2' WHERE "id" = '2345' AND "idx" = '3'`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 6;`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("xfer"),$4::bigint FROM "testschema"."xfer" WHERE "id" = $5 AND "idx" = $6; -- [U, "testschema"."xfer", {"id":"2345","idx":"3"}, 11, 2345, 3]`,
+				`UPDATE "testschema"."xfer" SET "from"=$1, "to"=$2 WHERE "id" = $3 AND "idx" = $4 -- [sender2, receiver2, 2345, 3]`,
 				`UPDATE "testschema"."cursors" set cursor = 'LamYQ1PoEJyzLTRd7kdEiKWwLpcyB1tlVArvLBtH', block_num = 11, block_id = '11' WHERE id = '756e75736564';`,
 				`COMMIT`,
 			},
@@ -150,22 +180,96 @@ func TestInserts(t *testing.T) {
 				},
 			},
 			expectSQL: []string{
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ('I','"testschema"."xfer"','{"id":"1234","idx":"3"}',10);` +
-					`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender1','1234','receiver1');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 5;`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234","idx":"3"}, 10]`,
+				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3); -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
 				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
 				`COMMIT`,
 				// the following gets deduped
-				//`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT 'U','"testschema"."xfer"','{"id":"2345","idx":"3"}',row_to_json("xfer"),11 FROM "testschema"."xfer" WHERE "id" = '2345' AND "idx" = '3';` +
-				//	`UPDATE "testschema"."xfer" SET "from"='sender2', "to"='receiver2' WHERE "id" = '2345' AND "idx" = '3'`,
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT 'D','"testschema"."xfer"','{"id":"2345","idx":"3"}',row_to_json("xfer"),11 FROM "testschema"."xfer" WHERE "id" = '2345' AND "idx" = '3';` +
-					`DELETE FROM "testschema"."xfer" WHERE "id" = '2345' AND "idx" = '3'`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 6;`,
+				//`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("xfer"),$4::bigint FROM "testschema"."xfer" WHERE "id" = $5 AND "idx" = $6; -- [U, "testschema"."xfer", {"id":"2345","idx":"3"}, 11, 2345, 3]`,
+				//`UPDATE "testschema"."xfer" SET "from"=$1, "to"=$2 WHERE "id" = $3 AND "idx" = $4 -- [sender2, receiver2, 2345, 3]`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("xfer"),$4::bigint FROM "testschema"."xfer" WHERE "id" = $5 AND "idx" = $6; -- [D, "testschema"."xfer", {"id":"2345","idx":"3"}, 11, 2345, 3]`,
+				`DELETE FROM "testschema"."xfer" WHERE "id" = $1 AND "idx" = $2 -- [2345, 3]`,
 				`UPDATE "testschema"."cursors" set cursor = 'LamYQ1PoEJyzLTRd7kdEiKWwLpcyB1tlVArvLBtH', block_num = 11, block_id = '11' WHERE id = '756e75736564';`,
 				`COMMIT`,
 			},
 		},
 
+		{
+			name: "upsert final block",
+			events: []event{
+				{
+					blockNum:     10,
+					libNum:       10,
+					tableChanges: []*pbdatabase.TableChange{upsertRowSinglePK("xfer", "1234", "from", "sender1", "to", "receiver1")},
+				},
+			},
+			expectSQL: []string{
+				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3) ON CONFLICT ("id") DO UPDATE SET "from"=EXCLUDED."from", "to"=EXCLUDED."to"; -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 10 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'bN7dsAhRyo44yl_ykkjA36WwLpc_DFtvXwrlIBBBj4r2', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				`COMMIT`,
+			},
+		},
+		{
+			name: "upsert reversible block",
+			events: []event{
+				{
+					blockNum:     10,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{upsertRowSinglePK("xfer", "1234", "from", "sender1")},
+				},
+			},
+			expectSQL: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT CASE WHEN prev IS NULL THEN 'I' ELSE 'U' END,$1::text,$2::jsonb,prev,$3::bigint FROM (SELECT (SELECT to_jsonb("xfer") FROM "testschema"."xfer" WHERE "id" = $4) AS prev) AS existing; -- ["testschema"."xfer", {"id":"1234"}, 10, 1234]`,
+				`INSERT INTO "testschema"."xfer" ("from","id") VALUES ($1,$2) ON CONFLICT ("id") DO UPDATE SET "from"=EXCLUDED."from"; -- [sender1, 1234]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				`COMMIT`,
+			},
+		},
+
+		{
+			name: "delete with composite primary key",
+			events: []event{
+				{
+					blockNum:     10,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{deleteRowMultiplePK("balance", map[string]string{"owner": "0xdead", "token": "0xbeef"})},
+				},
+			},
+			expectSQL: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("balance"),$4::bigint FROM "testschema"."balance" WHERE "owner" = $5 AND "token" = $6; -- [D, "testschema"."balance", {"owner":"0xdead","token":"0xbeef"}, 10, 0xdead, 0xbeef]`,
+				`DELETE FROM "testschema"."balance" WHERE "owner" = $1 AND "token" = $2 -- [0xdead, 0xbeef]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				`COMMIT`,
+			},
+		},
+
+		{
+			name: "delete, then insert again in the same block",
+			events: []event{
+				{
+					blockNum: 10,
+					libNum:   5,
+					tableChanges: []*pbdatabase.TableChange{
+						deleteRowMultiplePK("xfer", map[string]string{"id": "1234"}),
+						insertRowSinglePK("xfer", "1234", "from", "sender1"),
+					},
+				},
+			},
+			expectSQL: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("xfer"),$4::bigint FROM "testschema"."xfer" WHERE "id" = $5; -- [D, "testschema"."xfer", {"id":"1234"}, 10, 1234]`,
+				`DELETE FROM "testschema"."xfer" WHERE "id" = $1 -- [1234]`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234"}, 10]`,
+				`INSERT INTO "testschema"."xfer" ("from","id") VALUES ($1,$2); -- [sender1, 1234]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				`COMMIT`,
+			},
+		},
+
 		{
 			name: "insert two reversible blocks, then UNDO last",
 			events: []event{
@@ -186,21 +290,88 @@ func TestInserts(t *testing.T) {
 				},
 			},
 			expectSQL: []string{
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ('I','"testschema"."xfer"','{"id":"1234"}',10);` +
-					`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender1','1234','receiver1');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 5;`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234"}, 10]`,
+				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3); -- [sender1, 1234, receiver1]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
 				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
 				`COMMIT`,
-				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ('I','"testschema"."xfer"','{"id":"2345"}',11);` +
-					`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ('sender2','2345','receiver2');`,
-				`DELETE FROM "testschema"."substreams_history" WHERE block_num <= 5;`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"2345"}, 11]`,
+				`INSERT INTO "testschema"."xfer" ("from","id","to") VALUES ($1,$2,$3); -- [sender2, 2345, receiver2]`,
 				`UPDATE "testschema"."cursors" set cursor = 'Euaqz6R-ylLG0gbdej7Me6WwLpcyB1tlVArvLxtE', block_num = 11, block_id = '11' WHERE id = '756e75736564';`,
 				`COMMIT`,
-				`SELECT op,table_name,pk,prev_value,block_num FROM "testschema"."substreams_history" WHERE "block_num" > 10 ORDER BY "block_num" DESC`,
+				`SELECT DISTINCT table_name FROM "testschema"."substreams_history" WHERE "block_num" > 10 ORDER BY table_name`,
 
 				//`DELETE FROM "testschema"."xfer" WHERE "id" = "2345";`, // this mechanism is tested in db.revertOp
 				`DELETE FROM "testschema"."substreams_history" WHERE "block_num" > 10;`,
 				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				createReorgsTableSQL,
+				`INSERT INTO "testschema"."substreams_reorgs" (module_hash, last_valid_block, cursor_before, cursor_after, reverted_rows, duration_ms) VALUES ('756e75736564', 10, 'Euaqz6R-ylLG0gbdej7Me6WwLpcyB1tlVArvLxtE', 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', '{}', 0)`,
+				`COMMIT`,
+			},
+		},
+
+		{
+			name:        "batch live reversible blocks",
+			flushPolicy: FlushPolicy{LiveBlocks: 4},
+			events: []event{
+				{
+					blockNum:     10,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{insertRowSinglePK("xfer", "1234", "from", "sender1")},
+				},
+				{
+					blockNum:     11,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{updateRowMultiplePK("xfer", map[string]string{"id": "1234"}, "from", "sender2")},
+				},
+				{
+					blockNum:     12,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{insertRowSinglePK("xfer", "2345", "from", "sender3")},
+				},
+			},
+			expectSQL: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4),($5,$6,$7,$8); -- [I, "testschema"."xfer", {"id":"1234"}, 10, I, "testschema"."xfer", {"id":"2345"}, 12]`,
+				`INSERT INTO "testschema"."xfer" ("from","id") VALUES ($1,$2),($3,$4); -- [sender1, 1234, sender3, 2345]`,
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,prev_value,block_num) SELECT $1::char,$2::text,$3::jsonb,to_jsonb("xfer"),$4::bigint FROM "testschema"."xfer" WHERE "id" = $5; -- [U, "testschema"."xfer", {"id":"1234"}, 11, 1234]`,
+				`UPDATE "testschema"."xfer" SET "from"=$1 WHERE "id" = $2 -- [sender2, 1234]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'ZBaBEJha4hVM4xTECAoDGKWwLpcyB1hlVAnvLxtE', block_num = 12, block_id = '12' WHERE id = '756e75736564';`,
+				`COMMIT`,
+			},
+		},
+
+		{
+			name:        "batch live reversible blocks, then UNDO last",
+			flushPolicy: FlushPolicy{LiveBlocks: 4},
+			events: []event{
+				{
+					blockNum:     10,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{insertRowSinglePK("xfer", "1234", "from", "sender1")},
+				},
+				{
+					blockNum:     11,
+					libNum:       5,
+					tableChanges: []*pbdatabase.TableChange{insertRowSinglePK("xfer", "2345", "from", "sender2")},
+				},
+				{
+					blockNum:   10, // undo everything above 10
+					libNum:     5,
+					undoSignal: true,
+				},
+			},
+			expectSQL: []string{
+				`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4),($5,$6,$7,$8); -- [I, "testschema"."xfer", {"id":"1234"}, 10, I, "testschema"."xfer", {"id":"2345"}, 11]`,
+				`INSERT INTO "testschema"."xfer" ("from","id") VALUES ($1,$2),($3,$4); -- [sender1, 1234, sender2, 2345]`,
+				`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
+				`UPDATE "testschema"."cursors" set cursor = 'Euaqz6R-ylLG0gbdej7Me6WwLpcyB1tlVArvLxtE', block_num = 11, block_id = '11' WHERE id = '756e75736564';`,
+				`COMMIT`,
+				`SELECT DISTINCT table_name FROM "testschema"."substreams_history" WHERE "block_num" > 10 ORDER BY table_name`,
+				`DELETE FROM "testschema"."substreams_history" WHERE "block_num" > 10;`,
+				`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+				createReorgsTableSQL,
+				`INSERT INTO "testschema"."substreams_reorgs" (module_hash, last_valid_block, cursor_before, cursor_after, reverted_rows, duration_ms) VALUES ('756e75736564', 10, 'Euaqz6R-ylLG0gbdej7Me6WwLpcyB1tlVArvLxtE', 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', '{}', 0)`,
 				`COMMIT`,
 			},
 		},
@@ -214,9 +385,9 @@ func TestInserts(t *testing.T) {
 				"testschema",
 				db.TestTables("testschema"),
 			)
-			s, err := sink.New(sink.SubstreamsModeDevelopment, testPackage, testPackage.Modules.Modules[0], []byte("unused"), testClientConfig, logger, nil)
+			s, err := sink.New(sink.SubstreamsModeDevelopment, false, testPackage, testPackage.Modules.Modules[0], []byte("unused"), testClientConfig, logger, nil)
 			require.NoError(t, err)
-			sinker, _ := New(s, l, logger, nil)
+			sinker, _ := New(s, l, test.flushPolicy, logger, nil)
 
 			for _, evt := range test.events {
 				if evt.undoSignal {
@@ -237,6 +408,8 @@ func TestInserts(t *testing.T) {
 				require.NoError(t, err)
 			}
 
+			require.NoError(t, l.WaitForFlush())
+
 			results := tx.Results()
 			assert.Equal(t, test.expectSQL, results)
 
@@ -245,6 +418,76 @@ func TestInserts(t *testing.T) {
 
 }
 
+func TestLiveMaxLatency(t *testing.T) {
+	ctx := context.Background()
+	l, tx := db.NewTestLoader(logger, tracer, "testschema", db.TestTables("testschema"))
+	s, err := sink.New(sink.SubstreamsModeDevelopment, false, testPackage, testPackage.Modules.Modules[0], []byte("unused"), testClientConfig, logger, nil)
+	require.NoError(t, err)
+	sinker, _ := New(s, l, FlushPolicy{LiveBlocks: 100, LiveMaxLatency: 10 * time.Millisecond}, logger, nil)
+
+	err = sinker.HandleBlockScopedData(
+		ctx,
+		blockScopedData("db_out", []*pbdatabase.TableChange{insertRowSinglePK("xfer", "1234", "from", "sender1")}, 10, 5),
+		flushEveryBlock, sink.MustNewCursor(simpleCursor(10, 5)),
+	)
+	require.NoError(t, err)
+
+	// No other block is received, the latency bound alone triggers the flush
+	require.Eventually(t, func() bool {
+		sinker.lock.Lock()
+		defer sinker.lock.Unlock()
+
+		return sinker.pendingCursor == nil
+	}, 5*time.Second, 5*time.Millisecond)
+	require.NoError(t, l.WaitForFlush())
+
+	assert.Equal(t, []string{
+		`INSERT INTO "testschema"."substreams_history" (op,table_name,pk,block_num) values ($1,$2,$3,$4); -- [I, "testschema"."xfer", {"id":"1234"}, 10]`,
+		`INSERT INTO "testschema"."xfer" ("from","id") VALUES ($1,$2); -- [sender1, 1234]`,
+		`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 5 LIMIT 10000);`,
+		`UPDATE "testschema"."cursors" set cursor = 'i4tY9gOcWnhKoGjRCl2VUKWwLpcyB1plVAvvLxtE', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+		`COMMIT`,
+	}, tx.Results())
+}
+
+func TestBlockRangeCompletion(t *testing.T) {
+	ctx := context.Background()
+	l, tx := db.NewTestLoader(logger, tracer, "testschema", db.TestTables("testschema"))
+	s, err := sink.New(sink.SubstreamsModeDevelopment, false, testPackage, testPackage.Modules.Modules[0], []byte("unused"), testClientConfig, logger, nil)
+	require.NoError(t, err)
+	sinker, _ := New(s, l, FlushPolicy{}, logger, nil)
+
+	isLive := false
+	err = sinker.HandleBlockScopedData(
+		ctx,
+		blockScopedData("db_out", []*pbdatabase.TableChange{insertRowSinglePK("xfer", "1234", "from", "sender1")}, 10, 10),
+		&isLive, sink.MustNewCursor(simpleCursor(10, 10)),
+	)
+	require.NoError(t, err)
+
+	// Block 10 is not a flush boundary, the operations are only pending at this point
+	assert.Empty(t, tx.Results())
+	assert.False(t, sinker.Completed())
+
+	require.NoError(t, sinker.HandleBlockRangeCompletion(ctx, sink.MustNewCursor(simpleCursor(10, 10))))
+
+	assert.True(t, sinker.Completed())
+	assert.Equal(t, []string{
+		`COPY "testschema"."xfer" ("from","id") FROM STDIN -- [sender1, 1234]`,
+		`DELETE FROM "testschema"."substreams_history" WHERE id IN (SELECT id FROM "testschema"."substreams_history" WHERE block_num <= 10 LIMIT 10000);`,
+		`UPDATE "testschema"."cursors" set cursor = 'bN7dsAhRyo44yl_ykkjA36WwLpc_DFtvXwrlIBBBj4r2', block_num = 10, block_id = '10' WHERE id = '756e75736564';`,
+		`COMMIT`,
+		"create table if not exists \"testschema\".\"substreams_completions\"\n(\n" +
+			"\tid           text not null constraint \"substreams_completions_pk\" primary key,\n" +
+			"\tblock_num    bigint,\n" +
+			"\tblock_id     text,\n" +
+			"\tcompleted_at timestamp with time zone default now()\n);",
+		`INSERT INTO "testschema"."substreams_completions" (id, block_num, block_id, completed_at) VALUES ('756e75736564', 10, '10', now())` + "\n" +
+			`ON CONFLICT (id) DO UPDATE SET block_num = EXCLUDED.block_num, block_id = EXCLUDED.block_id, completed_at = EXCLUDED.completed_at;`,
+		`COMMIT`,
+	}, tx.Results())
+}
+
 var T = true
 var flushEveryBlock = &T
 
@@ -323,6 +566,17 @@ func updateRowMultiplePK(table string, pk map[string]string, fieldsAndValues ...
 		Fields:    getFields(fieldsAndValues...),
 	}
 }
+func upsertRowSinglePK(table string, pk string, fieldsAndValues ...string) *pbdatabase.TableChange {
+	return &pbdatabase.TableChange{
+		Table: table,
+		PrimaryKey: &pbdatabase.TableChange_Pk{
+			Pk: pk,
+		},
+		Operation: TableChange_UPSERT,
+		Fields:    getFields(fieldsAndValues...),
+	}
+}
+
 func deleteRowMultiplePK(table string, pk map[string]string) *pbdatabase.TableChange {
 	return &pbdatabase.TableChange{
 		Table: table,